@@ -0,0 +1,87 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Command proxy-wasm-replay replays a log written by replay.Recorder against a
+// wasm module and reports where the module diverges from the recording.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"mosn.io/proxy-wasm-go-host/proxywasm/replay"
+	"mosn.io/proxy-wasm-go-host/wasmer"
+)
+
+func main() {
+	os.Exit(run())
+}
+
+func run() int {
+	modulePath := flag.String("module", "", "path of the wasm module")
+	logPath := flag.String("log", "", "path of the recorded log")
+	flag.Parse()
+
+	if *modulePath == "" || *logPath == "" {
+		flag.Usage()
+		return 2
+	}
+
+	instance := wasmer.NewWasmerInstanceFromFile(*modulePath)
+	if instance == nil {
+		fmt.Fprintf(os.Stderr, "failed to load module %s\n", *modulePath)
+		return 2
+	}
+
+	f, err := os.Open(filepath.Clean(*logPath))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer f.Close()
+
+	replayer, err := replay.NewReplayer(instance, f)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if err = replayer.RegisterImports(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	err = replayer.Run()
+
+	var divergence *replay.Divergence
+	if errors.As(err, &divergence) {
+		fmt.Println(divergence)
+		return 1
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	fmt.Printf("replayed %d records without divergence\n", replayer.Len())
+
+	return 0
+}
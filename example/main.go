@@ -24,8 +24,10 @@ import (
 	"path/filepath"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+	"mosn.io/proxy-wasm-go-host/proxywasm/nethttp"
 	proxywasm "mosn.io/proxy-wasm-go-host/proxywasm/v1"
 	"mosn.io/proxy-wasm-go-host/wasmer"
 )
@@ -37,6 +39,9 @@ var lock sync.Mutex
 var once sync.Once
 var instance common.WasmInstance
 
+// properties shared by all the requests, e.g. plugin_name
+var pluginProperties = common.NewPropertyStore(nil)
+
 // implement proxywasm.ImportsHandler.
 type importHandler struct {
 	reqHeader common.HeaderMap
@@ -56,6 +61,7 @@ func (im *importHandler) Log(level proxywasm.LogLevel, msg string) proxywasm.Was
 
 // serve HTTP req
 func ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
 	fmt.Printf("receive request %s\n", r.URL)
 	for k, v := range r.Header {
 		fmt.Printf("print header from server host, %v -> %v\n", k, v)
@@ -64,9 +70,18 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// get wasm vm instance
 	instance := getWasmInstance()
 
+	reqHeader := nethttp.NewRequestHeaderMap(r)
+
+	// expose the request attributes, e.g. request.path, to the plugin
+	properties := common.NewPropertyStore(pluginProperties)
+	nethttp.RegisterRequestAttributes(properties, r, start)
+
 	// create abi context
 	ctx := &proxywasm.ABIContext{
-		Imports:  &importHandler{reqHeader: &myHeaderMap{r.Header}},
+		Imports: &importHandler{
+			reqHeader:             reqHeader,
+			DefaultImportsHandler: proxywasm.DefaultImportsHandler{Properties: properties},
+		},
 		Instance: instance,
 	}
 
@@ -80,18 +95,21 @@ func ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		_ = ctx.GetExports().ProxyOnContextCreate(rootContextID, 0)
 	})
 
-	// lock wasm vm instance for exclusive ownership
+	// lock wasm vm instance for exclusive ownership, and create wasm-side
+	// context id for current http req
 	instance.Lock(ctx)
-	defer instance.Unlock()
-
-	// create wasm-side context id for current http req
 	_ = ctx.GetExports().ProxyOnContextCreate(contextID, rootContextID)
+	instance.Unlock()
 
-	// call wasm-side on_request_header
-	_, _ = ctx.GetExports().ProxyOnRequestHeaders(contextID, int32(len(r.Header)), 1)
+	// call wasm-side on_request_header, the instance being released to the
+	// other requests if the plugin pauses this one
+	stream := proxywasm.NewStream(ctx, contextID)
+	_, _ = stream.OnRequestHeaders(r.Context(), int32(reqHeader.Len()), true)
 
 	// delete wasm-side context id to prevent memory leak
+	instance.Lock(ctx)
 	_ = ctx.GetExports().ProxyOnDelete(contextID)
+	instance.Unlock()
 
 	// reply with ok
 	w.WriteHeader(http.StatusOK)
@@ -101,6 +119,8 @@ func main() {
 	// create root context id
 	rootContextID = atomic.AddInt32(&contextIDGenerator, 1)
 
+	nethttp.SetPluginAttributes(pluginProperties, "example", "", "")
+
 	// serve http
 	http.HandleFunc("/", ServeHTTP)
 	_ = http.ListenAndServe("127.0.0.1:2045", nil)
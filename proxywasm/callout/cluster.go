@@ -0,0 +1,318 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callout
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LoadBalancing is the way a cluster picks an endpoint for each callout.
+type LoadBalancing string
+
+const (
+	RoundRobin LoadBalancing = "round_robin"
+	Random     LoadBalancing = "random"
+)
+
+// Duration is a time.Duration read from JSON as a string, e.g. "1.5s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+
+	return nil
+}
+
+// TLSConfig is the TLS configuration of the connections to a cluster.
+type TLSConfig struct {
+	// ServerName is the SNI, and the name checked against the certificate of
+	// the endpoints, the host of the endpoint if empty.
+	ServerName string `json:"server_name,omitempty"`
+	// CAFile is a PEM file of the CAs trusted instead of the system ones.
+	CAFile string `json:"ca_file,omitempty"`
+	// CertFile and KeyFile are the PEM files of the client certificate.
+	CertFile           string `json:"cert_file,omitempty"`
+	KeyFile            string `json:"key_file,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+}
+
+// Cluster is a named group of endpoints the callouts of the plugins are sent to.
+type Cluster struct {
+	Name string `json:"name"`
+	// Endpoints are the "host:port" of the endpoints.
+	Endpoints     []string      `json:"endpoints"`
+	LoadBalancing LoadBalancing `json:"load_balancing,omitempty"`
+	// Timeout bounds the callouts sent to the cluster, including the ones
+	// given a longer timeout by the plugins, none if 0.
+	Timeout Duration `json:"timeout,omitempty"`
+	// TLS enables TLS when not nil.
+	TLS *TLSConfig `json:"tls,omitempty"`
+	// MaxConnsPerEndpoint limits the connections to each endpoint, no limit if 0.
+	MaxConnsPerEndpoint int `json:"max_conns_per_endpoint,omitempty"`
+	// MaxIdleConnsPerEndpoint is the number of idle connections kept to each
+	// endpoint, 2 if 0.
+	MaxIdleConnsPerEndpoint int `json:"max_idle_conns_per_endpoint,omitempty"`
+	// IdleTimeout closes the idle connections after that time, 90s if 0.
+	IdleTimeout Duration `json:"idle_timeout,omitempty"`
+	// Retry retries the callouts sent to the cluster, unless they have their
+	// own retry policy.
+	Retry *RetryPolicy `json:"retry,omitempty"`
+	// Handler serves the callouts in process instead of the endpoints, e.g.
+	// for tests or for services of the same binary.
+	Handler http.Handler `json:"-"`
+
+	next      uint32
+	transport *http.Transport
+	client    *http.Client
+}
+
+// init checks the configuration and creates the connection pool.
+func (c *Cluster) init() error {
+	if c.Name == "" {
+		return errors.New("cluster without name")
+	}
+	if c.Handler != nil {
+		c.client = &http.Client{Transport: &handlerTransport{handler: c.Handler}}
+		return nil
+	}
+	if len(c.Endpoints) == 0 {
+		return fmt.Errorf("cluster %s: no endpoints", c.Name)
+	}
+
+	switch c.LoadBalancing {
+	case "":
+		c.LoadBalancing = RoundRobin
+	case RoundRobin, Random:
+	default:
+		return fmt.Errorf("cluster %s: unknown load balancing %s", c.Name, c.LoadBalancing)
+	}
+
+	idleTimeout := time.Duration(c.IdleTimeout)
+	if idleTimeout == 0 {
+		idleTimeout = 90 * time.Second
+	}
+
+	c.transport = &http.Transport{
+		ForceAttemptHTTP2:   true,
+		MaxConnsPerHost:     c.MaxConnsPerEndpoint,
+		MaxIdleConnsPerHost: c.MaxIdleConnsPerEndpoint,
+		IdleConnTimeout:     idleTimeout,
+	}
+
+	if c.TLS != nil {
+		config, err := c.TLS.config()
+		if err != nil {
+			return fmt.Errorf("cluster %s: %w", c.Name, err)
+		}
+		c.transport.TLSClientConfig = config
+	}
+
+	c.client = &http.Client{Transport: c.transport}
+
+	return nil
+}
+
+func (t *TLSConfig) config() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         t.ServerName,
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+
+	if t.CAFile != "" {
+		pem, err := ioutil.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", t.CAFile)
+		}
+	}
+
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// Pick returns the base URL of the endpoint the next callout is sent to,
+// e.g. "https://10.0.0.1:8443".
+func (c *Cluster) Pick() string {
+	if c.Handler != nil {
+		return "http://" + inProcessHost
+	}
+
+	var i int
+	if c.LoadBalancing == Random {
+		i = rand.Intn(len(c.Endpoints))
+	} else {
+		i = int((atomic.AddUint32(&c.next, 1) - 1) % uint32(len(c.Endpoints)))
+	}
+
+	if c.TLS != nil {
+		return "https://" + c.Endpoints[i]
+	}
+	return "http://" + c.Endpoints[i]
+}
+
+// Client returns the client sending the requests to the cluster, sharing
+// the connection pool of the cluster.
+func (c *Cluster) Client() *http.Client {
+	return c.client
+}
+
+// Transport returns the transport of the cluster, e.g. to build another
+// client, nil for an in-process cluster.
+func (c *Cluster) Transport() *http.Transport {
+	return c.transport
+}
+
+func (c *Cluster) closeIdleConnections() {
+	if c.transport != nil {
+		c.transport.CloseIdleConnections()
+	}
+}
+
+// ClampTimeout returns the timeout of a callout given timeout by the plugin.
+func (c *Cluster) ClampTimeout(timeout time.Duration) time.Duration {
+	if limit := time.Duration(c.Timeout); limit > 0 && (timeout == 0 || timeout > limit) {
+		return limit
+	}
+	return timeout
+}
+
+// Clusters is a registry of clusters by name.
+type Clusters struct {
+	lock sync.RWMutex
+	m    map[string]*Cluster
+}
+
+func NewClusters() *Clusters {
+	return &Clusters{m: make(map[string]*Cluster)}
+}
+
+// LoadClusters reads the clusters of a JSON file of the form
+// {"clusters": [{"name": "auth", "endpoints": ["10.0.0.1:8080"]}]}.
+func LoadClusters(path string) (*Clusters, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Clusters []*Cluster `json:"clusters"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	c := NewClusters()
+	for _, cluster := range config.Clusters {
+		if err := c.Add(cluster); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	return c, nil
+}
+
+// Add adds cluster, replacing the cluster of the same name. The cluster
+// must not be changed afterwards.
+func (c *Clusters) Add(cluster *Cluster) error {
+	if err := cluster.init(); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	prev := c.m[cluster.Name]
+	c.m[cluster.Name] = cluster
+	c.lock.Unlock()
+
+	if prev != nil {
+		prev.closeIdleConnections()
+	}
+
+	return nil
+}
+
+// AddHandler adds a cluster whose callouts are served by handler in process.
+func (c *Clusters) AddHandler(name string, handler http.Handler) error {
+	return c.Add(&Cluster{Name: name, Handler: handler})
+}
+
+// Remove removes the cluster name.
+func (c *Clusters) Remove(name string) {
+	c.lock.Lock()
+	prev := c.m[name]
+	delete(c.m, name)
+	c.lock.Unlock()
+
+	if prev != nil {
+		prev.closeIdleConnections()
+	}
+}
+
+// Get returns the cluster name.
+func (c *Clusters) Get(name string) (*Cluster, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	cluster, ok := c.m[name]
+	return cluster, ok
+}
+
+// RetryPolicy returns the retry policy of the cluster name, nil if none.
+func (c *Clusters) RetryPolicy(name string) *RetryPolicy {
+	if c == nil {
+		return nil
+	}
+
+	cluster, ok := c.Get(name)
+	if !ok {
+		return nil
+	}
+	return cluster.Retry
+}
@@ -0,0 +1,143 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callout
+
+import (
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+)
+
+func getRequest() *Request {
+	return &Request{
+		Upstream: "backend",
+		Headers: common.NewCommonHeader(
+			common.HeaderPair{Key: ":method", Value: "GET"},
+			common.HeaderPair{Key: ":path", Value: "/"},
+			common.HeaderPair{Key: ":authority", Value: "backend"},
+		),
+	}
+}
+
+func TestClusterRoundRobin(t *testing.T) {
+	var servers []string
+	for _, name := range []string{"a", "b"} {
+		name := name
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(name))
+		}))
+		defer server.Close()
+		servers = append(servers, server.Listener.Addr().String())
+	}
+
+	clusters := NewClusters()
+	assert.Nil(t, clusters.Add(&Cluster{Name: "backend", Endpoints: servers}))
+
+	d := NewDispatcher(nil)
+	d.Clusters = clusters
+
+	var bodies []string
+	for i := 0; i < 4; i++ {
+		id, err := d.Dispatch(getRequest())
+		assert.Nil(t, err)
+		bodies = append(bodies, string(await(t, d, id).Body.Bytes()))
+	}
+	assert.Equal(t, []string{"a", "b", "a", "b"}, bodies)
+
+	// only the registered clusters are reachable
+	req := getRequest()
+	req.Upstream = servers[0]
+	_, err := d.Dispatch(req)
+	assert.True(t, errors.Is(err, ErrUnknownUpstream))
+
+	clusters.Remove("backend")
+	_, err = d.Dispatch(getRequest())
+	assert.True(t, errors.Is(err, ErrUnknownUpstream))
+}
+
+func TestClusterTimeout(t *testing.T) {
+	c := &Cluster{Name: "backend", Endpoints: []string{"a:80", "b:80"}, LoadBalancing: Random, Timeout: Duration(time.Second)}
+	assert.Nil(t, NewClusters().Add(c))
+
+	assert.Equal(t, time.Second, c.ClampTimeout(0))
+	assert.Equal(t, time.Second, c.ClampTimeout(time.Minute))
+	assert.Equal(t, time.Millisecond, c.ClampTimeout(time.Millisecond))
+
+	for i := 0; i < 10; i++ {
+		assert.Contains(t, []string{"http://a:80", "http://b:80"}, c.Pick())
+	}
+
+	assert.NotNil(t, NewClusters().Add(&Cluster{Name: "backend"}))
+	assert.NotNil(t, NewClusters().Add(&Cluster{Name: "backend", Endpoints: []string{"a:80"}, LoadBalancing: "least_request"}))
+}
+
+func TestLoadClusters(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("secure"))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "clusters")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := filepath.Join(dir, "ca.pem")
+	assert.Nil(t, ioutil.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600))
+
+	config := filepath.Join(dir, "clusters.json")
+	assert.Nil(t, ioutil.WriteFile(config, []byte(`{"clusters": [{
+		"name": "backend",
+		"endpoints": ["`+server.Listener.Addr().String()+`"],
+		"timeout": "5s",
+		"tls": {"server_name": "example.com", "ca_file": "`+filepath.ToSlash(ca)+`"},
+		"max_conns_per_endpoint": 4,
+		"retry": {"max_attempts": 3, "retry_on": [503], "retry_on_grpc": [14], "hedge_delay": "50ms"}
+	}]}`), 0600))
+
+	clusters, err := LoadClusters(config)
+	assert.Nil(t, err)
+
+	c, ok := clusters.Get("backend")
+	assert.True(t, ok)
+	assert.Equal(t, Duration(5*time.Second), c.Timeout)
+	assert.Equal(t, &RetryPolicy{MaxAttempts: 3, RetryOn: []int{503}, RetryOnGrpc: []int32{14}, HedgeDelay: Duration(50 * time.Millisecond)}, clusters.RetryPolicy("backend"))
+	assert.True(t, strings.HasPrefix(c.Pick(), "https://"))
+
+	d := NewDispatcher(nil)
+	d.Clusters = clusters
+
+	id, err := d.Dispatch(getRequest())
+	assert.Nil(t, err)
+	resp := await(t, d, id)
+	assert.Nil(t, resp.Err)
+	assert.Equal(t, "secure", string(resp.Body.Bytes()))
+
+	assert.Nil(t, ioutil.WriteFile(config, []byte(`{"clusters": [{"name": "backend", "timeout": "soon"}]}`), 0600))
+	_, err = LoadClusters(config)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,360 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package callout sends the HTTP callouts of the plugins, i.e. the requests of
+// proxy_http_call, with net/http.
+package callout
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+	"mosn.io/proxy-wasm-go-host/proxywasm/nethttp"
+)
+
+var (
+	ErrBadRequest      = errors.New("bad callout request")
+	ErrUnknownUpstream = errors.New("unknown upstream")
+)
+
+// Resolver resolves the upstream names given by the plugins, e.g. cluster
+// names, to base URLs such as "http://127.0.0.1:8080".
+type Resolver interface {
+	Resolve(upstream string) (string, error)
+}
+
+// ResolverFunc is a func implementing Resolver.
+type ResolverFunc func(upstream string) (string, error)
+
+func (f ResolverFunc) Resolve(upstream string) (string, error) {
+	return f(upstream)
+}
+
+// Request is a callout request, as given by a plugin.
+type Request struct {
+	// Upstream is the name of the upstream, see Resolver.
+	Upstream string
+	// Headers holds :method, :path and :authority, and optionally :scheme,
+	// along with the headers to send.
+	Headers  common.HeaderMap
+	Body     []byte
+	Trailers common.HeaderMap
+	// Timeout is the timeout of the whole callout, none if 0.
+	Timeout time.Duration
+	// MaxResponseSize is the maximum size of the response body, none if 0.
+	MaxResponseSize int64
+	// Retry retries the callout, instead of the retry policy of its cluster.
+	Retry *RetryPolicy
+}
+
+// Response is the response of a callout. The maps and the body are empty if
+// the callout failed, Err then telling why.
+type Response struct {
+	// Headers holds :status along with the response headers.
+	Headers  common.HeaderMap
+	Body     common.IoBuffer
+	Trailers common.HeaderMap
+	Err      error
+}
+
+// Dispatcher sends callouts and keeps their responses until they are claimed
+// by OnResponse.
+type Dispatcher struct {
+	// Clusters routes the callouts by cluster name, with the load balancing,
+	// timeout and connection pool of the cluster, instead of Client and
+	// Resolver. The callouts to unknown clusters are then rejected.
+	Clusters *Clusters
+	// Client sends the requests, http.DefaultClient if nil.
+	Client *http.Client
+	// Resolver resolves the upstreams, nil resolving "host:port" to
+	// "http://host:port" and keeping URLs as is.
+	Resolver Resolver
+
+	lock    sync.Mutex
+	nextID  uint32
+	pending map[uint32]*pendingCallout
+}
+
+type pendingCallout struct {
+	resp   *Response
+	f      func(resp *Response)
+	cancel context.CancelFunc
+}
+
+func NewDispatcher(resolver Resolver) *Dispatcher {
+	return &Dispatcher{
+		Resolver: resolver,
+		pending:  make(map[uint32]*pendingCallout),
+	}
+}
+
+// Dispatch sends req in the background and returns the id of the callout
+// right away. The request is checked beforehand, ErrBadRequest or
+// ErrUnknownUpstream being returned if it can't be sent. The body is copied,
+// the caller may reuse it once Dispatch returns.
+func (d *Dispatcher) Dispatch(req *Request) (uint32, error) {
+	// each attempt reads the body again
+	copied := *req
+	copied.Body = append([]byte(nil), req.Body...)
+	req = &copied
+
+	r, client, timeout, err := d.newRequest(req)
+	if err != nil {
+		return 0, err
+	}
+
+	// the callout can be canceled until it completes
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	retry := req.Retry
+	if retry == nil {
+		retry = d.Clusters.RetryPolicy(req.Upstream)
+	}
+
+	// each attempt is routed on its own, possibly to another endpoint
+	run, _ := retry.start(ctx, func(ctx context.Context, n int) (func() (interface{}, bool), error) {
+		attempt, client := r, client
+		if n > 1 {
+			var err error
+			if attempt, client, _, err = d.newRequest(req); err != nil {
+				return func() (interface{}, bool) { return failedResponse(err), false }, nil
+			}
+		}
+		attempt = attempt.WithContext(ctx)
+
+		return func() (interface{}, bool) {
+			resp := d.do(client, attempt, req.MaxResponseSize)
+			return resp, retry.retryResponse(ctx, resp)
+		}, nil
+	})
+
+	d.lock.Lock()
+	d.nextID++
+	if d.nextID == 0 {
+		d.nextID++
+	}
+	id := d.nextID
+	d.pending[id] = &pendingCallout{cancel: cancel}
+	d.lock.Unlock()
+
+	go func() {
+		defer cancel()
+		d.complete(id, run().(*Response))
+	}()
+
+	return id, nil
+}
+
+// OnResponse makes f be called with the response of the callout id once it
+// arrives, right away if it already did. It returns false if id is unknown.
+func (d *Dispatcher) OnResponse(id uint32, f func(resp *Response)) bool {
+	d.lock.Lock()
+
+	p, ok := d.pending[id]
+	if !ok {
+		d.lock.Unlock()
+		return false
+	}
+
+	if p.resp == nil {
+		p.f = f
+		d.lock.Unlock()
+		return true
+	}
+
+	delete(d.pending, id)
+	d.lock.Unlock()
+
+	f(p.resp)
+
+	return true
+}
+
+// Cancel cancels the callout id and forgets it, its response is never
+// delivered. It returns false if id is unknown or already delivered.
+func (d *Dispatcher) Cancel(id uint32) bool {
+	d.lock.Lock()
+	p, ok := d.pending[id]
+	delete(d.pending, id)
+	d.lock.Unlock()
+
+	if ok {
+		p.cancel()
+	}
+	return ok
+}
+
+func (d *Dispatcher) complete(id uint32, resp *Response) {
+	d.lock.Lock()
+
+	p, ok := d.pending[id]
+	if !ok {
+		// canceled
+		d.lock.Unlock()
+		return
+	}
+	if p.f == nil {
+		p.resp = resp
+		d.lock.Unlock()
+		return
+	}
+
+	delete(d.pending, id)
+	d.lock.Unlock()
+
+	p.f(resp)
+}
+
+func (d *Dispatcher) newRequest(req *Request) (*http.Request, *http.Client, time.Duration, error) {
+	method, _ := req.Headers.Get(":method")
+	path, _ := req.Headers.Get(":path")
+	authority, _ := req.Headers.Get(":authority")
+	if method == "" || path == "" || authority == "" {
+		return nil, nil, 0, fmt.Errorf("%w: :method, :path and :authority are required", ErrBadRequest)
+	}
+
+	base, client, timeout, err := d.route(req.Upstream, req.Timeout)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if scheme, ok := req.Headers.Get(":scheme"); ok && scheme != "" {
+		if i := strings.Index(base, "://"); i >= 0 {
+			base = scheme + base[i:]
+		}
+	}
+
+	r, err := http.NewRequest(method, strings.TrimSuffix(base, "/")+path, bytes.NewReader(req.Body))
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+	r.Host = authority
+
+	req.Headers.Range(func(key, value string) bool {
+		if !strings.HasPrefix(key, ":") {
+			r.Header.Add(key, value)
+		}
+		return true
+	})
+
+	if req.Trailers != nil && req.Trailers.Len() > 0 {
+		// the trailers are sent with a chunked body
+		r.ContentLength = -1
+		r.Trailer = make(http.Header)
+		req.Trailers.Range(func(key, value string) bool {
+			r.Trailer.Add(key, value)
+			return true
+		})
+	}
+
+	return r, client, timeout, nil
+}
+
+// route returns the base URL and the client of upstream, and the timeout of
+// a callout given timeout by the plugin.
+func (d *Dispatcher) route(upstream string, timeout time.Duration) (string, *http.Client, time.Duration, error) {
+	return route(d.Clusters, d.Client, d.Resolver, upstream, timeout)
+}
+
+// route returns the base URL and the client of upstream, through clusters if
+// set, along with the timeout to use.
+func route(clusters *Clusters, client *http.Client, resolver Resolver, upstream string, timeout time.Duration) (string, *http.Client, time.Duration, error) {
+	if clusters != nil {
+		cluster, ok := clusters.Get(upstream)
+		if !ok {
+			return "", nil, 0, fmt.Errorf("%w: %s", ErrUnknownUpstream, upstream)
+		}
+		return cluster.Pick(), cluster.Client(), cluster.ClampTimeout(timeout), nil
+	}
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	if resolver != nil {
+		base, err := resolver.Resolve(upstream)
+		return base, client, timeout, err
+	}
+
+	if upstream == "" {
+		return "", nil, 0, fmt.Errorf("%w: empty upstream", ErrUnknownUpstream)
+	}
+	if strings.Contains(upstream, "://") {
+		return upstream, client, timeout, nil
+	}
+	return "http://" + upstream, client, timeout, nil
+}
+
+func (d *Dispatcher) do(client *http.Client, r *http.Request, maxBodySize int64) *Response {
+	resp, err := client.Do(r)
+	if err != nil {
+		return failedResponse(err)
+	}
+
+	rc := resp.Body
+	if maxBodySize > 0 {
+		rc = struct {
+			io.Reader
+			io.Closer
+		}{io.LimitReader(resp.Body, maxBodySize+1), resp.Body}
+	}
+
+	body, err := nethttp.ReadBody(rc)
+	if err != nil {
+		return failedResponse(err)
+	}
+	if maxBodySize > 0 && int64(body.Len()) > maxBodySize {
+		return failedResponse(ErrResponseTooLarge)
+	}
+
+	// the plugins see lower-case keys, as with Envoy
+	headers := common.NewCommonHeader()
+	nethttp.NewResponseHeaderMap(resp).Range(func(key, value string) bool {
+		headers.Add(strings.ToLower(key), value)
+		return true
+	})
+
+	trailers := common.NewCommonHeader()
+	nethttp.NewHeaderMap(resp.Trailer).Range(func(key, value string) bool {
+		trailers.Add(strings.ToLower(key), value)
+		return true
+	})
+
+	return &Response{Headers: headers, Body: body, Trailers: trailers}
+}
+
+func failedResponse(err error) *Response {
+	return &Response{
+		Headers:  common.NewCommonHeader(),
+		Body:     common.NewIoBufferBytes(nil),
+		Trailers: common.NewCommonHeader(),
+		Err:      err,
+	}
+}
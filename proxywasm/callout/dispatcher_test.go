@@ -0,0 +1,172 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callout
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+)
+
+func await(t *testing.T, d *Dispatcher, id uint32) *Response {
+	ch := make(chan *Response, 1)
+	assert.True(t, d.OnResponse(id, func(resp *Response) { ch <- resp }))
+
+	select {
+	case resp := <-ch:
+		return resp
+	case <-time.After(5 * time.Second):
+		t.Fatal("no response")
+	}
+	return nil
+}
+
+func TestDispatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/auth?x=1", r.URL.RequestURI())
+		assert.Equal(t, "auth.local", r.Host)
+		assert.Equal(t, "token", r.Header.Get("Authorization"))
+		assert.Equal(t, "payload", string(body))
+		assert.Equal(t, "done", r.Trailer.Get("X-Checksum"))
+
+		w.Header().Set("Trailer", "X-Result")
+		w.Header().Set("X-Auth", "ok")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("allowed"))
+		w.Header().Set("X-Result", "1")
+	}))
+	defer server.Close()
+
+	d := NewDispatcher(ResolverFunc(func(upstream string) (string, error) {
+		assert.Equal(t, "auth_cluster", upstream)
+		return server.URL, nil
+	}))
+
+	id, err := d.Dispatch(&Request{
+		Upstream: "auth_cluster",
+		Headers: common.NewCommonHeader(
+			common.HeaderPair{Key: ":method", Value: "POST"},
+			common.HeaderPair{Key: ":path", Value: "/auth?x=1"},
+			common.HeaderPair{Key: ":authority", Value: "auth.local"},
+			common.HeaderPair{Key: "authorization", Value: "token"},
+		),
+		Body:     []byte("payload"),
+		Trailers: common.NewCommonHeader(common.HeaderPair{Key: "x-checksum", Value: "done"}),
+		Timeout:  5 * time.Second,
+	})
+	assert.Nil(t, err)
+
+	resp := await(t, d, id)
+	assert.Nil(t, resp.Err)
+
+	status, _ := resp.Headers.Get(":status")
+	assert.Equal(t, "201", status)
+	auth, _ := resp.Headers.Get("x-auth")
+	assert.Equal(t, "ok", auth)
+	assert.Equal(t, "allowed", string(resp.Body.Bytes()))
+	result, _ := resp.Trailers.Get("x-result")
+	assert.Equal(t, "1", result)
+
+	// the response is delivered once
+	assert.False(t, d.OnResponse(id, func(*Response) {}))
+}
+
+func TestDispatchErrors(t *testing.T) {
+	d := NewDispatcher(nil)
+
+	_, err := d.Dispatch(&Request{
+		Upstream: "127.0.0.1:1",
+		Headers:  common.NewCommonHeader(common.HeaderPair{Key: ":method", Value: "GET"}),
+	})
+	assert.True(t, errors.Is(err, ErrBadRequest))
+
+	_, err = d.Dispatch(&Request{
+		Headers: common.NewCommonHeader(
+			common.HeaderPair{Key: ":method", Value: "GET"},
+			common.HeaderPair{Key: ":path", Value: "/"},
+			common.HeaderPair{Key: ":authority", Value: "a"},
+		),
+	})
+	assert.True(t, errors.Is(err, ErrUnknownUpstream))
+
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer server.Close()
+	defer close(block)
+
+	id, err := d.Dispatch(&Request{
+		Upstream: server.Listener.Addr().String(),
+		Headers: common.NewCommonHeader(
+			common.HeaderPair{Key: ":method", Value: "GET"},
+			common.HeaderPair{Key: ":path", Value: "/"},
+			common.HeaderPair{Key: ":authority", Value: "a"},
+		),
+		Timeout: 50 * time.Millisecond,
+	})
+	assert.Nil(t, err)
+
+	// a failed callout gets an empty response
+	resp := await(t, d, id)
+	assert.NotNil(t, resp.Err)
+	assert.Equal(t, 0, resp.Headers.Len())
+	assert.Equal(t, 0, resp.Body.Len())
+}
+
+func TestDispatchCancel(t *testing.T) {
+	received, canceled := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-r.Context().Done()
+		close(canceled)
+	}))
+	defer server.Close()
+
+	d := NewDispatcher(nil)
+	id, err := d.Dispatch(&Request{
+		Upstream: server.Listener.Addr().String(),
+		Headers: common.NewCommonHeader(
+			common.HeaderPair{Key: ":method", Value: "GET"},
+			common.HeaderPair{Key: ":path", Value: "/"},
+			common.HeaderPair{Key: ":authority", Value: "a"},
+		),
+	})
+	assert.Nil(t, err)
+
+	<-received
+
+	// the request is aborted and the id forgotten
+	assert.True(t, d.Cancel(id))
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request not canceled")
+	}
+	assert.False(t, d.Cancel(id))
+	assert.False(t, d.OnResponse(id, func(resp *Response) {}))
+}
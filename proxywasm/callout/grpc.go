@@ -0,0 +1,490 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callout
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+)
+
+var ErrCallNotFound = errors.New("grpc call not found")
+
+// The gRPC status codes used by the host.
+const (
+	GrpcStatusOk                int32 = 0
+	GrpcStatusCanceled          int32 = 1
+	GrpcStatusUnknown           int32 = 2
+	GrpcStatusDeadlineExceeded  int32 = 4
+	GrpcStatusPermissionDenied  int32 = 7
+	GrpcStatusResourceExhausted int32 = 8
+	GrpcStatusUnimplemented     int32 = 12
+	GrpcStatusInternal          int32 = 13
+	GrpcStatusUnavailable       int32 = 14
+	GrpcStatusUnauthenticated   int32 = 16
+)
+
+// GrpcRequest opens a gRPC call.
+type GrpcRequest struct {
+	// Upstream is the name of the upstream, see Clusters.
+	Upstream string
+	Service  string
+	Method   string
+	// Metadata is the initial metadata sent with the request.
+	Metadata common.HeaderMap
+	// Timeout is the timeout of the whole call, none if 0.
+	Timeout time.Duration
+	// MaxMessageSize is the maximum size of a received message,
+	// MaxGrpcMessageSize if 0.
+	MaxMessageSize int64
+	// Retry retries the unary call, instead of the retry policy of its
+	// upstream if the transport has some.
+	Retry *RetryPolicy
+}
+
+// GrpcEventType is the type of a GrpcEvent.
+type GrpcEventType int
+
+const (
+	GrpcHeaders GrpcEventType = iota
+	GrpcMessage
+	GrpcTrailers
+	GrpcClose
+)
+
+// GrpcEvent is received from a gRPC call. The events of a call are, in
+// order: the headers, the messages, the trailers and at last the close.
+type GrpcEvent struct {
+	Type GrpcEventType
+	// Metadata is set for GrpcHeaders and GrpcTrailers.
+	Metadata common.HeaderMap
+	// Message is set for GrpcMessage.
+	Message common.IoBuffer
+	// Status is the gRPC status code of GrpcClose.
+	Status int32
+	// Err tells why the call failed on the host side, if it did, for
+	// GrpcClose.
+	Err error
+
+	call *grpcCall
+}
+
+// Canceled returns true if the call of the event has been canceled since,
+// the event must then be dropped.
+func (ev *GrpcEvent) Canceled() bool {
+	return ev.call != nil && atomic.LoadInt32(&ev.call.canceled) != 0
+}
+
+// GrpcTransport opens gRPC calls.
+type GrpcTransport interface {
+	// Open starts the call req, the received events being given to deliver
+	// in order, ending with a GrpcClose event. The call is canceled along
+	// with ctx, no event being delivered afterwards.
+	Open(ctx context.Context, req *GrpcRequest, deliver func(ev *GrpcEvent)) (GrpcStream, error)
+}
+
+// retryPolicyResolver is implemented by the transports giving retry
+// policies to their upstreams.
+type retryPolicyResolver interface {
+	retryPolicy(upstream string) *RetryPolicy
+}
+
+// GrpcStream sends the messages of a gRPC call.
+type GrpcStream interface {
+	// Send sends msg without blocking.
+	Send(msg []byte) error
+	// CloseSend ends the messages of the call.
+	CloseSend() error
+}
+
+// GrpcDispatcher runs the gRPC calls and streams of the plugins, and keeps
+// their events until they are claimed by OnEvent.
+type GrpcDispatcher struct {
+	transport GrpcTransport
+
+	lock   sync.Mutex
+	nextID uint32
+	calls  map[uint32]*grpcCall
+}
+
+type grpcCall struct {
+	stream   GrpcStream
+	cancel   context.CancelFunc
+	canceled int32
+
+	events []*GrpcEvent
+	f      func(ev *GrpcEvent)
+	closed bool
+}
+
+func NewGrpcDispatcher(transport GrpcTransport) *GrpcDispatcher {
+	return &GrpcDispatcher{
+		transport: transport,
+		calls:     make(map[uint32]*grpcCall),
+	}
+}
+
+// Call starts a unary call sending msg, and returns its id right away. The
+// call is retried according to its retry policy, the events of the final
+// attempt only being delivered. msg is copied, the caller may reuse it once
+// Call returns.
+func (d *GrpcDispatcher) Call(req *GrpcRequest, msg []byte) (uint32, error) {
+	// each attempt sends the message again
+	msg = append([]byte(nil), msg...)
+
+	retry := req.Retry
+	if r, ok := d.transport.(retryPolicyResolver); ok && retry == nil {
+		retry = r.retryPolicy(req.Upstream)
+	}
+	if retry.enabled() {
+		return d.retryCall(req, msg, retry)
+	}
+
+	id, call, err := d.open(req)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := call.stream.Send(msg); err != nil {
+		d.abort(id, call)
+		return 0, err
+	}
+	if err := call.stream.CloseSend(); err != nil {
+		d.abort(id, call)
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// Open starts a stream, and returns its id right away.
+func (d *GrpcDispatcher) Open(req *GrpcRequest) (uint32, error) {
+	id, _, err := d.open(req)
+	return id, err
+}
+
+func (d *GrpcDispatcher) open(req *GrpcRequest) (uint32, *grpcCall, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	call := &grpcCall{cancel: cancel}
+	id := d.add(call)
+
+	stream, err := d.transport.Open(ctx, req, func(ev *GrpcEvent) {
+		d.deliver(id, call, ev)
+	})
+	if err != nil {
+		d.abort(id, call)
+		return 0, nil, err
+	}
+	call.stream = stream
+
+	return id, call, nil
+}
+
+func (d *GrpcDispatcher) retryCall(req *GrpcRequest, msg []byte, retry *RetryPolicy) (uint32, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	call := &grpcCall{cancel: cancel, stream: unaryStream{}}
+	id := d.add(call)
+
+	if req.Timeout > 0 {
+		// the timeout spans all the attempts
+		ctx, cancel = context.WithTimeout(ctx, req.Timeout)
+	}
+
+	run, err := retry.start(ctx, func(ctx context.Context, n int) (func() (interface{}, bool), error) {
+		attempt := &grpcAttempt{done: make(chan struct{})}
+
+		stream, err := d.transport.Open(ctx, req, attempt.deliver)
+		if err == nil {
+			if err = stream.Send(msg); err == nil {
+				err = stream.CloseSend()
+			}
+		}
+		if err != nil {
+			if n == 1 {
+				return nil, err
+			}
+			return func() (interface{}, bool) {
+				return []*GrpcEvent{{Type: GrpcClose, Status: GrpcStatusUnavailable, Err: err}}, false
+			}, nil
+		}
+
+		return func() (interface{}, bool) {
+			events := attempt.wait(ctx)
+			return events, retry.retryGrpc(ctx, events[len(events)-1])
+		}, nil
+	})
+	if err != nil {
+		cancel()
+		d.abort(id, call)
+		return 0, err
+	}
+
+	go func() {
+		defer cancel()
+		for _, ev := range run().([]*GrpcEvent) {
+			d.deliver(id, call, ev)
+		}
+	}()
+
+	return id, nil
+}
+
+func (d *GrpcDispatcher) add(call *grpcCall) uint32 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.nextID++
+	if d.nextID == 0 {
+		d.nextID++
+	}
+	d.calls[d.nextID] = call
+
+	return d.nextID
+}
+
+// Send sends msg on the stream id, and ends the stream if endOfStream.
+func (d *GrpcDispatcher) Send(id uint32, msg []byte, endOfStream bool) error {
+	call := d.get(id)
+	if call == nil || call.stream == nil {
+		return ErrCallNotFound
+	}
+
+	if err := call.stream.Send(msg); err != nil {
+		return err
+	}
+	if endOfStream {
+		return call.stream.CloseSend()
+	}
+	return nil
+}
+
+// Close ends the messages sent on the call id, its events keep being
+// delivered until the GrpcClose event.
+func (d *GrpcDispatcher) Close(id uint32) error {
+	call := d.get(id)
+	if call == nil || call.stream == nil {
+		return ErrCallNotFound
+	}
+	return call.stream.CloseSend()
+}
+
+// Cancel aborts the call id. Its listener, if any, gets a last GrpcClose
+// event marked as canceled, telling that the call is over.
+func (d *GrpcDispatcher) Cancel(id uint32) error {
+	call := d.get(id)
+	if call == nil {
+		return ErrCallNotFound
+	}
+
+	d.abort(id, call)
+	return nil
+}
+
+// OnEvent makes f be called with the events of the call id, starting with
+// the ones already received. f is called with the dispatcher locked and must
+// not block. It returns false if id is unknown.
+func (d *GrpcDispatcher) OnEvent(id uint32, f func(ev *GrpcEvent)) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	call, ok := d.calls[id]
+	if !ok {
+		return false
+	}
+
+	call.f = f
+	for _, ev := range call.events {
+		f(ev)
+	}
+	call.events = nil
+
+	if call.closed {
+		delete(d.calls, id)
+	}
+
+	return true
+}
+
+func (d *GrpcDispatcher) deliver(id uint32, call *grpcCall, ev *GrpcEvent) {
+	ev.call = call
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if atomic.LoadInt32(&call.canceled) != 0 || call.closed {
+		return
+	}
+
+	if ev.Type == GrpcClose {
+		call.closed = true
+		// the call is over, release whatever waits on its context
+		defer call.cancel()
+	}
+
+	if call.f == nil {
+		call.events = append(call.events, ev)
+		return
+	}
+
+	call.f(ev)
+
+	if call.closed && d.calls[id] == call {
+		delete(d.calls, id)
+	}
+}
+
+func (d *GrpcDispatcher) abort(id uint32, call *grpcCall) {
+	atomic.StoreInt32(&call.canceled, 1)
+	call.cancel()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.calls[id] == call {
+		delete(d.calls, id)
+	}
+
+	if call.f != nil && !call.closed {
+		call.closed = true
+		call.f(&GrpcEvent{Type: GrpcClose, Status: GrpcStatusCanceled, Err: context.Canceled, call: call})
+	}
+}
+
+func (d *GrpcDispatcher) get(id uint32) *grpcCall {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.calls[id]
+}
+
+// grpcAttempt keeps the events of an attempt of a retried call.
+type grpcAttempt struct {
+	lock   sync.Mutex
+	events []*GrpcEvent
+	done   chan struct{}
+}
+
+func (a *grpcAttempt) deliver(ev *GrpcEvent) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	select {
+	case <-a.done:
+		return
+	default:
+	}
+
+	a.events = append(a.events, ev)
+	if ev.Type == GrpcClose {
+		close(a.done)
+	}
+}
+
+// wait returns the events of the attempt once closed, or along with ctx.
+func (a *grpcAttempt) wait(ctx context.Context) []*GrpcEvent {
+	select {
+	case <-a.done:
+	case <-ctx.Done():
+		a.deliver(&GrpcEvent{Type: GrpcClose, Status: errorStatus(ctx, ctx.Err()), Err: ctx.Err()})
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return a.events
+}
+
+// unaryStream is the stream of a retried unary call, whose message is sent
+// by each attempt.
+type unaryStream struct{}
+
+func (unaryStream) Send(msg []byte) error { return ErrStreamClosed }
+
+func (unaryStream) CloseSend() error { return nil }
+
+// GrpcUpstream returns the upstream of a serialized GrpcService of Envoy, its
+// envoy_grpc.cluster_name or google_grpc.target_uri, or service itself if it
+// is not a serialized GrpcService, e.g. a plain cluster name.
+func GrpcUpstream(service []byte) string {
+	for _, field := range []int{1, 2} { // envoy_grpc, google_grpc
+		if msg, ok := protoField(service, field); ok {
+			if name, ok := protoField(msg, 1); ok && len(name) > 0 { // cluster_name, target_uri
+				return string(name)
+			}
+		}
+	}
+	return string(service)
+}
+
+// protoField returns the length-delimited field number of a protobuf message.
+func protoField(b []byte, number int) ([]byte, bool) {
+	for len(b) > 0 {
+		key, n := protoVarint(b)
+		if n == 0 {
+			return nil, false
+		}
+		b = b[n:]
+
+		switch key & 7 {
+		case 0: // varint
+			_, n = protoVarint(b)
+			if n == 0 {
+				return nil, false
+			}
+			b = b[n:]
+		case 1: // 64-bit
+			if len(b) < 8 {
+				return nil, false
+			}
+			b = b[8:]
+		case 2: // length-delimited
+			size, n := protoVarint(b)
+			if n == 0 || uint64(len(b)-n) < size {
+				return nil, false
+			}
+			if int(key>>3) == number {
+				return b[n : n+int(size)], true
+			}
+			b = b[n+int(size):]
+		case 5: // 32-bit
+			if len(b) < 4 {
+				return nil, false
+			}
+			b = b[4:]
+		default:
+			return nil, false
+		}
+	}
+
+	return nil, false
+}
+
+func protoVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
@@ -0,0 +1,269 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callout
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+)
+
+// newGrpcServer starts an HTTP/2 server echoing the messages of
+// /echo.Echo/Echo, along with the x-token metadata.
+func newGrpcServer(t *testing.T, done chan struct{}) (*httptest.Server, *GrpcDispatcher) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if done != nil {
+			defer close(done)
+		}
+		if r.URL.Path != "/echo.Echo/Echo" {
+			w.Header().Set("Grpc-Status", "12")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		assert.Equal(t, "application/grpc", r.Header.Get("Content-Type"))
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Header().Set("X-Token", r.Header.Get("X-Token"))
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		br := bufio.NewReader(r.Body)
+		for {
+			msg, err := readFrame(br, MaxGrpcMessageSize)
+			if err != nil {
+				break
+			}
+			frame := append([]byte{0, 0, 0, 0, byte(len(msg))}, msg...)
+			_, _ = w.Write(frame)
+			w.(http.Flusher).Flush()
+		}
+
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+
+	return server, NewGrpcDispatcher(&HTTP2Transport{
+		Client:   server.Client(),
+		Resolver: ResolverFunc(func(string) (string, error) { return server.URL, nil }),
+	})
+}
+
+func next(t *testing.T, events chan *GrpcEvent) *GrpcEvent {
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("no grpc event")
+		return nil
+	}
+}
+
+func TestGrpcCall(t *testing.T) {
+	server, d := newGrpcServer(t, nil)
+	defer server.Close()
+
+	id, err := d.Call(&GrpcRequest{
+		Service:  "echo.Echo",
+		Method:   "Echo",
+		Metadata: common.NewCommonHeaderFromMap(map[string]string{"x-token": "secret"}),
+		Timeout:  5 * time.Second,
+	}, []byte("hello"))
+	assert.NoError(t, err)
+
+	events := make(chan *GrpcEvent, 8)
+	assert.True(t, d.OnEvent(id, func(ev *GrpcEvent) { events <- ev }))
+
+	ev := next(t, events)
+	assert.Equal(t, GrpcHeaders, ev.Type)
+	token, _ := ev.Metadata.Get("x-token")
+	assert.Equal(t, "secret", token)
+
+	ev = next(t, events)
+	assert.Equal(t, GrpcMessage, ev.Type)
+	assert.Equal(t, "hello", string(ev.Message.Bytes()))
+
+	assert.Equal(t, GrpcTrailers, next(t, events).Type)
+
+	ev = next(t, events)
+	assert.Equal(t, GrpcClose, ev.Type)
+	assert.Equal(t, GrpcStatusOk, ev.Status)
+
+	// the call is forgotten once closed
+	assert.False(t, d.OnEvent(id, func(*GrpcEvent) {}))
+
+	id, err = d.Call(&GrpcRequest{Service: "echo.Echo", Method: "Missing"}, nil)
+	assert.NoError(t, err)
+	assert.True(t, d.OnEvent(id, func(ev *GrpcEvent) { events <- ev }))
+	assert.Equal(t, GrpcTrailers, next(t, events).Type)
+	assert.Equal(t, GrpcStatusUnimplemented, next(t, events).Status)
+}
+
+func TestGrpcBinaryMetadata(t *testing.T) {
+	value := "\x00\xffé"
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// binary values are base64 on the wire
+		assert.Equal(t, base64.RawStdEncoding.EncodeToString([]byte(value)), r.Header.Get("X-Token-Bin"))
+		w.Header().Set("X-Token-Bin", base64.StdEncoding.EncodeToString([]byte(value)))
+		w.Header().Set("X-Raw-Bin", "not base64!")
+		w.Header().Set("Grpc-Status", "0")
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	d := NewGrpcDispatcher(&HTTP2Transport{
+		Client:   server.Client(),
+		Resolver: ResolverFunc(func(string) (string, error) { return server.URL, nil }),
+	})
+
+	id, err := d.Call(&GrpcRequest{
+		Service:  "echo.Echo",
+		Method:   "Echo",
+		Metadata: common.NewCommonHeaderFromMap(map[string]string{"x-token-bin": value}),
+	}, nil)
+	assert.NoError(t, err)
+
+	events := make(chan *GrpcEvent, 8)
+	assert.True(t, d.OnEvent(id, func(ev *GrpcEvent) { events <- ev }))
+
+	ev := next(t, events)
+	assert.Equal(t, GrpcTrailers, ev.Type)
+	token, _ := ev.Metadata.Get("x-token-bin")
+	assert.Equal(t, value, token)
+	// the values which can't be decoded are kept
+	raw, _ := ev.Metadata.Get("x-raw-bin")
+	assert.Equal(t, "not base64!", raw)
+
+	assert.Equal(t, GrpcStatusOk, next(t, events).Status)
+}
+
+func TestGrpcStream(t *testing.T) {
+	server, d := newGrpcServer(t, nil)
+	defer server.Close()
+
+	id, err := d.Open(&GrpcRequest{Service: "echo.Echo", Method: "Echo"})
+	assert.NoError(t, err)
+
+	events := make(chan *GrpcEvent, 8)
+	assert.True(t, d.OnEvent(id, func(ev *GrpcEvent) { events <- ev }))
+
+	// the messages are echoed as they are sent
+	assert.NoError(t, d.Send(id, []byte("a"), false))
+	assert.Equal(t, GrpcHeaders, next(t, events).Type)
+	assert.Equal(t, "a", string(next(t, events).Message.Bytes()))
+
+	assert.NoError(t, d.Send(id, []byte("b"), true))
+	assert.Equal(t, "b", string(next(t, events).Message.Bytes()))
+	assert.Equal(t, GrpcTrailers, next(t, events).Type)
+	assert.Equal(t, GrpcStatusOk, next(t, events).Status)
+
+	assert.Equal(t, ErrCallNotFound, d.Send(id, []byte("c"), false))
+}
+
+func TestGrpcCancel(t *testing.T) {
+	done := make(chan struct{})
+	server, d := newGrpcServer(t, done)
+	defer server.Close()
+
+	id, err := d.Open(&GrpcRequest{Service: "echo.Echo", Method: "Echo"})
+	assert.NoError(t, err)
+
+	events := make(chan *GrpcEvent, 8)
+	assert.True(t, d.OnEvent(id, func(ev *GrpcEvent) { events <- ev }))
+	assert.NoError(t, d.Send(id, []byte("a"), false))
+	assert.Equal(t, GrpcHeaders, next(t, events).Type)
+	ev := next(t, events)
+	assert.False(t, ev.Canceled())
+
+	assert.NoError(t, d.Cancel(id))
+	assert.True(t, ev.Canceled())
+	assert.Equal(t, ErrCallNotFound, d.Cancel(id))
+
+	// the listener is told that the call is over
+	ev = next(t, events)
+	assert.Equal(t, GrpcClose, ev.Type)
+	assert.True(t, ev.Canceled())
+
+	// the server sees the stream reset, and nothing else is delivered
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not reset")
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event %v", ev.Type)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// contextTransport keeps the context of the calls it opens.
+type contextTransport struct {
+	GrpcTransport
+	ctx chan context.Context
+}
+
+func (t *contextTransport) Open(ctx context.Context, req *GrpcRequest, deliver func(ev *GrpcEvent)) (GrpcStream, error) {
+	t.ctx <- ctx
+	return t.GrpcTransport.Open(ctx, req, deliver)
+}
+
+func TestGrpcCloseContext(t *testing.T) {
+	server, d := newGrpcServer(t, nil)
+	defer server.Close()
+
+	transport := &contextTransport{GrpcTransport: d.transport, ctx: make(chan context.Context, 1)}
+	d = NewGrpcDispatcher(transport)
+
+	id, err := d.Call(&GrpcRequest{Service: "echo.Echo", Method: "Echo"}, []byte("hello"))
+	assert.NoError(t, err)
+	ctx := <-transport.ctx
+
+	events := make(chan *GrpcEvent, 8)
+	assert.True(t, d.OnEvent(id, func(ev *GrpcEvent) { events <- ev }))
+	for ev := next(t, events); ev.Type != GrpcClose; ev = next(t, events) {
+	}
+
+	// the context of a closed call is done
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("context not canceled")
+	}
+}
+
+func TestGrpcUpstream(t *testing.T) {
+	// envoy_grpc { cluster_name: "auth" }, timeout { seconds: 1 }
+	service := []byte{0x0a, 0x06, 0x0a, 0x04, 'a', 'u', 't', 'h', 0x1a, 0x02, 0x08, 0x01}
+	assert.Equal(t, "auth", GrpcUpstream(service))
+
+	// google_grpc { target_uri: "localhost:50051" }
+	service = append([]byte{0x12, 0x11, 0x0a, 0x0f}, "localhost:50051"...)
+	assert.Equal(t, "localhost:50051", GrpcUpstream(service))
+
+	assert.Equal(t, "auth", GrpcUpstream([]byte("auth")))
+}
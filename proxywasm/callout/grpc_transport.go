@@ -0,0 +1,361 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callout
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+	"mosn.io/proxy-wasm-go-host/proxywasm/nethttp"
+)
+
+// MaxGrpcMessageSize is the largest gRPC message received.
+const MaxGrpcMessageSize = 16 << 20
+
+var (
+	ErrStreamClosed = errors.New("grpc stream closed")
+	errBadFrame     = errors.New("bad grpc frame")
+)
+
+// HTTP2Transport is the default GrpcTransport, framing the messages with a
+// length prefix over HTTP/2. net/http only speaks HTTP/2 over TLS, plaintext
+// upstreams need a Client whose transport speaks h2c.
+type HTTP2Transport struct {
+	// Clusters routes the calls by cluster name instead of Client and
+	// Resolver, see Dispatcher.
+	Clusters *Clusters
+	// Client sends the requests, http.DefaultClient if nil.
+	Client *http.Client
+	// Resolver resolves the upstreams, nil resolving "host:port" to
+	// "http://host:port" and keeping URLs as is.
+	Resolver Resolver
+}
+
+func (t *HTTP2Transport) Open(ctx context.Context, req *GrpcRequest, deliver func(ev *GrpcEvent)) (GrpcStream, error) {
+	if req.Service == "" || req.Method == "" {
+		return nil, fmt.Errorf("%w: service and method are required", ErrBadRequest)
+	}
+
+	base, client, timeout, err := route(t.Clusters, t.Client, t.Resolver, req.Upstream, req.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// the goroutines of the stream end once the call is over
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+
+	pr, pw := io.Pipe()
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(base, "/")+"/"+req.Service+"/"+req.Method, pr)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("%w: %v", ErrBadRequest, err)
+	}
+
+	if req.Metadata != nil {
+		req.Metadata.Range(func(key, value string) bool {
+			if !strings.HasPrefix(key, ":") {
+				r.Header.Add(key, encodeMetadata(key, value))
+			}
+			return true
+		})
+	}
+	r.Header.Set("Content-Type", "application/grpc")
+	r.Header.Set("Te", "trailers")
+	if timeout > 0 {
+		r.Header.Set("Grpc-Timeout", strconv.FormatInt(int64((timeout+time.Millisecond-1)/time.Millisecond), 10)+"m")
+	}
+
+	s := &http2Stream{pw: pw, maxMessageSize: req.MaxMessageSize}
+	s.cond = sync.NewCond(&s.lock)
+
+	go s.write()
+	go func() {
+		// the request body must fail for the stream to be reset
+		<-ctx.Done()
+		s.abort(ctx.Err())
+	}()
+	go func() {
+		defer cancel()
+		defer s.abort(ErrStreamClosed)
+
+		deliver(s.receive(ctx, client, r, deliver))
+	}()
+
+	return s, nil
+}
+
+func (t *HTTP2Transport) retryPolicy(upstream string) *RetryPolicy {
+	return t.Clusters.RetryPolicy(upstream)
+}
+
+// http2Stream queues the messages sent, so that Send never blocks.
+type http2Stream struct {
+	pw             *io.PipeWriter
+	maxMessageSize int64
+
+	lock   sync.Mutex
+	cond   *sync.Cond
+	queue  [][]byte
+	closed bool
+	err    error
+}
+
+func (s *http2Stream) Send(msg []byte) error {
+	frame := make([]byte, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	copy(frame[5:], msg)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	if s.closed {
+		return ErrStreamClosed
+	}
+	s.queue = append(s.queue, frame)
+	s.cond.Signal()
+
+	return nil
+}
+
+func (s *http2Stream) CloseSend() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	s.closed = true
+	s.cond.Signal()
+
+	return nil
+}
+
+func (s *http2Stream) abort(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Signal()
+}
+
+// write writes the queued messages to the request body.
+func (s *http2Stream) write() {
+	for {
+		s.lock.Lock()
+		for len(s.queue) == 0 && !s.closed && s.err == nil {
+			s.cond.Wait()
+		}
+		if s.err != nil {
+			s.lock.Unlock()
+			_ = s.pw.CloseWithError(s.err)
+			return
+		}
+		if len(s.queue) == 0 {
+			s.lock.Unlock()
+			_ = s.pw.Close()
+			return
+		}
+		frame := s.queue[0]
+		s.queue = s.queue[1:]
+		s.lock.Unlock()
+
+		if _, err := s.pw.Write(frame); err != nil {
+			s.abort(err)
+		}
+	}
+}
+
+// receive delivers the events of the response but the last, which it returns.
+func (s *http2Stream) receive(ctx context.Context, client *http.Client, r *http.Request, deliver func(ev *GrpcEvent)) *GrpcEvent {
+	resp, err := client.Do(r)
+	if err != nil {
+		return &GrpcEvent{Type: GrpcClose, Status: errorStatus(ctx, err), Err: err}
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return closeEvent(httpStatus(resp.StatusCode))
+	}
+
+	// a response without messages may carry its status in the headers
+	if status, ok := grpcStatus(resp.Header); ok {
+		deliver(&GrpcEvent{Type: GrpcTrailers, Metadata: metadata(resp.Header)})
+		return closeEvent(status)
+	}
+
+	deliver(&GrpcEvent{Type: GrpcHeaders, Metadata: metadata(resp.Header)})
+
+	maxSize := s.maxMessageSize
+	if maxSize <= 0 || maxSize > MaxGrpcMessageSize {
+		maxSize = MaxGrpcMessageSize
+	}
+
+	br := bufio.NewReader(resp.Body)
+	for {
+		msg, err := readFrame(br, maxSize)
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, ErrResponseTooLarge) {
+			return &GrpcEvent{Type: GrpcClose, Status: GrpcStatusResourceExhausted, Err: err}
+		}
+		if err != nil {
+			return closeEvent(errorStatus(ctx, err))
+		}
+		deliver(&GrpcEvent{Type: GrpcMessage, Message: common.NewIoBufferBytes(msg)})
+	}
+
+	deliver(&GrpcEvent{Type: GrpcTrailers, Metadata: metadata(resp.Trailer)})
+
+	status, ok := grpcStatus(resp.Trailer)
+	if !ok {
+		status = GrpcStatusUnknown
+	}
+	return closeEvent(status)
+}
+
+func readFrame(r io.Reader, maxSize int64) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errBadFrame
+		}
+		return nil, err
+	}
+
+	// compressed messages are not supported, none being accepted
+	if prefix[0] != 0 {
+		return nil, errBadFrame
+	}
+
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if int64(size) > maxSize {
+		return nil, ErrResponseTooLarge
+	}
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errBadFrame
+		}
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+func metadata(header http.Header) common.HeaderMap {
+	md := common.NewCommonHeader()
+	nethttp.NewHeaderMap(header).Range(func(key, value string) bool {
+		key = strings.ToLower(key)
+		md.Add(key, decodeMetadata(key, value))
+		return true
+	})
+	return md
+}
+
+// encodeMetadata base64 encodes the values of the binary metadata, whose key
+// ends with -bin, as gRPC requires.
+func encodeMetadata(key, value string) string {
+	if !strings.HasSuffix(strings.ToLower(key), "-bin") {
+		return value
+	}
+	return base64.RawStdEncoding.EncodeToString([]byte(value))
+}
+
+// decodeMetadata decodes the values of the binary metadata, padded or not,
+// keeping the ones which are not base64.
+func decodeMetadata(key, value string) string {
+	if !strings.HasSuffix(key, "-bin") {
+		return value
+	}
+	b, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return value
+	}
+	return string(b)
+}
+
+func grpcStatus(header http.Header) (int32, bool) {
+	value := header.Get("Grpc-Status")
+	if value == "" {
+		return 0, false
+	}
+
+	status, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return GrpcStatusUnknown, true
+	}
+	return int32(status), true
+}
+
+func closeEvent(status int32) *GrpcEvent {
+	return &GrpcEvent{Type: GrpcClose, Status: status}
+}
+
+func errorStatus(ctx context.Context, err error) int32 {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return GrpcStatusDeadlineExceeded
+	case errors.Is(ctx.Err(), context.Canceled):
+		return GrpcStatusCanceled
+	case errors.Is(err, errBadFrame):
+		return GrpcStatusInternal
+	default:
+		return GrpcStatusUnavailable
+	}
+}
+
+// httpStatus maps the HTTP status of a failed call to a gRPC status.
+func httpStatus(code int) int32 {
+	switch code {
+	case http.StatusBadRequest:
+		return GrpcStatusInternal
+	case http.StatusUnauthorized:
+		return GrpcStatusUnauthenticated
+	case http.StatusForbidden:
+		return GrpcStatusPermissionDenied
+	case http.StatusNotFound:
+		return GrpcStatusUnimplemented
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return GrpcStatusUnavailable
+	default:
+		return GrpcStatusUnknown
+	}
+}
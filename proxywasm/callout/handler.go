@@ -0,0 +1,62 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callout
+
+import (
+	"net/http"
+	"net/http/httptest"
+)
+
+// inProcessHost is the host of the URLs of the in-process clusters.
+const inProcessHost = "in-process"
+
+// handlerTransport is an http.RoundTripper serving the requests with an
+// http.Handler, the way a server would.
+type handlerTransport struct {
+	handler http.Handler
+}
+
+func (t *handlerTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// the handler sees a server request
+	req := r.Clone(r.Context())
+	req.RequestURI = r.URL.RequestURI()
+	req.RemoteAddr = "127.0.0.1:0"
+	if req.Body == nil {
+		req.Body = http.NoBody
+	}
+
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		t.handler.ServeHTTP(rec, req)
+	}()
+
+	select {
+	case <-done:
+	case <-r.Context().Done():
+		// the handler keeps running until it returns, its response is dropped
+		return nil, r.Context().Err()
+	}
+
+	resp := rec.Result()
+	resp.Request = r
+
+	return resp, nil
+}
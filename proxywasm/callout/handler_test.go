@@ -0,0 +1,83 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callout
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+)
+
+func TestHandlerCluster(t *testing.T) {
+	clusters := NewClusters()
+	assert.Nil(t, clusters.AddHandler("auth", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		assert.Equal(t, "/check", r.RequestURI)
+		assert.Equal(t, "auth.local", r.Host)
+		assert.Equal(t, "token", string(body))
+		assert.Equal(t, "v", r.Trailer.Get("X-Trailer"))
+
+		w.Header().Set("Trailer", "X-Result")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("denied"))
+		w.Header().Set("X-Result", "no")
+	})))
+	assert.Nil(t, clusters.AddHandler("slow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})))
+
+	d := NewDispatcher(nil)
+	d.Clusters = clusters
+
+	id, err := d.Dispatch(&Request{
+		Upstream: "auth",
+		Headers: common.NewCommonHeader(
+			common.HeaderPair{Key: ":method", Value: "POST"},
+			common.HeaderPair{Key: ":path", Value: "/check"},
+			common.HeaderPair{Key: ":authority", Value: "auth.local"},
+		),
+		Body:     []byte("token"),
+		Trailers: common.NewCommonHeader(common.HeaderPair{Key: "x-trailer", Value: "v"}),
+	})
+	assert.Nil(t, err)
+
+	resp := await(t, d, id)
+	assert.Nil(t, resp.Err)
+	status, _ := resp.Headers.Get(":status")
+	assert.Equal(t, "403", status)
+	assert.Equal(t, "denied", string(resp.Body.Bytes()))
+	result, _ := resp.Trailers.Get("x-result")
+	assert.Equal(t, "no", result)
+
+	id, err = d.Dispatch(&Request{
+		Upstream: "slow",
+		Headers: common.NewCommonHeader(
+			common.HeaderPair{Key: ":method", Value: "GET"},
+			common.HeaderPair{Key: ":path", Value: "/"},
+			common.HeaderPair{Key: ":authority", Value: "slow"},
+		),
+		Timeout: 50 * time.Millisecond,
+	})
+	assert.Nil(t, err)
+	assert.NotNil(t, await(t, d, id).Err)
+}
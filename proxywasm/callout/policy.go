@@ -0,0 +1,209 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callout
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+	"mosn.io/proxy-wasm-go-host/proxywasm/metrics"
+)
+
+var (
+	ErrUpstreamNotAllowed = errors.New("upstream not allowed")
+	ErrTooManyCallouts    = errors.New("too many callouts in flight")
+	ErrResponseTooLarge   = errors.New("response above the maximum size")
+)
+
+// The reasons of the rejections counted by Policy, as the suffix of the
+// callout.rejected.<reason> counters.
+const (
+	RejectedUpstream     = "upstream"
+	RejectedConcurrency  = "concurrency"
+	RejectedResponseSize = "response_size"
+)
+
+// Policy bounds the callouts of a plugin, it is shared by the handlers of
+// the plugin. A nil Policy allows everything. The callouts it rejects fail
+// with NotAllowed in the v2 ABI, and with BadArgument in the v1 ABI which has
+// no such result.
+type Policy struct {
+	// AllowedUpstreams lists the clusters or hosts which may be called, any
+	// if empty. "*.example.com" allows the subdomains of example.com.
+	AllowedUpstreams []string
+	// MaxInFlight is the maximum number of callouts in flight for the
+	// plugin, none if 0.
+	MaxInFlight int
+	// MaxInFlightPerContext is the maximum number of callouts in flight for a
+	// context of the plugin, e.g. a stream, none if 0.
+	MaxInFlightPerContext int
+	// MaxTimeout is the maximum timeout of a callout, longer timeouts and
+	// callouts without timeout getting this one. None if 0.
+	MaxTimeout time.Duration
+	// MaxResponseSize is the maximum size of the body of an HTTP response or
+	// of a gRPC message, none if 0.
+	MaxResponseSize int64
+	// Metrics counts the rejected callouts, see RejectedUpstream.
+	Metrics *metrics.Scope
+
+	lock       sync.Mutex
+	inFlight   int
+	perContext map[contextKey]int
+}
+
+// contextKey identifies a context, whose IDs are only unique in the instance
+// running it.
+type contextKey struct {
+	instance  common.WasmInstance
+	contextID int32
+}
+
+// Admission is a callout admitted by a Policy.
+type Admission struct {
+	policy *Policy
+	key    contextKey
+	once   sync.Once
+}
+
+// Admit checks a callout of the context contextID of instance to upstream,
+// returning the timeout it must use. The callout is in flight until Done is
+// called on the admission.
+func (p *Policy) Admit(instance common.WasmInstance, contextID int32, upstream string, timeout time.Duration) (time.Duration, *Admission, error) {
+	if p == nil {
+		return timeout, &Admission{}, nil
+	}
+
+	if !p.allowed(upstream) {
+		p.reject(RejectedUpstream)
+		return 0, nil, fmt.Errorf("%w: %s", ErrUpstreamNotAllowed, upstream)
+	}
+
+	if p.MaxTimeout > 0 && (timeout == 0 || timeout > p.MaxTimeout) {
+		timeout = p.MaxTimeout
+	}
+
+	key := contextKey{instance: instance, contextID: contextID}
+
+	p.lock.Lock()
+	full := p.MaxInFlight > 0 && p.inFlight >= p.MaxInFlight ||
+		p.MaxInFlightPerContext > 0 && p.perContext[key] >= p.MaxInFlightPerContext
+	if !full {
+		if p.perContext == nil {
+			p.perContext = make(map[contextKey]int)
+		}
+		p.inFlight++
+		p.perContext[key]++
+	}
+	p.lock.Unlock()
+
+	if full {
+		p.reject(RejectedConcurrency)
+		return 0, nil, ErrTooManyCallouts
+	}
+
+	return timeout, &Admission{policy: p, key: key}, nil
+}
+
+// ResponseLimit returns MaxResponseSize, 0 for a nil Policy.
+func (p *Policy) ResponseLimit() int64 {
+	if p == nil {
+		return 0
+	}
+	return p.MaxResponseSize
+}
+
+// InFlight returns the number of callouts in flight for the plugin.
+func (p *Policy) InFlight() int {
+	if p == nil {
+		return 0
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.inFlight
+}
+
+// Done ends the callout, err being the error it failed with if any. Only the
+// first call counts.
+func (a *Admission) Done(err error) {
+	p := a.policy
+	if p == nil {
+		return
+	}
+
+	a.once.Do(func() {
+		if errors.Is(err, ErrResponseTooLarge) {
+			p.reject(RejectedResponseSize)
+		}
+
+		p.lock.Lock()
+		defer p.lock.Unlock()
+
+		p.inFlight--
+		if p.perContext[a.key]--; p.perContext[a.key] <= 0 {
+			delete(p.perContext, a.key)
+		}
+	})
+}
+
+func (p *Policy) allowed(upstream string) bool {
+	if len(p.AllowedUpstreams) == 0 {
+		return true
+	}
+
+	host := upstream
+	if strings.Contains(upstream, "://") {
+		u, err := url.Parse(upstream)
+		if err != nil {
+			return false
+		}
+		host = u.Host
+	}
+	hostname := host
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.HasSuffix(host, "]") {
+		hostname = host[:i]
+	}
+
+	for _, allowed := range p.AllowedUpstreams {
+		switch {
+		case allowed == upstream, allowed == host, allowed == hostname:
+			return true
+		case strings.HasPrefix(allowed, "*.") && strings.HasSuffix(hostname, allowed[1:]):
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p *Policy) reject(reason string) {
+	if p.Metrics == nil {
+		return
+	}
+
+	id, err := p.Metrics.Define(metrics.Counter, "callout.rejected."+reason)
+	if err == nil {
+		_ = p.Metrics.Increment(id, 1)
+	}
+}
@@ -0,0 +1,137 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callout
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+	"mosn.io/proxy-wasm-go-host/proxywasm/metrics"
+)
+
+func rejections(r *metrics.Registry) map[string]int64 {
+	counts := make(map[string]int64)
+	for _, m := range r.Metrics() {
+		counts[m.Name()], _ = m.Value()
+	}
+	return counts
+}
+
+func TestPolicy(t *testing.T) {
+	registry := metrics.NewRegistry()
+	p := &Policy{
+		AllowedUpstreams:      []string{"auth", "*.example.com", "10.0.0.1:8080"},
+		MaxInFlight:           2,
+		MaxInFlightPerContext: 1,
+		MaxTimeout:            time.Second,
+		Metrics:               registry.NewScope("plugin"),
+	}
+
+	for _, upstream := range []string{"auth", "api.example.com:443", "https://api.example.com/x", "10.0.0.1:8080"} {
+		_, a, err := p.Admit(nil, int32(len(upstream)), upstream, 0)
+		assert.NoError(t, err, upstream)
+		a.Done(nil)
+	}
+	for _, upstream := range []string{"billing", "example.com", "10.0.0.1:9090", "http://evil.com/auth"} {
+		_, _, err := p.Admit(nil, 1, upstream, 0)
+		assert.ErrorIs(t, err, ErrUpstreamNotAllowed, upstream)
+	}
+
+	// callouts without timeout or with a longer one get the maximum one
+	timeout, a, err := p.Admit(nil, 1, "auth", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Second, timeout)
+
+	timeout, c, err := p.Admit(nil, 2, "auth", 2*time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Second, timeout)
+	c.Done(nil)
+
+	timeout, c, err = p.Admit(nil, 2, "auth", 500*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, 500*time.Millisecond, timeout)
+	c.Done(nil)
+
+	// one callout per context, two for the plugin
+	_, _, err = p.Admit(nil, 1, "auth", 0)
+	assert.Equal(t, ErrTooManyCallouts, err)
+	_, b, err := p.Admit(nil, 2, "auth", 0)
+	assert.NoError(t, err)
+	_, _, err = p.Admit(nil, 3, "auth", 0)
+	assert.Equal(t, ErrTooManyCallouts, err)
+	assert.Equal(t, 2, p.InFlight())
+
+	a.Done(ErrResponseTooLarge)
+	a.Done(nil)
+	b.Done(nil)
+	assert.Equal(t, 0, p.InFlight())
+
+	assert.Equal(t, map[string]int64{
+		"callout.rejected.upstream":      4,
+		"callout.rejected.concurrency":   2,
+		"callout.rejected.response_size": 1,
+	}, rejections(registry))
+
+	// a nil policy allows everything
+	var none *Policy
+	timeout, a, err = none.Admit(nil, 1, "anything", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), timeout)
+	a.Done(nil)
+}
+
+func TestPolicyPerInstance(t *testing.T) {
+	p := &Policy{MaxInFlightPerContext: 1}
+
+	// the instances of a plugin number their contexts alike
+	first, second := &struct{ common.WasmInstance }{}, &struct{ common.WasmInstance }{}
+	_, a, err := p.Admit(first, 2, "auth", 0)
+	assert.NoError(t, err)
+	_, b, err := p.Admit(second, 2, "auth", 0)
+	assert.NoError(t, err)
+	_, _, err = p.Admit(first, 2, "auth", 0)
+	assert.Equal(t, ErrTooManyCallouts, err)
+
+	a.Done(nil)
+	b.Done(nil)
+	assert.Equal(t, 0, p.InFlight())
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(strings.Repeat("x", 100)))
+	}))
+	defer server.Close()
+
+	d := NewDispatcher(nil)
+	headers := common.NewCommonHeaderFromMap(map[string]string{":method": "GET", ":path": "/", ":authority": "a"})
+
+	for _, c := range []struct {
+		max int64
+		err error
+	}{{100, nil}, {99, ErrResponseTooLarge}} {
+		id, err := d.Dispatch(&Request{Upstream: server.URL, Headers: headers, MaxResponseSize: c.max})
+		assert.NoError(t, err)
+		assert.Equal(t, c.err, await(t, d, id).Err)
+	}
+}
@@ -0,0 +1,251 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callout
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultBaseInterval = 25 * time.Millisecond
+)
+
+// RetryPolicy retries the failed attempts of a callout, and may hedge them.
+// The plugins only get the outcome of the last attempt, or of the first one
+// succeeding.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, the first one included,
+	// 1 if 0.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// RetryOn lists the HTTP statuses retried, the connection failures being
+	// always retried.
+	RetryOn []int `json:"retry_on,omitempty"`
+	// RetryOnGrpc lists the gRPC statuses retried, the connection failures
+	// being always retried. Only the unary calls are retried.
+	RetryOnGrpc []int32 `json:"retry_on_grpc,omitempty"`
+	// BaseInterval is the base of the exponential backoff between the
+	// attempts, 25ms if 0. The backoff is fully jittered.
+	BaseInterval Duration `json:"base_interval,omitempty"`
+	// MaxInterval bounds the backoff, 10 times BaseInterval if 0.
+	MaxInterval Duration `json:"max_interval,omitempty"`
+	// HedgeDelay starts another attempt when the pending ones did not
+	// complete within it, the first one succeeding winning. None if 0.
+	HedgeDelay Duration `json:"hedge_delay,omitempty"`
+}
+
+// attemptFunc opens the attempt n of a callout, returning the func waiting
+// for its outcome, and telling whether it may be retried. Only the first
+// attempt may fail to open, the later ones turning their errors into failed
+// outcomes.
+type attemptFunc func(ctx context.Context, n int) (wait func() (interface{}, bool), err error)
+
+func (p *RetryPolicy) enabled() bool {
+	return p != nil && (p.MaxAttempts > 1 || p.HedgeDelay > 0)
+}
+
+// start opens the first attempt of a callout, and returns the func running
+// it along with the retries until the final outcome.
+func (p *RetryPolicy) start(ctx context.Context, attempt attemptFunc) (func() interface{}, error) {
+	if !p.enabled() {
+		wait, err := attempt(ctx, 1)
+		if err != nil {
+			return nil, err
+		}
+		return func() interface{} {
+			outcome, _ := wait()
+			return outcome
+		}, nil
+	}
+
+	r := &retrier{
+		policy:  p,
+		ctx:     ctx,
+		attempt: attempt,
+		results: make(chan attemptResult, p.maxAttempts()),
+	}
+	if err := r.open(); err != nil {
+		r.cancel()
+		return nil, err
+	}
+
+	return r.run, nil
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// backoff returns the time to wait before the attempt n.
+func (p *RetryPolicy) backoff(n int) time.Duration {
+	base := time.Duration(p.BaseInterval)
+	if base <= 0 {
+		base = defaultBaseInterval
+	}
+	max := time.Duration(p.MaxInterval)
+	if max <= 0 {
+		max = 10 * base
+	}
+
+	interval := max
+	if shift := uint(n - 2); shift < 32 && base<<shift < max {
+		interval = base << shift
+	}
+
+	return time.Duration(rand.Int63n(int64(interval) + 1))
+}
+
+// retryResponse tells whether the attempt ending with resp may be retried.
+func (p *RetryPolicy) retryResponse(ctx context.Context, resp *Response) bool {
+	if p == nil || ctx.Err() != nil {
+		return false
+	}
+	if resp.Err != nil {
+		return !errors.Is(resp.Err, ErrResponseTooLarge)
+	}
+
+	status, _ := resp.Headers.Get(":status")
+	code, _ := strconv.Atoi(status)
+	return p.retryOnStatus(code)
+}
+
+func (p *RetryPolicy) retryOnStatus(status int) bool {
+	for _, s := range p.RetryOn {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// retryGrpc tells whether the attempt closed with ev may be retried.
+func (p *RetryPolicy) retryGrpc(ctx context.Context, ev *GrpcEvent) bool {
+	if p == nil || ctx.Err() != nil {
+		return false
+	}
+	if ev.Err != nil {
+		return !errors.Is(ev.Err, ErrResponseTooLarge)
+	}
+	return p.retryOnGrpcStatus(ev.Status)
+}
+
+func (p *RetryPolicy) retryOnGrpcStatus(status int32) bool {
+	for _, s := range p.RetryOnGrpc {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+type attemptResult struct {
+	outcome   interface{}
+	retryable bool
+}
+
+// retrier runs the attempts of a callout.
+type retrier struct {
+	policy  *RetryPolicy
+	ctx     context.Context
+	attempt attemptFunc
+	results chan attemptResult
+
+	started int
+	pending int
+	cancels []context.CancelFunc
+	hedge   <-chan time.Time
+}
+
+func (r *retrier) open() error {
+	ctx, cancel := context.WithCancel(r.ctx)
+	r.cancels = append(r.cancels, cancel)
+	r.started++
+
+	wait, err := r.attempt(ctx, r.started)
+	if err != nil {
+		return err
+	}
+
+	r.pending++
+	go func() {
+		outcome, retryable := wait()
+		r.results <- attemptResult{outcome, retryable}
+	}()
+
+	if r.policy.HedgeDelay > 0 && r.started < r.policy.maxAttempts() {
+		r.hedge = time.After(time.Duration(r.policy.HedgeDelay))
+	} else {
+		r.hedge = nil
+	}
+
+	return nil
+}
+
+func (r *retrier) run() interface{} {
+	defer r.cancel()
+
+	var last interface{}
+	var backoff <-chan time.Time
+	done := r.ctx.Done()
+
+	for {
+		select {
+		case result := <-r.results:
+			r.pending--
+			last = result.outcome
+			if !result.retryable {
+				return last
+			}
+			if r.pending > 0 {
+				// a hedged attempt may still succeed
+				continue
+			}
+			if r.started >= r.policy.maxAttempts() || r.ctx.Err() != nil {
+				return last
+			}
+			r.hedge = nil
+			backoff = time.After(r.policy.backoff(r.started + 1))
+
+		case <-r.hedge:
+			_ = r.open()
+
+		case <-backoff:
+			backoff = nil
+			_ = r.open()
+
+		case <-done:
+			// the pending attempts end along with the context
+			done = nil
+			if r.pending == 0 {
+				return last
+			}
+		}
+	}
+}
+
+func (r *retrier) cancel() {
+	for _, cancel := range r.cancels {
+		cancel()
+	}
+}
@@ -0,0 +1,200 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package callout
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+)
+
+func TestRetryHttp(t *testing.T) {
+	var hits int32
+	clusters := NewClusters()
+	assert.NoError(t, clusters.AddHandler("flaky", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})))
+
+	d := NewDispatcher(nil)
+	d.Clusters = clusters
+	headers := common.NewCommonHeaderFromMap(map[string]string{":method": "GET", ":path": "/", ":authority": "flaky"})
+	retry := &RetryPolicy{MaxAttempts: 3, RetryOn: []int{503}, BaseInterval: Duration(time.Millisecond)}
+
+	// the plugin only gets the last attempt
+	id, err := d.Dispatch(&Request{Upstream: "flaky", Headers: headers, Retry: retry})
+	assert.NoError(t, err)
+	status, _ := await(t, d, id).Headers.Get(":status")
+	assert.Equal(t, "200", status)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&hits))
+
+	// the retry policy of the cluster applies by default, until exhausted
+	atomic.StoreInt32(&hits, 0)
+	cluster, _ := clusters.Get("flaky")
+	cluster.Retry = &RetryPolicy{MaxAttempts: 2, RetryOn: []int{503}}
+	id, err = d.Dispatch(&Request{Upstream: "flaky", Headers: headers})
+	assert.NoError(t, err)
+	status, _ = await(t, d, id).Headers.Get(":status")
+	assert.Equal(t, "503", status)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+}
+
+func TestRetryHttpBody(t *testing.T) {
+	var lock sync.Mutex
+	var bodies []string
+	clusters := NewClusters()
+	assert.NoError(t, clusters.AddHandler("flaky", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+		if bodies = append(bodies, string(body)); len(bodies) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})))
+
+	d := NewDispatcher(nil)
+	d.Clusters = clusters
+	headers := common.NewCommonHeaderFromMap(map[string]string{":method": "POST", ":path": "/", ":authority": "flaky"})
+	retry := &RetryPolicy{MaxAttempts: 3, RetryOn: []int{503}, BaseInterval: Duration(10 * time.Millisecond)}
+
+	// the caller reuses the body once dispatched, as a guest its memory
+	body := []byte("hello")
+	id, err := d.Dispatch(&Request{Upstream: "flaky", Headers: headers, Body: body, Retry: retry})
+	assert.NoError(t, err)
+	copy(body, "xxxxx")
+
+	status, _ := await(t, d, id).Headers.Get(":status")
+	assert.Equal(t, "200", status)
+	lock.Lock()
+	assert.Equal(t, []string{"hello", "hello", "hello"}, bodies)
+	lock.Unlock()
+}
+
+func TestHedging(t *testing.T) {
+	var hits int32
+	clusters := NewClusters()
+	assert.NoError(t, clusters.AddHandler("slow", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 1 {
+			// the first attempt hangs until canceled
+			<-r.Context().Done()
+			return
+		}
+		_, _ = w.Write([]byte("hedged"))
+	})))
+
+	d := NewDispatcher(nil)
+	d.Clusters = clusters
+	headers := common.NewCommonHeaderFromMap(map[string]string{":method": "GET", ":path": "/", ":authority": "slow"})
+
+	start := time.Now()
+	id, err := d.Dispatch(&Request{
+		Upstream: "slow",
+		Headers:  headers,
+		Timeout:  5 * time.Second,
+		Retry:    &RetryPolicy{MaxAttempts: 2, HedgeDelay: Duration(20 * time.Millisecond)},
+	})
+	assert.NoError(t, err)
+	resp := await(t, d, id)
+	assert.NoError(t, resp.Err)
+	assert.Equal(t, "hedged", string(resp.Body.Bytes()))
+	assert.True(t, time.Since(start) < 4*time.Second)
+}
+
+// flakyGrpcTransport fails the calls with UNAVAILABLE until the attempt ok.
+type flakyGrpcTransport struct {
+	attempts int32
+	ok       int32
+
+	lock     sync.Mutex
+	messages []string
+}
+
+func (t *flakyGrpcTransport) Open(ctx context.Context, req *GrpcRequest, deliver func(ev *GrpcEvent)) (GrpcStream, error) {
+	n := atomic.AddInt32(&t.attempts, 1)
+	go func() {
+		deliver(&GrpcEvent{Type: GrpcHeaders, Metadata: common.NewCommonHeader()})
+		if n < t.ok {
+			deliver(&GrpcEvent{Type: GrpcClose, Status: GrpcStatusUnavailable})
+			return
+		}
+		deliver(&GrpcEvent{Type: GrpcMessage, Message: common.NewIoBufferBytes([]byte("ok"))})
+		deliver(&GrpcEvent{Type: GrpcTrailers, Metadata: common.NewCommonHeader()})
+		deliver(&GrpcEvent{Type: GrpcClose, Status: GrpcStatusOk})
+	}()
+	return t, nil
+}
+
+func (t *flakyGrpcTransport) Send(msg []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.messages = append(t.messages, string(msg))
+	return nil
+}
+
+func (t *flakyGrpcTransport) CloseSend() error { return nil }
+
+func TestRetryGrpc(t *testing.T) {
+	transport := &flakyGrpcTransport{ok: 3}
+	d := NewGrpcDispatcher(transport)
+
+	msg := []byte("check")
+	id, err := d.Call(&GrpcRequest{
+		Service: "auth.Auth",
+		Method:  "Check",
+		Retry:   &RetryPolicy{MaxAttempts: 3, RetryOnGrpc: []int32{GrpcStatusUnavailable}, BaseInterval: Duration(10 * time.Millisecond)},
+	}, msg)
+	assert.NoError(t, err)
+	// the caller reuses the message once the call is started
+	copy(msg, "xxxxx")
+
+	events := make(chan *GrpcEvent, 8)
+	assert.True(t, d.OnEvent(id, func(ev *GrpcEvent) { events <- ev }))
+
+	// the events of the failed attempts are dropped
+	var types []GrpcEventType
+	for ev := next(t, events); ; ev = next(t, events) {
+		types = append(types, ev.Type)
+		if ev.Type == GrpcClose {
+			assert.Equal(t, GrpcStatusOk, ev.Status)
+			break
+		}
+	}
+	assert.Equal(t, []GrpcEventType{GrpcHeaders, GrpcMessage, GrpcTrailers, GrpcClose}, types)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&transport.attempts))
+	transport.lock.Lock()
+	assert.Equal(t, []string{"check", "check", "check"}, transport.messages)
+	transport.lock.Unlock()
+}
+
+func TestBackoff(t *testing.T) {
+	p := &RetryPolicy{BaseInterval: Duration(10 * time.Millisecond), MaxInterval: Duration(50 * time.Millisecond)}
+	for i := 0; i < 100; i++ {
+		assert.True(t, p.backoff(2) <= 10*time.Millisecond)
+		assert.True(t, p.backoff(3) <= 20*time.Millisecond)
+		assert.True(t, p.backoff(10) <= 50*time.Millisecond)
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import "sync"
+
+// InvokeLocked calls f with exclusive ownership of instance, locked with data
+// as for a call into the guest. It returns false without calling f if the
+// instance has been stopped.
+func InvokeLocked(instance WasmInstance, data interface{}, f func()) bool {
+	if !instance.Acquire() {
+		return false
+	}
+	defer instance.Release()
+
+	instance.Lock(data)
+	defer instance.Unlock()
+
+	f()
+
+	return true
+}
+
+// EventQueue delivers events into a wasm instance asynchronously, one at a
+// time and in the order they are posted. Each event is called through
+// InvokeLocked, so it is serialized with the other calls into the instance.
+// Posting never blocks, and can therefore be done from within a guest call.
+type EventQueue struct {
+	instance WasmInstance
+
+	lock    sync.Mutex
+	events  []queuedEvent
+	running bool
+	stopped bool
+}
+
+type queuedEvent struct {
+	data interface{}
+	f    func()
+	drop func()
+}
+
+func NewEventQueue(instance WasmInstance) *EventQueue {
+	return &EventQueue{instance: instance}
+}
+
+// Post schedules f to be called with the instance locked with data. It
+// returns false if the instance is known to be stopped, the event is then
+// dropped.
+func (q *EventQueue) Post(data interface{}, f func()) bool {
+	return q.PostOrDrop(data, f, nil)
+}
+
+// PostOrDrop is Post, drop being called instead of f if the event is dropped
+// once queued, because the instance stopped before it was delivered.
+func (q *EventQueue) PostOrDrop(data interface{}, f func(), drop func()) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.stopped {
+		return false
+	}
+
+	q.events = append(q.events, queuedEvent{data: data, f: f, drop: drop})
+	if !q.running {
+		q.running = true
+		go q.run()
+	}
+
+	return true
+}
+
+// Instance returns the instance the events are delivered to.
+func (q *EventQueue) Instance() WasmInstance {
+	return q.instance
+}
+
+// Stopped returns true once an event could not be delivered because the
+// instance has been stopped.
+func (q *EventQueue) Stopped() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.stopped
+}
+
+func (q *EventQueue) run() {
+	for {
+		q.lock.Lock()
+		if len(q.events) == 0 || q.stopped {
+			dropped := q.events
+			q.events = nil
+			q.running = false
+			q.lock.Unlock()
+
+			for _, ev := range dropped {
+				ev.dropped()
+			}
+			return
+		}
+		ev := q.events[0]
+		q.events = q.events[1:]
+		q.lock.Unlock()
+
+		if !InvokeLocked(q.instance, ev.data, ev.f) {
+			q.lock.Lock()
+			q.stopped = true
+			q.lock.Unlock()
+
+			ev.dropped()
+		}
+	}
+}
+
+func (ev queuedEvent) dropped() {
+	if ev.drop != nil {
+		ev.drop()
+	}
+}
@@ -0,0 +1,91 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// stoppableInstance fails Acquire once stopped.
+type stoppableInstance struct {
+	*mockInstance
+	stopped chan struct{}
+}
+
+func (s *stoppableInstance) Acquire() bool {
+	select {
+	case <-s.stopped:
+		return false
+	default:
+		return true
+	}
+}
+
+func TestEventQueue(t *testing.T) {
+	instance := &stoppableInstance{mockInstance: newMockInstance(0), stopped: make(chan struct{})}
+	q := NewEventQueue(instance)
+
+	delivered := make(chan int, 10)
+	for i := 0; i < 5; i++ {
+		i := i
+		assert.True(t, q.Post(i, func() {
+			// the instance is locked with the data of the event
+			assert.Equal(t, i, instance.GetData())
+			delivered <- i
+		}))
+	}
+
+	for i := 0; i < 5; i++ {
+		select {
+		case v := <-delivered:
+			assert.Equal(t, i, v)
+		case <-time.After(time.Second):
+			t.Fatal("event not delivered")
+		}
+	}
+
+	close(instance.stopped)
+	dropped := make(chan struct{}, 2)
+	posted := 0
+	for i := 0; i < 2; i++ {
+		if q.PostOrDrop(nil, func() { delivered <- -1 }, func() { dropped <- struct{}{} }) {
+			posted++
+		}
+	}
+	assert.NotZero(t, posted)
+
+	deadline := time.Now().Add(time.Second)
+	for !q.Stopped() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.True(t, q.Stopped())
+	assert.False(t, q.Post(nil, func() {}))
+	assert.Empty(t, delivered)
+
+	// the events queued once the instance stopped are dropped
+	for i := 0; i < posted; i++ {
+		select {
+		case <-dropped:
+		case <-time.After(time.Second):
+			t.Fatal("event not dropped")
+		}
+	}
+}
@@ -17,6 +17,14 @@
 
 package common
 
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+var ErrBufferRange = errors.New("buffer range out of bounds")
+
 type IoBuffer interface {
 	// Len returns the number of bytes of the unread portion of the buffer;
 	// b.Len() == len(b.Bytes()).
@@ -37,6 +45,146 @@ type IoBuffer interface {
 	Drain(offset int)
 }
 
+// MutableBuffer is an IoBuffer which can modify a range of its content in place.
+type MutableBuffer interface {
+	IoBuffer
+
+	// Replace replaces the length bytes starting at start with the contents of p.
+	// start+length must not exceed Len(), otherwise ErrBufferRange is returned.
+	Replace(start int, length int, p []byte) error
+}
+
+// ReplaceBuffer replaces the length bytes of buf starting at start with p,
+// following the proxy_set_buffer_bytes semantics: a start beyond the end of
+// the buffer appends p, and the range is clamped to the end of the buffer.
+// Buffers not implementing MutableBuffer are rewritten through Drain and Write.
+func ReplaceBuffer(buf IoBuffer, start int, length int, p []byte) error {
+	if start < 0 || length < 0 {
+		return ErrBufferRange
+	}
+
+	size := buf.Len()
+	if start > size {
+		start = size
+	}
+	if length > size-start {
+		length = size - start
+	}
+
+	if mb, ok := buf.(MutableBuffer); ok {
+		return mb.Replace(start, length, p)
+	}
+
+	if start == size {
+		_, err := buf.Write(p)
+		return err
+	}
+
+	// copy the tail first, Bytes may share its memory with the buffer
+	tail := append([]byte(nil), buf.Bytes()[start+length:]...)
+	head := append([]byte(nil), buf.Bytes()[:start]...)
+
+	buf.Drain(size)
+	for _, b := range [][]byte{head, p, tail} {
+		if _, err := buf.Write(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// InsertBuffer inserts p into buf at offset start.
+func InsertBuffer(buf IoBuffer, start int, p []byte) error {
+	return ReplaceBuffer(buf, start, 0, p)
+}
+
+// PrependBuffer inserts p at the beginning of buf.
+func PrependBuffer(buf IoBuffer, p []byte) error {
+	return ReplaceBuffer(buf, 0, 0, p)
+}
+
+// ReaderAtBuffer is an IoBuffer which can read a range of its content without
+// exposing it whole through Bytes, e.g. a large body kept in chunks or on disk.
+// Such a buffer returns nil from Bytes, or less than its Len, when its content
+// is not held in memory.
+type ReaderAtBuffer interface {
+	IoBuffer
+	io.ReaderAt
+}
+
+// bufferChunkSize is the size of the chunks copied from a ReaderAtBuffer into guest memory.
+const bufferChunkSize = 16 * 1024
+
+var bufferChunkPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, bufferChunkSize)
+		return &b
+	},
+}
+
+// CopyBufferIntoInstance copies at most length bytes of buf starting at start
+// into a single allocation of guest memory, and returns its address and size.
+// The range is clamped to the end of the buffer, a start beyond it returns
+// ErrBufferRange. The buffers holding the range in their Bytes are copied at
+// once, the other ReaderAtBuffers chunk by chunk. Nothing is allocated for an
+// empty range.
+func CopyBufferIntoInstance(instance WasmInstance, buf IoBuffer, start int, length int) (uint64, uint64, error) {
+	if start < 0 || length < 0 || start > buf.Len() {
+		return 0, 0, ErrBufferRange
+	}
+	if length > buf.Len()-start {
+		length = buf.Len() - start
+	}
+	if length == 0 {
+		return 0, 0, nil
+	}
+
+	addr, err := instance.Malloc(int32(length))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if b := buf.Bytes(); len(b) >= start+length {
+		if err := instance.PutMemory(addr, uint64(length), b[start:start+length]); err != nil {
+			return 0, 0, err
+		}
+		return addr, uint64(length), nil
+	}
+
+	ra, ok := buf.(ReaderAtBuffer)
+	if !ok {
+		return 0, 0, ErrBufferRange
+	}
+
+	bp := bufferChunkPool.Get().(*[]byte)
+	defer bufferChunkPool.Put(bp)
+
+	for off := 0; off < length; {
+		chunk := *bp
+		if length-off < len(chunk) {
+			chunk = chunk[:length-off]
+		}
+
+		n, err := ra.ReadAt(chunk, int64(start+off))
+		if n < len(chunk) && err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		if n > 0 {
+			if err := instance.PutMemory(addr+uint64(off), uint64(n), chunk[:n]); err != nil {
+				return 0, 0, err
+			}
+			off += n
+		}
+		// io.EOF is allowed along with the last chunk
+		if err != nil && off < length {
+			return 0, 0, err
+		}
+	}
+
+	return addr, uint64(length), nil
+}
+
 // CommonBuffer is a simple implementation of IoBuffer.
 type CommonBuffer struct {
 	buf []byte
@@ -62,6 +210,36 @@ func (c *CommonBuffer) Drain(offset int) {
 	c.buf = c.buf[offset:]
 }
 
+func (c *CommonBuffer) Replace(start int, length int, p []byte) error {
+	if start < 0 || length < 0 || start+length > len(c.buf) {
+		return ErrBufferRange
+	}
+
+	// always reallocate, the previous content may still be referenced through Bytes
+	buf := make([]byte, 0, len(c.buf)-length+len(p))
+	buf = append(buf, c.buf[:start]...)
+	buf = append(buf, p...)
+	buf = append(buf, c.buf[start+length:]...)
+	c.buf = buf
+
+	return nil
+}
+
+func (c *CommonBuffer) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, ErrBufferRange
+	}
+	if off >= int64(len(c.buf)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, c.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
 func NewIoBufferBytes(data []byte) IoBuffer {
 	return &CommonBuffer{buf: data}
 }
@@ -0,0 +1,131 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// plainBuffer hides the Replace method of CommonBuffer.
+type plainBuffer struct {
+	IoBuffer
+}
+
+func TestReplaceBuffer(t *testing.T) {
+	cases := []struct {
+		start, length int
+		expected      string
+	}{
+		{0, 0, "new-hello world"},  // prepend
+		{0, 11, "new-"},            // replace all
+		{0, 100, "new-"},           // replace all, clamped
+		{5, 1, "hellonew-world"},   // splice
+		{5, 0, "hellonew- world"},  // insert
+		{6, 100, "hello new-"},     // replace the tail
+		{11, 0, "hello worldnew-"}, // append
+		{20, 5, "hello worldnew-"}, // append
+	}
+
+	for _, c := range cases {
+		buffers := []IoBuffer{
+			NewIoBufferBytes([]byte("hello world")),
+			&plainBuffer{NewIoBufferBytes([]byte("hello world"))},
+		}
+		for _, buf := range buffers {
+			assert.Nil(t, ReplaceBuffer(buf, c.start, c.length, []byte("new-")))
+			assert.Equal(t, c.expected, string(buf.Bytes()), "start %d, length %d", c.start, c.length)
+		}
+	}
+
+	buf := NewIoBufferBytes([]byte("world"))
+	assert.Nil(t, PrependBuffer(buf, []byte("hello ")))
+	assert.Nil(t, InsertBuffer(buf, 5, []byte(",")))
+	assert.Equal(t, "hello, world", string(buf.Bytes()))
+
+	assert.Equal(t, ErrBufferRange, ReplaceBuffer(buf, -1, 0, nil))
+	assert.Equal(t, ErrBufferRange, buf.(MutableBuffer).Replace(10, 10, nil))
+}
+
+// streamBuffer is a ReaderAtBuffer whose content is not exposed by Bytes.
+type streamBuffer struct {
+	*CommonBuffer
+}
+
+func (b streamBuffer) Bytes() []byte { return nil }
+
+// countingInstance counts the PutMemory calls.
+type countingInstance struct {
+	*mockInstance
+	puts int
+}
+
+func (c *countingInstance) PutMemory(addr uint64, size uint64, content []byte) error {
+	c.puts++
+	return c.mockInstance.PutMemory(addr, size, content)
+}
+
+func TestCopyBufferIntoInstance(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), bufferChunkSize/4)
+
+	buffers := []IoBuffer{
+		NewIoBufferBytes(data),
+		&plainBuffer{NewIoBufferBytes(data)},
+		streamBuffer{NewIoBufferBytes(data).(*CommonBuffer)},
+	}
+	for _, buf := range buffers {
+		instance := newMockInstance(len(data) + 1024)
+
+		// read the body in two chunks, the second one being clamped
+		half := len(data) / 2
+		for start := 0; start < len(data); start += half + 1 {
+			addr, size, err := CopyBufferIntoInstance(instance, buf, start, half+1)
+			assert.Nil(t, err)
+
+			end := start + half + 1
+			if end > len(data) {
+				end = len(data)
+			}
+			assert.Equal(t, uint64(end-start), size)
+
+			mem, _ := instance.GetMemory(addr, size)
+			assert.Equal(t, data[start:end], mem)
+		}
+
+		addr, size, err := CopyBufferIntoInstance(instance, buf, len(data), 10)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(0), addr)
+		assert.Equal(t, uint64(0), size)
+
+		_, _, err = CopyBufferIntoInstance(instance, buf, len(data)+1, 10)
+		assert.Equal(t, ErrBufferRange, err)
+	}
+
+	// the in-memory buffers are copied at once, the streaming ones by chunks
+	instance := &countingInstance{mockInstance: newMockInstance(len(data) + 1024)}
+	_, _, err := CopyBufferIntoInstance(instance, NewIoBufferBytes(data), 0, len(data))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, instance.puts)
+
+	instance = &countingInstance{mockInstance: newMockInstance(len(data) + 1024)}
+	_, _, err = CopyBufferIntoInstance(instance, streamBuffer{NewIoBufferBytes(data).(*CommonBuffer)}, 0, len(data))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, instance.puts)
+}
@@ -19,27 +19,93 @@ package common
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
 )
 
-// EncodeMap encode map into bytes.
-func EncodeMap(m map[string]string) []byte {
-	if len(m) == 0 {
+var ErrInvalidMap = errors.New("invalid map encoding")
+
+// maxPooledMapBuffer is the capacity above which a map buffer is not returned to the pool.
+const maxPooledMapBuffer = 64 * 1024
+
+var mapBufferPool = sync.Pool{
+	New: func() interface{} {
+		return new([]byte)
+	},
+}
+
+// EncodeMap encode map into bytes, repeated keys are encoded as separate pairs.
+func EncodeMap(m HeaderMap) []byte {
+	if m == nil || m.Len() == 0 {
 		return nil
 	}
 
-	totalBytesLen := 4
-	for k, v := range m {
-		totalBytesLen += 4 + 4
-		totalBytesLen += len(k) + 1 + len(v) + 1
+	n, size := mapByteSize(m)
+	b := make([]byte, size)
+	size = encodeMapInto(b, m, n)
+
+	return b[:size]
+}
+
+// CopyMapIntoInstance serializes m into a single allocation of guest memory
+// and returns its address and size. The pairs are encoded into a pooled
+// buffer and written with one PutMemory call.
+func CopyMapIntoInstance(instance WasmInstance, m HeaderMap) (uint64, uint64, error) {
+	n, size := mapByteSize(m)
+
+	addr, err := instance.Malloc(int32(size))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	bp := mapBufferPool.Get().(*[]byte)
+	if cap(*bp) < size {
+		*bp = make([]byte, size)
 	}
+	b := (*bp)[:size]
+
+	size = encodeMapInto(b, m, n)
+	err = instance.PutMemory(addr, uint64(size), b[:size])
 
-	b := make([]byte, totalBytesLen)
-	binary.LittleEndian.PutUint32(b, uint32(len(m)))
+	if cap(*bp) <= maxPooledMapBuffer {
+		mapBufferPool.Put(bp)
+	}
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return addr, uint64(size), nil
+}
+
+// mapByteSize returns the number of pairs of m and the size of their encoding.
+func mapByteSize(m HeaderMap) (int, int) {
+	n, size := 0, 4
+	m.Range(func(k, v string) bool {
+		n++
+		size += 4 + 4                   // keyLen + valueLen
+		size += len(k) + 1 + len(v) + 1 // key + \0 + value + \0
+		return true
+	})
+	return n, size
+}
 
+// encodeMapInto writes the n pairs of m into b, sized by mapByteSize, and
+// returns the size of the encoding. The pairs written are counted as they
+// go, m may have changed since it was sized.
+func encodeMapInto(b []byte, m HeaderMap, n int) int {
 	lenPtr := 4
-	dataPtr := lenPtr + 8*len(m)
+	dataPtr := lenPtr + 8*n
+
+	i := 0
+	m.Range(func(k, v string) bool {
+		// m changed since it was sized
+		if i == n || dataPtr+len(k)+len(v)+2 > len(b) {
+			return false
+		}
+		i++
 
-	for k, v := range m {
 		binary.LittleEndian.PutUint32(b[lenPtr:], uint32(len(k)))
 		lenPtr += 4
 		binary.LittleEndian.PutUint32(b[lenPtr:], uint32(len(v)))
@@ -47,56 +113,84 @@ func EncodeMap(m map[string]string) []byte {
 
 		copy(b[dataPtr:], k)
 		dataPtr += len(k)
-		b[dataPtr] = '0'
+		b[dataPtr] = 0
 		dataPtr++
 
 		copy(b[dataPtr:], v)
 		dataPtr += len(v)
-		b[dataPtr] = '0'
+		b[dataPtr] = 0
 		dataPtr++
+
+		return true
+	})
+
+	binary.LittleEndian.PutUint32(b, uint32(i))
+
+	// fewer pairs than sized, the data follows the sizes actually written
+	if i < n {
+		copy(b[lenPtr:], b[4+8*n:dataPtr])
+		dataPtr -= 8 * (n - i)
 	}
 
-	return b
+	return dataPtr
 }
 
-// DecodeMap decode map from rawData.
-func DecodeMap(rawData []byte) map[string]string {
+// DecodeMap decode map from rawData, keeping the order and the repeated keys
+// of the pairs. Keys and values are located by their sizes, so they may hold
+// any bytes. An empty rawData is an empty map, malformed data returns an
+// error wrapping ErrInvalidMap.
+func DecodeMap(rawData []byte) (*CommonHeader, error) {
+	res := NewCommonHeader()
+
+	if len(rawData) == 0 {
+		return res, nil
+	}
 	if len(rawData) < 4 {
-		return nil
+		return nil, fmt.Errorf("%w: %d bytes", ErrInvalidMap, len(rawData))
 	}
 
 	headerSize := binary.LittleEndian.Uint32(rawData[0:4])
 
-	dataPtr := 4 + (4+4)*int(headerSize) // headerSize + (key1_size + value1_size) * headerSize
-	if dataPtr >= len(rawData) {
-		return nil
+	// each pair takes at least its two sizes and two terminators
+	if uint64(headerSize)*(4+4+1+1) > uint64(len(rawData)-4) {
+		return nil, fmt.Errorf("%w: %d pairs in %d bytes", ErrInvalidMap, headerSize, len(rawData))
 	}
 
-	res := make(map[string]string, headerSize)
+	dataPtr := 4 + (4+4)*int(headerSize) // headerSize + (key1_size + value1_size) * headerSize
 
 	for i := 0; i < int(headerSize); i++ {
 		lenIndex := 4 + (4+4)*i
-		keySize := int(binary.LittleEndian.Uint32(rawData[lenIndex : lenIndex+4]))
-		valueSize := int(binary.LittleEndian.Uint32(rawData[lenIndex+4 : lenIndex+8]))
+		keySize := binary.LittleEndian.Uint32(rawData[lenIndex : lenIndex+4])
+		valueSize := binary.LittleEndian.Uint32(rawData[lenIndex+4 : lenIndex+8])
 
-		if dataPtr >= len(rawData) || dataPtr+keySize > len(rawData) {
-			break
+		key, err := decodeMapString(rawData, dataPtr, keySize)
+		if err != nil {
+			return nil, fmt.Errorf("%w: key of pair %d %v", ErrInvalidMap, i, err)
 		}
+		dataPtr += len(key) + 1
 
-		key := string(rawData[dataPtr : dataPtr+keySize])
-		dataPtr += keySize
-		dataPtr++ // 0
-
-		if dataPtr >= len(rawData) || dataPtr+keySize > len(rawData) {
-			break
+		value, err := decodeMapString(rawData, dataPtr, valueSize)
+		if err != nil {
+			return nil, fmt.Errorf("%w: value of pair %d %v", ErrInvalidMap, i, err)
 		}
+		dataPtr += len(value) + 1
+
+		res.Add(string(key), string(value))
+	}
+
+	return res, nil
+}
 
-		value := string(rawData[dataPtr : dataPtr+valueSize])
-		dataPtr += valueSize
-		dataPtr++ // 0
+// decodeMapString returns the size bytes of rawData at ptr, which must be followed by a NUL.
+func decodeMapString(rawData []byte, ptr int, size uint32) ([]byte, error) {
+	if uint64(size) >= uint64(len(rawData)-ptr) {
+		return nil, errors.New("overflows the data")
+	}
 
-		res[key] = value
+	end := ptr + int(size)
+	if rawData[end] != 0 {
+		return nil, errors.New("is not NUL terminated")
 	}
 
-	return res
+	return rawData[ptr:end], nil
 }
@@ -18,27 +18,259 @@
 package common
 
 import (
-	"reflect"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestEncodeDecodeMap(t *testing.T) {
-	m := map[string]string{
+	m := NewCommonHeaderFromMap(map[string]string{
 		"key1": "value1",
 		"key2": "value2",
 		"key3": "value3",
-	}
+	})
+	m.Add("key1", "value4")
 
 	b := EncodeMap(m)
 	assert.NotNil(t, b)
 
-	mm := DecodeMap(b)
-	assert.NotNil(t, mm)
+	mm, err := DecodeMap(b)
+	assert.Nil(t, err)
+
+	assert.Equal(t, m, mm)
+	assert.Equal(t, []string{"value1", "value4"}, mm.Values("key1"))
+
+	assert.Nil(t, EncodeMap(NewCommonHeader()))
+
+	mm, err = DecodeMap(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, mm.Len())
+}
+
+func TestEncodeDecodeBinaryMap(t *testing.T) {
+	m := NewCommonHeader()
+	m.AddBytes("trace-bin", []byte{0, 1, 0, 0xff})
+	m.AddBytes("empty-bin", nil)
+
+	b := EncodeMap(m)
+	assert.Equal(t, []byte{
+		2, 0, 0, 0,
+		9, 0, 0, 0, 4, 0, 0, 0,
+		9, 0, 0, 0, 0, 0, 0, 0,
+		't', 'r', 'a', 'c', 'e', '-', 'b', 'i', 'n', 0, 0, 1, 0, 0xff, 0,
+		'e', 'm', 'p', 't', 'y', '-', 'b', 'i', 'n', 0, 0,
+	}, b)
+
+	mm, err := DecodeMap(b)
+	assert.Nil(t, err)
+
+	v, ok := mm.GetBytes("trace-bin")
+	assert.True(t, ok)
+	assert.Equal(t, []byte{0, 1, 0, 0xff}, v)
+}
+
+func TestDecodeInvalidMap(t *testing.T) {
+	b := EncodeMap(NewCommonHeaderFromMap(map[string]string{"key": "value"}))
+
+	missingTerminator := append([]byte(nil), b...)
+	missingTerminator[len(b)-1] = '0'
+
+	largeValue := append([]byte(nil), b...)
+	largeValue[8] = 100
+
+	tooManyPairs := append([]byte(nil), b...)
+	tooManyPairs[0] = 2
+
+	for _, raw := range [][]byte{
+		{1, 0},
+		b[:len(b)-1],
+		missingTerminator,
+		largeValue,
+		tooManyPairs,
+		{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0},
+	} {
+		_, err := DecodeMap(raw)
+		assert.True(t, errors.Is(err, ErrInvalidMap), "%v", raw)
+	}
+}
+
+func TestCopyMapIntoInstance(t *testing.T) {
+	instance := newMockInstance(1024)
+
+	m := NewCommonHeader()
+	m.Add("key1", "value1")
+	m.Add("key1", "value2")
+	m.Add("", "")
+
+	addr, size, err := CopyMapIntoInstance(instance, m)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4+3*8+len("key1\x00value1\x00key1\x00value2\x00\x00\x00")), size)
+
+	raw, err := instance.GetMemory(addr, size)
+	assert.Nil(t, err)
+	assert.Equal(t, EncodeMap(m), raw)
+	mm, err := DecodeMap(raw)
+	assert.Nil(t, err)
+	assert.Equal(t, m, mm)
+
+	_, _, err = CopyMapIntoInstance(newMockInstance(16), m)
+	assert.NotNil(t, err)
+}
+
+// shrinkingHeader loses its last pair once it has been ranged over.
+type shrinkingHeader struct {
+	*CommonHeader
+}
+
+func (h shrinkingHeader) Range(f func(key, value string) bool) {
+	h.CommonHeader.Range(f)
+	h.pairs = h.pairs[:len(h.pairs)-1]
+}
+
+func TestEncodeShrinkingMap(t *testing.T) {
+	m := shrinkingHeader{NewCommonHeader(HeaderPair{Key: "a", Value: "1"}, HeaderPair{Key: "b", Value: "2"})}
+
+	n, size := mapByteSize(m)
+	b := make([]byte, size)
+	b = b[:encodeMapInto(b, m, n)]
+
+	// the header counts the pair actually written
+	mm, err := DecodeMap(b)
+	assert.Nil(t, err)
+	assert.Equal(t, NewCommonHeader(HeaderPair{Key: "a", Value: "1"}), mm)
+	assert.Equal(t, len(EncodeMap(mm)), len(b))
+}
+
+func benchmarkHeader(n int) HeaderMap {
+	m := NewCommonHeader()
+	for i := 0; i < n; i++ {
+		m.Add(fmt.Sprintf("x-header-%d", i), strings.Repeat("v", 32))
+	}
+	return m
+}
+
+// copyMapPerField is the former serialization, issuing one write per field.
+func copyMapPerField(instance WasmInstance, m HeaderMap) {
+	cloneMap := make(map[string]string)
+	totalBytesLen := 4
+	m.Range(func(key, value string) bool {
+		cloneMap[key] = value
+		totalBytesLen += 4 + 4 + len(key) + 1 + len(value) + 1
+		return true
+	})
+
+	addr, _ := instance.Malloc(int32(totalBytesLen))
+	_ = instance.PutUint32(addr, uint32(len(cloneMap)))
+
+	lenPtr := addr + 4
+	dataPtr := lenPtr + uint64(8*len(cloneMap))
+
+	for k, v := range cloneMap {
+		_ = instance.PutUint32(lenPtr, uint32(len(k)))
+		lenPtr += 4
+		_ = instance.PutUint32(lenPtr, uint32(len(v)))
+		lenPtr += 4
+
+		_ = instance.PutMemory(dataPtr, uint64(len(k)), []byte(k))
+		dataPtr += uint64(len(k))
+		_ = instance.PutByte(dataPtr, 0)
+		dataPtr++
+
+		_ = instance.PutMemory(dataPtr, uint64(len(v)), []byte(v))
+		dataPtr += uint64(len(v))
+		_ = instance.PutByte(dataPtr, 0)
+		dataPtr++
+	}
+}
+
+// engineInstance is a mockInstance whose memory accessors fetch the memory
+// export on each call and check their bounds against it, as the engines do,
+// e.g. wasmer crossing into the runtime for the memory of the instance.
+type engineInstance struct {
+	*mockInstance
+	memories map[string][]byte
+	calls    int
+}
+
+func newEngineInstance(memSize int) *engineInstance {
+	m := newMockInstance(memSize)
+	return &engineInstance{mockInstance: m, memories: map[string][]byte{"memory": m.mem}}
+}
+
+func (e *engineInstance) GetExportsMem(memName string) ([]byte, error) {
+	e.calls++
+	mem, ok := e.memories[memName]
+	if !ok {
+		return nil, errors.New("memory not found")
+	}
+	return mem, nil
+}
+
+func (e *engineInstance) PutMemory(addr uint64, size uint64, content []byte) error {
+	mem, err := e.GetExportsMem("memory")
+	if err != nil {
+		return err
+	}
+	if addr+size > uint64(len(mem)) {
+		return errMockAddrOverflow
+	}
+	copy(mem[addr:addr+size], content)
+	return nil
+}
+
+func (e *engineInstance) PutByte(addr uint64, b byte) error {
+	mem, err := e.GetExportsMem("memory")
+	if err != nil {
+		return err
+	}
+	if addr >= uint64(len(mem)) {
+		return errMockAddrOverflow
+	}
+	mem[addr] = b
+	return nil
+}
+
+func (e *engineInstance) PutUint32(addr uint64, value uint32) error {
+	mem, err := e.GetExportsMem("memory")
+	if err != nil {
+		return err
+	}
+	if addr+4 > uint64(len(mem)) {
+		return errMockAddrOverflow
+	}
+	binary.LittleEndian.PutUint32(mem[addr:], value)
+	return nil
+}
 
-	assert.True(t, reflect.DeepEqual(m, mm))
+// BenchmarkCopyMapIntoInstance reports the memory export lookups per copy
+// along with the time, the lookups being what dominates with a real engine.
+func BenchmarkCopyMapIntoInstance(b *testing.B) {
+	for _, n := range []int{10, 50, 200} {
+		m := benchmarkHeader(n)
+		instance := newEngineInstance(64 * 1024)
 
-	var emptyMap map[string]string
-	assert.Nil(t, EncodeMap(emptyMap))
+		b.Run(fmt.Sprintf("bulk-%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			instance.calls = 0
+			for i := 0; i < b.N; i++ {
+				instance.brk = 8
+				_, _, _ = CopyMapIntoInstance(instance, m)
+			}
+			b.ReportMetric(float64(instance.calls)/float64(b.N), "exports-mem/op")
+		})
+
+		b.Run(fmt.Sprintf("per-field-%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			instance.calls = 0
+			for i := 0; i < b.N; i++ {
+				instance.brk = 8
+				copyMapPerField(instance, m)
+			}
+			b.ReportMetric(float64(instance.calls)/float64(b.N), "exports-mem/op")
+		})
+	}
 }
@@ -0,0 +1,141 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import "sync"
+
+// ContextRegistry maps the IDs of the contexts created in a wasm instance to
+// the data the instance is locked with for the guest calls of each context,
+// e.g. its ContextHandler, along with the root context each belongs to.
+// Asynchronous events, and the guest switching context, use it to find the
+// handler of a context after the instance has been locked for another one.
+type ContextRegistry struct {
+	lock     sync.RWMutex
+	contexts map[int32]registeredContext
+}
+
+type registeredContext struct {
+	data          interface{}
+	rootContextID int32
+}
+
+var registries = struct {
+	sync.Mutex
+	m map[WasmInstance]*ContextRegistry
+}{m: make(map[WasmInstance]*ContextRegistry)}
+
+// GetContextRegistry returns the context registry of instance, creating it
+// on first use. The registry is dropped once instance stops.
+func GetContextRegistry(instance WasmInstance) *ContextRegistry {
+	registries.Lock()
+	r, ok := registries.m[instance]
+	if !ok {
+		r = &ContextRegistry{contexts: make(map[int32]registeredContext)}
+		registries.m[instance] = r
+	}
+	registries.Unlock()
+
+	// outside of the lock, the hook running right away if instance stopped
+	if !ok {
+		instance.OnStop(func() { removeContextRegistry(instance, r) })
+	}
+
+	return r
+}
+
+// RemoveContextRegistry forgets the contexts of instance, which is otherwise
+// done once it stops.
+func RemoveContextRegistry(instance WasmInstance) {
+	removeContextRegistry(instance, nil)
+}
+
+// removeContextRegistry forgets the registry of instance, only if it is r
+// unless r is nil.
+func removeContextRegistry(instance WasmInstance, r *ContextRegistry) {
+	registries.Lock()
+	defer registries.Unlock()
+
+	if cur, ok := registries.m[instance]; ok && (r == nil || cur == r) {
+		delete(registries.m, instance)
+	}
+}
+
+// LookupContext returns the data registered for contextID in instance,
+// without creating the registry of instance.
+func LookupContext(instance WasmInstance, contextID int32) (interface{}, bool) {
+	registries.Lock()
+	r, ok := registries.m[instance]
+	registries.Unlock()
+
+	if !ok {
+		return nil, false
+	}
+	return r.Get(contextID)
+}
+
+// Register registers the context contextID created under parentContextID,
+// 0 for a root context, with the data its guest calls are made with.
+func (r *ContextRegistry) Register(contextID int32, parentContextID int32, data interface{}) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	rootContextID := contextID
+	if parentContextID != 0 {
+		rootContextID = parentContextID
+		if parent, ok := r.contexts[parentContextID]; ok {
+			rootContextID = parent.rootContextID
+		}
+	}
+
+	r.contexts[contextID] = registeredContext{data: data, rootContextID: rootContextID}
+}
+
+// Unregister forgets the context contextID.
+func (r *ContextRegistry) Unregister(contextID int32) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.contexts, contextID)
+}
+
+// Get returns the data registered for contextID.
+func (r *ContextRegistry) Get(contextID int32) (interface{}, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	c, ok := r.contexts[contextID]
+	return c.data, ok
+}
+
+// RootContextID returns the root context of contextID, contextID itself for
+// a root context.
+func (r *ContextRegistry) RootContextID(contextID int32) (int32, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	c, ok := r.contexts[contextID]
+	return c.rootContextID, ok
+}
+
+// Len returns the number of registered contexts.
+func (r *ContextRegistry) Len() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	return len(r.contexts)
+}
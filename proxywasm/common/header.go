@@ -17,12 +17,23 @@
 
 package common
 
+import "sort"
+
 // HeaderMap is a interface to provide operation facade with user-value headers.
+// Implementations keep the insertion order of the pairs and may hold several
+// values for the same key.
 type HeaderMap interface {
 	// Get value of key
 	// If multiple values associated with this key, first one will be returned.
 	Get(key string) (string, bool)
 
+	// GetAll returns all values associated with key, in insertion order, nil
+	// if there is none.
+	GetAll(key string) []string
+
+	// Values is GetAll, named after http.Header.Values.
+	Values(key string) []string
+
 	// Set key-value pair in header map, the previous pair will be replaced if exists
 	Set(key, value string)
 
@@ -34,10 +45,14 @@ type HeaderMap interface {
 	// Del delete pair of specified key
 	Del(key string)
 
-	// Range calls f sequentially for each key and value present in the map.
+	// Range calls f sequentially for each key and value present in the map,
+	// in insertion order. A key with several values is visited once per value.
 	// If f returns false, range stops the iteration.
 	Range(f func(key, value string) bool)
 
+	// Len returns the number of pairs, counting each value of a repeated key.
+	Len() int
+
 	// Clone used to deep copy header's map
 	Clone() HeaderMap
 
@@ -45,50 +60,165 @@ type HeaderMap interface {
 	ByteSize() uint64
 }
 
-// CommonHeader is a simple implementation of HeaderMap.
-type CommonHeader map[string]string
+// BinaryHeaderMap is a HeaderMap giving access to its values as bytes, for
+// values which are not text, e.g. the gRPC metadata with a "-bin" key suffix.
+// The pairs codec is binary-safe, the values reach the guest unchanged.
+type BinaryHeaderMap interface {
+	HeaderMap
+
+	// GetBytes returns the first value of key.
+	GetBytes(key string) ([]byte, bool)
+
+	// SetBytes sets the value of key, replacing its previous values.
+	SetBytes(key string, value []byte)
+
+	// AddBytes adds a value for key.
+	AddBytes(key string, value []byte)
+
+	// RangeBytes calls f sequentially for each key and value, like Range.
+	// The value must not be retained or modified by f.
+	RangeBytes(f func(key string, value []byte) bool)
+}
+
+// HeaderPair is a single key-value pair of a HeaderMap.
+type HeaderPair struct {
+	Key   string
+	Value string
+}
+
+// CommonHeader is a simple implementation of HeaderMap and BinaryHeaderMap.
+type CommonHeader struct {
+	pairs []HeaderPair
+}
+
+// NewCommonHeader returns a CommonHeader holding pairs, in order.
+func NewCommonHeader(pairs ...HeaderPair) *CommonHeader {
+	return &CommonHeader{pairs: pairs}
+}
+
+// NewCommonHeaderFromMap builds a CommonHeader from m, ordered by key.
+func NewCommonHeaderFromMap(m map[string]string) *CommonHeader {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := &CommonHeader{pairs: make([]HeaderPair, 0, len(m))}
+	for _, k := range keys {
+		h.pairs = append(h.pairs, HeaderPair{Key: k, Value: m[k]})
+	}
 
-func (h CommonHeader) Get(key string) (value string, ok bool) {
-	value, ok = h[key]
-	return
+	return h
 }
 
-func (h CommonHeader) Set(key string, value string) {
-	h[key] = value
+func (h *CommonHeader) Get(key string) (string, bool) {
+	for _, p := range h.pairs {
+		if p.Key == key {
+			return p.Value, true
+		}
+	}
+	return "", false
 }
 
-func (h CommonHeader) Add(key string, value string) {
-	panic("not supported")
+func (h *CommonHeader) GetAll(key string) []string {
+	var values []string
+	for _, p := range h.pairs {
+		if p.Key == key {
+			values = append(values, p.Value)
+		}
+	}
+	return values
 }
 
-func (h CommonHeader) Del(key string) {
-	delete(h, key)
+func (h *CommonHeader) Values(key string) []string {
+	return h.GetAll(key)
 }
 
-func (h CommonHeader) Range(f func(key, value string) bool) {
-	for k, v := range h {
+func (h *CommonHeader) Set(key string, value string) {
+	found := false
+	pairs := h.pairs[:0]
+
+	for _, p := range h.pairs {
+		if p.Key == key {
+			if found {
+				continue
+			}
+			// replace the first occurrence in place, drop the others
+			found = true
+			p.Value = value
+		}
+		pairs = append(pairs, p)
+	}
+
+	if !found {
+		pairs = append(pairs, HeaderPair{Key: key, Value: value})
+	}
+
+	h.pairs = pairs
+}
+
+func (h *CommonHeader) Add(key string, value string) {
+	h.pairs = append(h.pairs, HeaderPair{Key: key, Value: value})
+}
+
+func (h *CommonHeader) Del(key string) {
+	pairs := h.pairs[:0]
+	for _, p := range h.pairs {
+		if p.Key != key {
+			pairs = append(pairs, p)
+		}
+	}
+	h.pairs = pairs
+}
+
+func (h *CommonHeader) Range(f func(key, value string) bool) {
+	for _, p := range h.pairs {
 		// stop if f return false
-		if !f(k, v) {
+		if !f(p.Key, p.Value) {
 			break
 		}
 	}
 }
 
-func (h CommonHeader) Clone() HeaderMap {
-	copy := make(map[string]string)
-
-	for k, v := range h {
-		copy[k] = v
+func (h *CommonHeader) GetBytes(key string) ([]byte, bool) {
+	value, ok := h.Get(key)
+	if !ok {
+		return nil, false
 	}
+	return []byte(value), true
+}
+
+func (h *CommonHeader) SetBytes(key string, value []byte) {
+	h.Set(key, string(value))
+}
+
+func (h *CommonHeader) AddBytes(key string, value []byte) {
+	h.Add(key, string(value))
+}
+
+func (h *CommonHeader) RangeBytes(f func(key string, value []byte) bool) {
+	h.Range(func(key, value string) bool {
+		return f(key, []byte(value))
+	})
+}
+
+func (h *CommonHeader) Len() int {
+	return len(h.pairs)
+}
+
+func (h *CommonHeader) Clone() HeaderMap {
+	pairs := make([]HeaderPair, len(h.pairs))
+	copy(pairs, h.pairs)
 
-	return CommonHeader(copy)
+	return &CommonHeader{pairs: pairs}
 }
 
-func (h CommonHeader) ByteSize() uint64 {
+func (h *CommonHeader) ByteSize() uint64 {
 	var size uint64
 
-	for k, v := range h {
-		size += uint64(len(k) + len(v))
+	for _, p := range h.pairs {
+		size += uint64(len(p.Key) + len(p.Value))
 	}
 	return size
 }
@@ -0,0 +1,66 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func pairsOf(h HeaderMap) []HeaderPair {
+	var pairs []HeaderPair
+	h.Range(func(key, value string) bool {
+		pairs = append(pairs, HeaderPair{Key: key, Value: value})
+		return true
+	})
+	return pairs
+}
+
+func TestCommonHeader(t *testing.T) {
+	h := NewCommonHeader()
+	h.Add("set-cookie", "a=1")
+	h.Add("x-b", "b")
+	h.Add("set-cookie", "b=2")
+
+	assert.Equal(t, 3, h.Len())
+	assert.Equal(t, []string{"a=1", "b=2"}, h.Values("set-cookie"))
+	assert.Equal(t, []string{"a=1", "b=2"}, h.GetAll("set-cookie"))
+	assert.Nil(t, h.GetAll("via"))
+
+	v, ok := h.Get("set-cookie")
+	assert.True(t, ok)
+	assert.Equal(t, "a=1", v)
+
+	clone := h.Clone()
+
+	// Set replaces the first value in place and drops the others
+	h.Set("set-cookie", "c=3")
+	assert.Equal(t, []HeaderPair{{"set-cookie", "c=3"}, {"x-b", "b"}}, pairsOf(h))
+
+	h.Set("x-a", "a")
+	h.Del("x-b")
+	assert.Equal(t, []HeaderPair{{"set-cookie", "c=3"}, {"x-a", "a"}}, pairsOf(h))
+	assert.Equal(t, uint64(len("set-cookiec=3x-aa")), h.ByteSize())
+
+	_, ok = h.Get("x-b")
+	assert.False(t, ok)
+
+	assert.Equal(t, 3, clone.Len())
+	assert.Equal(t, []string{"a=1", "b=2"}, clone.Values("set-cookie"))
+}
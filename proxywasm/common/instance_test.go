@@ -0,0 +1,170 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"reflect"
+)
+
+var errMockAddrOverflow = errors.New("addr overflow")
+
+// mockInstance is an in-memory WasmInstance used by the tests of this package.
+type mockInstance struct {
+	mem     []byte
+	brk     uint64
+	imports map[string]interface{}
+	exports map[string]WasmFunction
+	data    interface{}
+}
+
+func newMockInstance(memSize int) *mockInstance {
+	return &mockInstance{
+		mem:     make([]byte, memSize),
+		brk:     8,
+		imports: make(map[string]interface{}),
+		exports: make(map[string]WasmFunction),
+	}
+}
+
+// callImport invokes a registered import the way an engine does, passing itself as the instance.
+func (m *mockInstance) callImport(name string, args ...interface{}) []interface{} {
+	in := []reflect.Value{reflect.ValueOf(m)}
+	for _, a := range args {
+		in = append(in, reflect.ValueOf(a))
+	}
+
+	var res []interface{}
+	for _, v := range reflect.ValueOf(m.imports[name]).Call(in) {
+		res = append(res, v.Interface())
+	}
+	return res
+}
+
+type mockFunction func(args ...interface{}) (interface{}, error)
+
+func (f mockFunction) Call(args ...interface{}) (interface{}, error) { return f(args...) }
+
+func (m *mockInstance) Start() error { return nil }
+
+func (m *mockInstance) Stop() {}
+
+func (m *mockInstance) OnStop(f func()) {}
+
+func (m *mockInstance) RegisterFunc(namespace string, funcName string, f interface{}) error {
+	m.imports[funcName] = f
+	return nil
+}
+
+func (m *mockInstance) GetExportsFunc(funcName string) (WasmFunction, error) {
+	if f, ok := m.exports[funcName]; ok {
+		return f, nil
+	}
+	return nil, errors.New("export not found")
+}
+
+func (m *mockInstance) GetExportsMem(memName string) ([]byte, error) { return m.mem, nil }
+
+func (m *mockInstance) GetMemory(addr uint64, size uint64) ([]byte, error) {
+	if addr+size > uint64(len(m.mem)) {
+		return nil, errMockAddrOverflow
+	}
+	return m.mem[addr : addr+size], nil
+}
+
+func (m *mockInstance) PutMemory(addr uint64, size uint64, content []byte) error {
+	if addr+size > uint64(len(m.mem)) {
+		return errMockAddrOverflow
+	}
+	if uint64(len(content)) < size {
+		size = uint64(len(content))
+	}
+	copy(m.mem[addr:], content[:size])
+	return nil
+}
+
+func (m *mockInstance) GetByte(addr uint64) (byte, error) {
+	if addr >= uint64(len(m.mem)) {
+		return 0, errMockAddrOverflow
+	}
+	return m.mem[addr], nil
+}
+
+func (m *mockInstance) PutByte(addr uint64, b byte) error {
+	if addr >= uint64(len(m.mem)) {
+		return errMockAddrOverflow
+	}
+	m.mem[addr] = b
+	return nil
+}
+
+func (m *mockInstance) GetUint32(addr uint64) (uint32, error) {
+	if addr+4 > uint64(len(m.mem)) {
+		return 0, errMockAddrOverflow
+	}
+	return binary.LittleEndian.Uint32(m.mem[addr:]), nil
+}
+
+func (m *mockInstance) PutUint32(addr uint64, value uint32) error {
+	if addr+4 > uint64(len(m.mem)) {
+		return errMockAddrOverflow
+	}
+	binary.LittleEndian.PutUint32(m.mem[addr:], value)
+	return nil
+}
+
+func (m *mockInstance) GetUint64(addr uint64) (uint64, error) {
+	if addr+8 > uint64(len(m.mem)) {
+		return 0, errMockAddrOverflow
+	}
+	return binary.LittleEndian.Uint64(m.mem[addr:]), nil
+}
+
+func (m *mockInstance) PutUint64(addr uint64, value uint64) error {
+	if addr+8 > uint64(len(m.mem)) {
+		return errMockAddrOverflow
+	}
+	binary.LittleEndian.PutUint64(m.mem[addr:], value)
+	return nil
+}
+
+func (m *mockInstance) Malloc(size int32) (uint64, error) {
+	addr := m.brk
+	if addr+uint64(size) > uint64(len(m.mem)) {
+		return 0, errMockAddrOverflow
+	}
+	m.brk += uint64(size)
+	return addr, nil
+}
+
+func (m *mockInstance) GetData() interface{} { return m.data }
+
+func (m *mockInstance) SetData(data interface{}) { m.data = data }
+
+func (m *mockInstance) Acquire() bool { return true }
+
+func (m *mockInstance) Release() {}
+
+func (m *mockInstance) Lock(data interface{}) { m.data = data }
+
+func (m *mockInstance) Unlock() { m.data = nil }
+
+func (m *mockInstance) GetModule() WasmModule { return nil }
+
+func (m *mockInstance) HandleError(err error) {}
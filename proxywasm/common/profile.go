@@ -0,0 +1,281 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CallKind tells whether a profiled function is a host import or a guest export.
+type CallKind int
+
+const (
+	// CallKindImport is a host function called by the guest, e.g. proxy_log.
+	CallKindImport CallKind = iota
+	// CallKindExport is a guest function called by the host, e.g. proxy_on_request_headers.
+	CallKindExport
+)
+
+func (k CallKind) String() string {
+	if k == CallKindExport {
+		return "export"
+	}
+	return "import"
+}
+
+// CallStats holds the numbers collected for one function of one plugin.
+type CallStats struct {
+	Plugin string
+	Name   string
+	Kind   CallKind
+
+	Calls        uint64
+	TotalLatency time.Duration
+	MaxLatency   time.Duration
+
+	// BytesIn is the number of bytes the host read out of guest memory.
+	BytesIn uint64
+	// BytesOut is the number of bytes the host wrote into guest memory.
+	BytesOut uint64
+}
+
+type callKey struct {
+	plugin string
+	name   string
+	kind   CallKind
+}
+
+// Profiler collects CallStats from instances wrapped by NewProfiledInstance.
+type Profiler struct {
+	lock  sync.Mutex
+	stats map[callKey]*CallStats
+}
+
+func NewProfiler() *Profiler {
+	return &Profiler{stats: make(map[callKey]*CallStats)}
+}
+
+func (p *Profiler) record(key callKey, latency time.Duration, bytesIn uint64, bytesOut uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	s, ok := p.stats[key]
+	if !ok {
+		s = &CallStats{Plugin: key.plugin, Name: key.name, Kind: key.kind}
+		p.stats[key] = s
+	}
+
+	s.Calls++
+	s.TotalLatency += latency
+	if latency > s.MaxLatency {
+		s.MaxLatency = latency
+	}
+	s.BytesIn += bytesIn
+	s.BytesOut += bytesOut
+}
+
+// Stats returns a snapshot of all collected numbers, ordered by plugin, kind and name.
+func (p *Profiler) Stats() []CallStats {
+	p.lock.Lock()
+	res := make([]CallStats, 0, len(p.stats))
+	for _, s := range p.stats {
+		res = append(res, *s)
+	}
+	p.lock.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Plugin != res[j].Plugin {
+			return res[i].Plugin < res[j].Plugin
+		}
+		if res[i].Kind != res[j].Kind {
+			return res[i].Kind < res[j].Kind
+		}
+		return res[i].Name < res[j].Name
+	})
+
+	return res
+}
+
+// PluginStats returns the numbers collected for the given plugin only.
+func (p *Profiler) PluginStats(plugin string) []CallStats {
+	all := p.Stats()
+	res := all[:0]
+	for _, s := range all {
+		if s.Plugin == plugin {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// Reset drops all collected numbers.
+func (p *Profiler) Reset() {
+	p.lock.Lock()
+	p.stats = make(map[callKey]*CallStats)
+	p.lock.Unlock()
+}
+
+// profiledInstance decorates a WasmInstance, timing every registered import and
+// every export obtained through GetExportsFunc, and counting the bytes moved
+// across guest memory while they run.
+type profiledInstance struct {
+	// keep the counters first for 64-bit aligned atomic access
+	bytesIn  uint64
+	bytesOut uint64
+
+	WasmInstance
+	plugin   string
+	profiler *Profiler
+}
+
+// NewProfiledInstance wraps instance so that its calls are recorded into profiler
+// under the given plugin name. It must be used in place of instance, including
+// when registering the ABI imports, e.g. v1.RegisterImports(NewProfiledInstance(...)).
+func NewProfiledInstance(instance WasmInstance, plugin string, profiler *Profiler) WasmInstance {
+	return &profiledInstance{
+		WasmInstance: instance,
+		plugin:       plugin,
+		profiler:     profiler,
+	}
+}
+
+func (p *profiledInstance) counters() (uint64, uint64) {
+	return atomic.LoadUint64(&p.bytesIn), atomic.LoadUint64(&p.bytesOut)
+}
+
+func (p *profiledInstance) measure(name string, kind CallKind) func() {
+	start := time.Now()
+	in, out := p.counters()
+
+	return func() {
+		newIn, newOut := p.counters()
+		p.profiler.record(callKey{plugin: p.plugin, name: name, kind: kind}, time.Since(start), newIn-in, newOut-out)
+	}
+}
+
+func (p *profiledInstance) RegisterFunc(namespace string, funcName string, f interface{}) error {
+	fv := reflect.ValueOf(f)
+	if f == nil || fv.Kind() != reflect.Func || fv.Type().NumIn() < 1 ||
+		!reflect.TypeOf(p).AssignableTo(fv.Type().In(0)) {
+		return p.WasmInstance.RegisterFunc(namespace, funcName, f)
+	}
+
+	self := reflect.ValueOf(p)
+	wrapped := reflect.MakeFunc(fv.Type(), func(args []reflect.Value) []reflect.Value {
+		// route the memory accesses of the import through the profiled instance
+		args[0] = self
+		defer p.measure(funcName, CallKindImport)()
+		return fv.Call(args)
+	})
+
+	return p.WasmInstance.RegisterFunc(namespace, funcName, wrapped.Interface())
+}
+
+func (p *profiledInstance) GetExportsFunc(funcName string) (WasmFunction, error) {
+	f, err := p.WasmInstance.GetExportsFunc(funcName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &profiledFunction{WasmFunction: f, name: funcName, instance: p}, nil
+}
+
+func (p *profiledInstance) GetMemory(addr uint64, size uint64) ([]byte, error) {
+	b, err := p.WasmInstance.GetMemory(addr, size)
+	if err == nil {
+		atomic.AddUint64(&p.bytesIn, uint64(len(b)))
+	}
+	return b, err
+}
+
+func (p *profiledInstance) PutMemory(addr uint64, size uint64, content []byte) error {
+	err := p.WasmInstance.PutMemory(addr, size, content)
+	if err == nil {
+		n := uint64(len(content))
+		if size < n {
+			n = size
+		}
+		atomic.AddUint64(&p.bytesOut, n)
+	}
+	return err
+}
+
+func (p *profiledInstance) GetByte(addr uint64) (byte, error) {
+	b, err := p.WasmInstance.GetByte(addr)
+	if err == nil {
+		atomic.AddUint64(&p.bytesIn, 1)
+	}
+	return b, err
+}
+
+func (p *profiledInstance) PutByte(addr uint64, b byte) error {
+	err := p.WasmInstance.PutByte(addr, b)
+	if err == nil {
+		atomic.AddUint64(&p.bytesOut, 1)
+	}
+	return err
+}
+
+func (p *profiledInstance) GetUint32(addr uint64) (uint32, error) {
+	v, err := p.WasmInstance.GetUint32(addr)
+	if err == nil {
+		atomic.AddUint64(&p.bytesIn, 4)
+	}
+	return v, err
+}
+
+func (p *profiledInstance) PutUint32(addr uint64, value uint32) error {
+	err := p.WasmInstance.PutUint32(addr, value)
+	if err == nil {
+		atomic.AddUint64(&p.bytesOut, 4)
+	}
+	return err
+}
+
+func (p *profiledInstance) GetUint64(addr uint64) (uint64, error) {
+	v, err := p.WasmInstance.GetUint64(addr)
+	if err == nil {
+		atomic.AddUint64(&p.bytesIn, 8)
+	}
+	return v, err
+}
+
+func (p *profiledInstance) PutUint64(addr uint64, value uint64) error {
+	err := p.WasmInstance.PutUint64(addr, value)
+	if err == nil {
+		atomic.AddUint64(&p.bytesOut, 8)
+	}
+	return err
+}
+
+// profiledFunction times calls into a guest export. The bytes recorded for an
+// export include the memory traffic of the imports it called.
+type profiledFunction struct {
+	WasmFunction
+	name     string
+	instance *profiledInstance
+}
+
+func (f *profiledFunction) Call(args ...interface{}) (interface{}, error) {
+	defer f.instance.measure(f.name, CallKindExport)()
+	return f.WasmFunction.Call(args...)
+}
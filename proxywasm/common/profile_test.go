@@ -0,0 +1,70 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProfiledInstance(t *testing.T) {
+	raw := newMockInstance(1024)
+	profiler := NewProfiler()
+	instance := NewProfiledInstance(raw, "plugin", profiler)
+
+	// an import that reads 5 bytes and writes 4 bytes of guest memory
+	_ = instance.RegisterFunc("env", "proxy_log", func(instance WasmInstance, ptr int32, size int32) int32 {
+		_, _ = instance.GetMemory(uint64(ptr), uint64(size))
+		_ = instance.PutUint32(0, 1)
+		return 0
+	})
+
+	raw.exports["proxy_on_tick"] = mockFunction(func(args ...interface{}) (interface{}, error) {
+		raw.callImport("proxy_log", int32(16), int32(5))
+		return nil, nil
+	})
+
+	for i := 0; i < 2; i++ {
+		f, err := instance.GetExportsFunc("proxy_on_tick")
+		assert.Nil(t, err)
+		_, err = f.Call(int32(1))
+		assert.Nil(t, err)
+	}
+
+	stats := profiler.PluginStats("plugin")
+	assert.Equal(t, 2, len(stats))
+
+	assert.Equal(t, "proxy_log", stats[0].Name)
+	assert.Equal(t, CallKindImport, stats[0].Kind)
+	assert.Equal(t, uint64(2), stats[0].Calls)
+	assert.Equal(t, uint64(10), stats[0].BytesIn)
+	assert.Equal(t, uint64(8), stats[0].BytesOut)
+	assert.True(t, stats[0].MaxLatency <= stats[0].TotalLatency)
+
+	assert.Equal(t, "proxy_on_tick", stats[1].Name)
+	assert.Equal(t, CallKindExport, stats[1].Kind)
+	assert.Equal(t, uint64(2), stats[1].Calls)
+	assert.Equal(t, uint64(10), stats[1].BytesIn)
+	assert.Equal(t, uint64(8), stats[1].BytesOut)
+
+	assert.Empty(t, profiler.PluginStats("other"))
+
+	profiler.Reset()
+	assert.Empty(t, profiler.Stats())
+}
@@ -0,0 +1,270 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PropertyPathSeparator separates the segments of a property path, e.g.
+// "request\x00headers\x00user-agent".
+const PropertyPathSeparator = "\x00"
+
+var ErrPropertyType = errors.New("unsupported property type")
+
+// PropertyPath joins segments into a property path.
+func PropertyPath(segments ...string) string {
+	return strings.Join(segments, PropertyPathSeparator)
+}
+
+// SplitPropertyPath splits a property path into its segments.
+func SplitPropertyPath(path string) []string {
+	return strings.Split(path, PropertyPathSeparator)
+}
+
+// PropertyProvider resolves the properties under the path it is registered for.
+type PropertyProvider interface {
+	// GetProperty returns the value at path, relative to the registered path.
+	// path is empty for the registered path itself.
+	GetProperty(path []string) (interface{}, bool)
+}
+
+// PropertyProviderFunc is a func implementing PropertyProvider.
+type PropertyProviderFunc func(path []string) (interface{}, bool)
+
+func (f PropertyProviderFunc) GetProperty(path []string) (interface{}, bool) {
+	return f(path)
+}
+
+// PropertyStore holds the properties read by proxy_get_property and written
+// by proxy_set_property.
+//
+// A property value is one of string, []byte, bool, int64 (or another integer
+// type), float64, time.Time, time.Duration, map[string]string, HeaderMap and
+// map[string]interface{}, the maps being reachable segment by segment. Values
+// are looked up in the store, then in the providers registered for a prefix of
+// the path, the longest prefix first, and at last in the parent store. A store
+// per stream, whose parent is the store of the plugin, keeps the properties set
+// by the streams apart from each other.
+type PropertyStore struct {
+	parent *PropertyStore
+
+	lock      sync.RWMutex
+	values    map[string]interface{}
+	providers map[string]PropertyProvider
+}
+
+// NewPropertyStore returns an empty store, falling back to parent if it is not nil.
+func NewPropertyStore(parent *PropertyStore) *PropertyStore {
+	return &PropertyStore{
+		parent:    parent,
+		values:    make(map[string]interface{}),
+		providers: make(map[string]PropertyProvider),
+	}
+}
+
+// Parent returns the store this store falls back to.
+func (s *PropertyStore) Parent() *PropertyStore {
+	return s.parent
+}
+
+// Set sets the value at path.
+func (s *PropertyStore) Set(path string, value interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.values[path] = value
+}
+
+// Delete removes the value at path, the parent store is not changed.
+func (s *PropertyStore) Delete(path string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.values, path)
+}
+
+// RegisterProvider makes p resolve the properties under path, e.g. "request".
+func (s *PropertyStore) RegisterProvider(path string, p PropertyProvider) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.providers[path] = p
+}
+
+// Get returns the value at path.
+func (s *PropertyStore) Get(path string) (interface{}, bool) {
+	segments := SplitPropertyPath(path)
+
+	for store := s; store != nil; store = store.parent {
+		if v, ok := store.get(segments); ok {
+			return v, true
+		}
+	}
+
+	return nil, false
+}
+
+// GetBytes returns the serialized value at path, see EncodePropertyValue.
+func (s *PropertyStore) GetBytes(path string) ([]byte, bool, error) {
+	v, ok := s.Get(path)
+	if !ok {
+		return nil, false, nil
+	}
+
+	b, err := EncodePropertyValue(v)
+	if err != nil {
+		return nil, true, err
+	}
+
+	return b, true, nil
+}
+
+func (s *PropertyStore) get(segments []string) (interface{}, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	// the longest prefix holding a value or a provider wins
+	for i := len(segments); i > 0; i-- {
+		prefix := PropertyPath(segments[:i]...)
+
+		if v, ok := s.values[prefix]; ok {
+			if v, ok := lookupPropertyValue(v, segments[i:]); ok {
+				return v, true
+			}
+		}
+
+		if p, ok := s.providers[prefix]; ok {
+			if v, ok := p.GetProperty(segments[i:]); ok {
+				return v, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// lookupPropertyValue descends into the maps of v along path.
+func lookupPropertyValue(v interface{}, path []string) (interface{}, bool) {
+	for _, key := range path {
+		switch m := v.(type) {
+		case map[string]interface{}:
+			next, ok := m[key]
+			if !ok {
+				return nil, false
+			}
+			v = next
+		case map[string]string:
+			s, ok := m[key]
+			if !ok {
+				return nil, false
+			}
+			v = s
+		case HeaderMap:
+			s, ok := m.Get(key)
+			if !ok {
+				return nil, false
+			}
+			v = s
+		default:
+			return nil, false
+		}
+	}
+
+	return v, true
+}
+
+// EncodePropertyValue serializes a property value the way Envoy does:
+// strings and bytes as is, integers as 8 bytes little-endian int64, floats as
+// 8 bytes IEEE 754, bools as one byte, timestamps and durations as int64
+// nanoseconds, and maps in the pairs encoding of
+// EncodeMap with serialized values.
+func EncodePropertyValue(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case string:
+		return []byte(v), nil
+	case []byte:
+		return v, nil
+	case bool:
+		if v {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case int:
+		return encodeInt64(int64(v)), nil
+	case int32:
+		return encodeInt64(int64(v)), nil
+	case int64:
+		return encodeInt64(v), nil
+	case uint32:
+		return encodeInt64(int64(v)), nil
+	case uint64:
+		return encodeInt64(int64(v)), nil
+	case time.Time:
+		return encodeInt64(v.UnixNano()), nil
+	case time.Duration:
+		return encodeInt64(int64(v)), nil
+	case float64:
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, math.Float64bits(v))
+		return b, nil
+	case map[string]string:
+		return encodePropertyMap(NewCommonHeaderFromMap(v)), nil
+	case HeaderMap:
+		return encodePropertyMap(v), nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		m := NewCommonHeader()
+		for _, k := range keys {
+			b, err := EncodePropertyValue(v[k])
+			if err != nil {
+				return nil, err
+			}
+			m.Add(k, string(b))
+		}
+		return encodePropertyMap(m), nil
+	}
+
+	return nil, fmt.Errorf("%w: %T", ErrPropertyType, v)
+}
+
+func encodeInt64(v int64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(v))
+	return b
+}
+
+// encodePropertyMap encodes m in the pairs encoding, an empty map included.
+func encodePropertyMap(m HeaderMap) []byte {
+	n, size := mapByteSize(m)
+	b := make([]byte, size)
+	size = encodeMapInto(b, m, n)
+	return b[:size]
+}
@@ -0,0 +1,109 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package common
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPropertyStore(t *testing.T) {
+	plugin := NewPropertyStore(nil)
+	plugin.Set(PropertyPath("plugin_name"), "my-plugin")
+	plugin.Set(PropertyPath("node"), map[string]interface{}{
+		"id":       "node-1",
+		"metadata": map[string]string{"zone": "a"},
+	})
+	plugin.RegisterProvider("request", PropertyProviderFunc(func(path []string) (interface{}, bool) {
+		if len(path) == 1 && path[0] == "method" {
+			return "GET", true
+		}
+		return nil, false
+	}))
+
+	stream := NewPropertyStore(plugin)
+	stream.RegisterProvider(PropertyPath("request", "headers"), PropertyProviderFunc(func(path []string) (interface{}, bool) {
+		headers := map[string]string{"user-agent": "curl"}
+		if len(path) == 0 {
+			return headers, true
+		}
+		v, ok := headers[path[0]]
+		return v, ok && len(path) == 1
+	}))
+	stream.Set(PropertyPath("filter_state", "key"), []byte("value"))
+
+	for path, expected := range map[string]interface{}{
+		PropertyPath("plugin_name"):                          "my-plugin",
+		PropertyPath("node", "id"):                           "node-1",
+		PropertyPath("node", "metadata", "zone"):             "a",
+		PropertyPath("request", "method"):                    "GET",
+		PropertyPath("request", "headers", "user-agent"):     "curl",
+		PropertyPath("request", "headers"):                   map[string]string{"user-agent": "curl"},
+		PropertyPath("filter_state", "key"):                  []byte("value"),
+		PropertyPath("node", "metadata"):                     map[string]string{"zone": "a"},
+		PropertyPath("request", "headers", "x-missing", "a"): nil,
+		PropertyPath("request", "path"):                      nil,
+		PropertyPath("missing"):                              nil,
+	} {
+		v, ok := stream.Get(path)
+		assert.Equal(t, expected != nil, ok, "%q", path)
+		assert.Equal(t, expected, v, "%q", path)
+	}
+
+	// the properties of a stream are not visible from the plugin or other streams
+	_, ok := plugin.Get(PropertyPath("filter_state", "key"))
+	assert.False(t, ok)
+	_, ok = NewPropertyStore(plugin).Get(PropertyPath("filter_state", "key"))
+	assert.False(t, ok)
+
+	stream.Delete(PropertyPath("filter_state", "key"))
+	_, ok = stream.Get(PropertyPath("filter_state", "key"))
+	assert.False(t, ok)
+}
+
+func TestEncodePropertyValue(t *testing.T) {
+	for _, c := range []struct {
+		value    interface{}
+		expected []byte
+	}{
+		{"str", []byte("str")},
+		{[]byte{0, 1}, []byte{0, 1}},
+		{true, []byte{1}},
+		{false, []byte{0}},
+		{int64(-2), []byte{0xfe, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{uint32(258), []byte{2, 1, 0, 0, 0, 0, 0, 0}},
+		{1.0, []byte{0, 0, 0, 0, 0, 0, 0xf0, 0x3f}},
+		{map[string]string{}, []byte{0, 0, 0, 0}},
+		{map[string]interface{}{"a": true}, []byte{1, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 'a', 0, 1, 0}},
+	} {
+		b, err := EncodePropertyValue(c.value)
+		assert.Nil(t, err)
+		assert.Equal(t, c.expected, b, "%v", c.value)
+	}
+
+	_, err := EncodePropertyValue(struct{}{})
+	assert.True(t, errors.Is(err, ErrPropertyType))
+
+	store := NewPropertyStore(nil)
+	store.Set("invalid", struct{}{})
+	_, ok, err := store.GetBytes("invalid")
+	assert.True(t, ok)
+	assert.NotNil(t, err)
+}
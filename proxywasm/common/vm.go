@@ -49,6 +49,10 @@ type WasmInstance interface {
 	// Stop stops the wasm instance
 	Stop()
 
+	// OnStop registers f to be called once the wasm instance has been
+	// stopped, right away if it already has
+	OnStop(f func())
+
 	// RegisterFunc registers a func to the wasm instance, should be called before Start()
 	RegisterFunc(namespace string, funcName string, f interface{}) error
 
@@ -76,6 +80,12 @@ type WasmInstance interface {
 	// PutUint32 set uint32 to specified addr
 	PutUint32(addr uint64, value uint32) error
 
+	// GetUint64 returns uint64 from specified addr
+	GetUint64(addr uint64) (uint64, error)
+
+	// PutUint64 set uint64 to specified addr
+	PutUint64(addr uint64, value uint64) error
+
 	// Malloc allocates size of mem from wasm default memory
 	Malloc(size int32) (uint64, error)
 
@@ -0,0 +1,185 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var _ http.Handler = &Registry{}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = r.WritePrometheus(w)
+}
+
+// WritePrometheus writes the metrics in the Prometheus text format, named
+// <namespace>_<tag name> with the invalid characters replaced by '_' and
+// labeled with their tags. The metrics whose names only differ by these
+// characters are written as one family. A metric whose type conflicts with
+// its family is written in the family <name>_<type> instead, e.g.
+// plugin_requests_gauge.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	for _, f := range prometheusFamilies(r.Metrics()) {
+		bw.WriteString("# TYPE " + f.name + " " + f.typ.String() + "\n")
+
+		for _, m := range f.metrics {
+			writePrometheusMetric(bw, f.name, m)
+		}
+	}
+
+	return bw.Flush()
+}
+
+func writePrometheusMetric(bw *bufio.Writer, name string, m *Metric) {
+	labels := formatTags(m.tags)
+
+	if m.typ != Histogram {
+		v, _ := m.Value()
+		bw.WriteString(name + labels + " " + strconv.FormatInt(v, 10) + "\n")
+		return
+	}
+
+	h, _ := m.Histogram()
+	for i, bound := range h.Bounds {
+		le := formatTags(m.tags, Tag{Name: "le", Value: formatBound(bound)})
+		bw.WriteString(name + "_bucket" + le + " " + strconv.FormatUint(h.Counts[i], 10) + "\n")
+	}
+	le := formatTags(m.tags, Tag{Name: "le", Value: "+Inf"})
+	bw.WriteString(name + "_bucket" + le + " " + strconv.FormatUint(h.Count, 10) + "\n")
+	bw.WriteString(name + "_sum" + labels + " " + strconv.FormatInt(h.Sum, 10) + "\n")
+	bw.WriteString(name + "_count" + labels + " " + strconv.FormatUint(h.Count, 10) + "\n")
+}
+
+// prometheusFamily is the metrics written under one Prometheus name.
+type prometheusFamily struct {
+	name    string
+	typ     Type
+	metrics []*Metric
+}
+
+// prometheusFamilies groups metrics, sorted as by Registry.Metrics, by
+// Prometheus name, and returns the families sorted by name along with their
+// series sorted by labels. The type of a family is the one of its first
+// metric, a series repeating the labels of another one is dropped.
+func prometheusFamilies(metrics []*Metric) []*prometheusFamily {
+	families := make(map[string]*prometheusFamily)
+
+	for _, m := range metrics {
+		name := prometheusName(m.namespace + "_" + m.tagName)
+		if f, ok := families[name]; ok && f.typ != m.typ {
+			name += "_" + m.typ.String()
+		}
+
+		f, ok := families[name]
+		if !ok {
+			f = &prometheusFamily{name: name, typ: m.typ}
+			families[name] = f
+		}
+		// the renamed family is taken by another type too
+		if f.typ != m.typ {
+			continue
+		}
+		f.metrics = append(f.metrics, m)
+	}
+
+	sorted := make([]*prometheusFamily, 0, len(families))
+	for _, f := range families {
+		sort.SliceStable(f.metrics, func(i, j int) bool {
+			return formatTags(f.metrics[i].tags) < formatTags(f.metrics[j].tags)
+		})
+
+		var metrics []*Metric
+		for _, m := range f.metrics {
+			if len(metrics) == 0 || formatTags(m.tags) != formatTags(metrics[len(metrics)-1].tags) {
+				metrics = append(metrics, m)
+			}
+		}
+		f.metrics = metrics
+
+		sorted = append(sorted, f)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].name < sorted[j].name })
+
+	return sorted
+}
+
+// String returns the metrics as a JSON object, so that the registry can be
+// published with expvar.Publish. The keys are <namespace>.<name>, the names
+// being the ones defined by the plugins, tags included, and the histograms
+// are objects holding their count, sum and cumulative buckets.
+func (r *Registry) String() string {
+	vars := make(map[string]interface{})
+
+	for _, m := range r.Metrics() {
+		key := m.namespace + "." + m.name
+
+		if m.typ != Histogram {
+			vars[key], _ = m.Value()
+			continue
+		}
+
+		h, _ := m.Histogram()
+		buckets := make(map[string]uint64, len(h.Bounds))
+		for i, bound := range h.Bounds {
+			buckets[formatBound(bound)] = h.Counts[i]
+		}
+		vars[key] = map[string]interface{}{
+			"count":   h.Count,
+			"sum":     h.Sum,
+			"buckets": buckets,
+		}
+	}
+
+	b, _ := json.Marshal(vars)
+	return string(b)
+}
+
+func formatBound(bound float64) string {
+	if math.IsInf(bound, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(bound, 'g', -1, 64)
+}
+
+// prometheusName replaces the characters not allowed in a metric name by '_'.
+func prometheusName(name string) string {
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == ':':
+			return r
+		case r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
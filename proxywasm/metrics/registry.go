@@ -0,0 +1,287 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package metrics implements the metrics defined by plugins through the
+// proxy-wasm metric imports, and exports them in the Prometheus text format
+// and through expvar.
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrNotFound     = errors.New("metric not found")
+	ErrType         = errors.New("operation not supported by the metric type")
+	ErrInvalidValue = errors.New("invalid metric value")
+)
+
+// Type is the type of a metric.
+type Type int
+
+const (
+	Counter Type = iota
+	Gauge
+	Histogram
+)
+
+func (t Type) String() string {
+	switch t {
+	case Counter:
+		return "counter"
+	case Gauge:
+		return "gauge"
+	case Histogram:
+		return "histogram"
+	}
+	return fmt.Sprintf("Type(%d)", int(t))
+}
+
+// DefaultBuckets are the upper bounds of the buckets of the histograms,
+// the same as the default of Envoy, e.g. for durations in milliseconds.
+var DefaultBuckets = []float64{
+	0.5, 1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000, 60000, 300000, 600000, 1800000, 3600000,
+}
+
+type metricKey struct {
+	namespace string
+	name      string
+}
+
+// Registry holds the metrics of the plugins, each plugin having its own
+// namespace. A metric defined by several instances of a plugin, i.e. by
+// several scopes of the same namespace, is shared by them and is removed
+// once all of them removed it.
+type Registry struct {
+	lock     sync.RWMutex
+	metrics  map[metricKey]*Metric
+	buckets  map[metricKey][]float64
+	tagRules []TagRule
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: make(map[metricKey]*Metric),
+		buckets: make(map[metricKey][]float64),
+	}
+}
+
+// SetBuckets sets the upper bounds of the buckets of the histogram name of
+// namespace, instead of DefaultBuckets. It applies to the histograms defined
+// afterwards.
+func (r *Registry) SetBuckets(namespace string, name string, buckets []float64) {
+	bounds := append([]float64(nil), buckets...)
+	sort.Float64s(bounds)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.buckets[metricKey{namespace, name}] = bounds
+}
+
+// Metrics returns the metrics of all the namespaces, sorted by namespace, tag
+// name and tags, i.e. the series of a metric next to each other.
+func (r *Registry) Metrics() []*Metric {
+	r.lock.RLock()
+	metrics := make([]*Metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		metrics = append(metrics, m)
+	}
+	r.lock.RUnlock()
+
+	sort.Slice(metrics, func(i, j int) bool {
+		a, b := metrics[i], metrics[j]
+		if a.namespace != b.namespace {
+			return a.namespace < b.namespace
+		}
+		if a.tagName != b.tagName {
+			return a.tagName < b.tagName
+		}
+		return formatTags(a.tags) < formatTags(b.tags)
+	})
+
+	return metrics
+}
+
+// acquire returns the metric name of namespace, defining it if needed.
+func (r *Registry) acquire(namespace string, t Type, name string) (*Metric, error) {
+	key := metricKey{namespace, name}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if m, ok := r.metrics[key]; ok {
+		if m.typ != t {
+			return nil, fmt.Errorf("%w: %s is a %s", ErrType, name, m.typ)
+		}
+		m.refs++
+		return m, nil
+	}
+
+	m := &Metric{namespace: namespace, name: name, typ: t, refs: 1}
+	m.tagName, m.tags = extractTags(r.tagRules, name)
+	if t == Histogram {
+		bounds, ok := r.buckets[key]
+		if !ok {
+			bounds = DefaultBuckets
+		}
+		m.histogram = &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+	}
+	r.metrics[key] = m
+
+	return m, nil
+}
+
+func (r *Registry) release(m *Metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	m.refs--
+	if m.refs == 0 {
+		delete(r.metrics, metricKey{m.namespace, m.name})
+	}
+}
+
+// Metric is a counter, a gauge or a histogram.
+type Metric struct {
+	value int64 // first for the 64-bit alignment of atomic operations
+
+	namespace string
+	name      string
+	typ       Type
+	refs      int // guarded by the lock of the registry
+	histogram *histogram
+
+	tagName string
+	tags    []Tag
+}
+
+type histogram struct {
+	lock   sync.Mutex
+	bounds []float64
+	counts []uint64 // the last one counting the values above all the bounds
+	sum    int64
+	count  uint64
+}
+
+// HistogramSnapshot is the state of a histogram.
+type HistogramSnapshot struct {
+	// Bounds are the upper bounds of the buckets.
+	Bounds []float64
+	// Counts are the cumulative counts of the buckets, one per bound.
+	Counts []uint64
+	Sum    int64
+	Count  uint64
+}
+
+func (m *Metric) Namespace() string { return m.namespace }
+
+func (m *Metric) Name() string { return m.name }
+
+func (m *Metric) Type() Type { return m.typ }
+
+// TagName returns the name without the tags extracted by the tag rules.
+func (m *Metric) TagName() string { return m.tagName }
+
+// Tags returns the tags extracted from the name by the tag rules.
+func (m *Metric) Tags() []Tag { return m.tags }
+
+// Value returns the value of a counter or a gauge.
+func (m *Metric) Value() (int64, error) {
+	if m.typ == Histogram {
+		return 0, ErrType
+	}
+	return atomic.LoadInt64(&m.value), nil
+}
+
+// Add adds delta to a counter or a gauge, a counter only increases.
+func (m *Metric) Add(delta int64) error {
+	switch m.typ {
+	case Counter:
+		if delta < 0 {
+			return ErrInvalidValue
+		}
+	case Histogram:
+		return ErrType
+	}
+
+	atomic.AddInt64(&m.value, delta)
+	return nil
+}
+
+// Record sets the value of a gauge or adds value to a histogram. A counter
+// may be set to a value not lower than its current value.
+func (m *Metric) Record(value int64) error {
+	switch m.typ {
+	case Counter:
+		for {
+			old := atomic.LoadInt64(&m.value)
+			if value < old {
+				return ErrInvalidValue
+			}
+			if atomic.CompareAndSwapInt64(&m.value, old, value) {
+				return nil
+			}
+		}
+	case Gauge:
+		atomic.StoreInt64(&m.value, value)
+		return nil
+	}
+
+	h := m.histogram
+	i := sort.SearchFloat64s(h.bounds, float64(value))
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.counts[i]++
+	h.sum += value
+	h.count++
+
+	return nil
+}
+
+// Histogram returns the state of a histogram.
+func (m *Metric) Histogram() (HistogramSnapshot, error) {
+	if m.typ != Histogram {
+		return HistogramSnapshot{}, ErrType
+	}
+
+	h := m.histogram
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s := HistogramSnapshot{
+		Bounds: h.bounds,
+		Counts: make([]uint64, len(h.bounds)),
+		Sum:    h.sum,
+		Count:  h.count,
+	}
+
+	var n uint64
+	for i := range h.bounds {
+		n += h.counts[i]
+		s.Counts[i] = n
+	}
+
+	return s, nil
+}
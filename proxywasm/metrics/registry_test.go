@@ -0,0 +1,219 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScopesMerge(t *testing.T) {
+	r := NewRegistry()
+	s1 := r.NewScope("plugin")
+	s2 := r.NewScope("plugin")
+	other := r.NewScope("other")
+
+	id1, err := s1.Define(Counter, "requests")
+	assert.Nil(t, err)
+	id2, err := s2.Define(Counter, "requests")
+	assert.Nil(t, err)
+	_, err = other.Define(Counter, "requests")
+	assert.Nil(t, err)
+
+	again, err := s1.Define(Counter, "requests")
+	assert.Nil(t, err)
+	assert.Equal(t, id1, again)
+
+	_, err = s2.Define(Gauge, "requests")
+	assert.True(t, errors.Is(err, ErrType))
+
+	assert.Nil(t, s1.Increment(id1, 2))
+	assert.Nil(t, s2.Increment(id2, 3))
+	assert.True(t, errors.Is(s1.Increment(id1, -1), ErrInvalidValue))
+
+	v, err := s2.Get(id2)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), v)
+	assert.Len(t, r.Metrics(), 2)
+
+	// the metric is kept until both instances removed it
+	assert.Nil(t, s1.Remove(id1))
+	assert.True(t, errors.Is(s1.Remove(id1), ErrNotFound))
+	v, _ = s2.Get(id2)
+	assert.Equal(t, int64(5), v)
+
+	s2.Close()
+	assert.Len(t, r.Metrics(), 1)
+
+	_, err = s2.Get(id2)
+	assert.True(t, errors.Is(err, ErrNotFound))
+}
+
+func TestGaugeAndHistogram(t *testing.T) {
+	r := NewRegistry()
+	r.SetBuckets("plugin", "latency", []float64{100, 10})
+	s := r.NewScope("plugin")
+
+	gauge, _ := s.Define(Gauge, "active")
+	assert.Nil(t, s.Record(gauge, 7))
+	assert.Nil(t, s.Increment(gauge, -2))
+	v, _ := s.Get(gauge)
+	assert.Equal(t, int64(5), v)
+
+	latency, _ := s.Define(Histogram, "latency")
+	for _, v := range []int64{1, 10, 50, 1000} {
+		assert.Nil(t, s.Record(latency, v))
+	}
+	_, err := s.Get(latency)
+	assert.True(t, errors.Is(err, ErrType))
+	assert.True(t, errors.Is(s.Increment(latency, 1), ErrType))
+
+	m, _ := s.Metric(latency)
+	h, err := m.Histogram()
+	assert.Nil(t, err)
+	assert.Equal(t, HistogramSnapshot{Bounds: []float64{10, 100}, Counts: []uint64{2, 3}, Sum: 1061, Count: 4}, h)
+
+	counter, _ := s.Define(Counter, "total")
+	assert.Nil(t, s.Record(counter, 3))
+	assert.True(t, errors.Is(s.Record(counter, 2), ErrInvalidValue))
+}
+
+func TestExport(t *testing.T) {
+	r := NewRegistry()
+	r.SetBuckets("my-plugin", "latency", []float64{10})
+	s := r.NewScope("my-plugin")
+
+	requests, _ := s.Define(Counter, "requests.total")
+	_ = s.Increment(requests, 3)
+	latency, _ := s.Define(Histogram, "latency")
+	_ = s.Record(latency, 5)
+	_ = s.Record(latency, 20)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, `# TYPE my_plugin_latency histogram
+my_plugin_latency_bucket{le="10"} 1
+my_plugin_latency_bucket{le="+Inf"} 2
+my_plugin_latency_sum 25
+my_plugin_latency_count 2
+# TYPE my_plugin_requests_total counter
+my_plugin_requests_total 3
+`, w.Body.String())
+
+	var vars map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(r.String()), &vars))
+	assert.Equal(t, map[string]interface{}{
+		"my-plugin.requests.total": 3.0,
+		"my-plugin.latency": map[string]interface{}{
+			"count":   2.0,
+			"sum":     25.0,
+			"buckets": map[string]interface{}{"10": 1.0},
+		},
+	}, vars)
+}
+
+func TestTagExtraction(t *testing.T) {
+	_, err := NewTagRule("method", `\.method\.[^.]+`)
+	assert.NotNil(t, err)
+
+	r := NewRegistry()
+	for _, rule := range [][2]string{
+		{"method", `(\.method\.([^.]+))`},
+		{"status", `(\.status\.([0-9]+))`},
+	} {
+		tag, err := NewTagRule(rule[0], rule[1])
+		assert.Nil(t, err)
+		r.AddTagRule(tag)
+	}
+	s := r.NewScope("plugin")
+
+	for name, v := range map[string]int64{
+		"requests.method.POST.status.500": 1,
+		"requests.method.GET.status.200":  2,
+		"requests":                        3,
+	} {
+		id, err := s.Define(Counter, name)
+		assert.Nil(t, err)
+		_ = s.Increment(id, v)
+	}
+
+	id, _ := s.Define(Counter, "requests.method.GET.status.200")
+	m, _ := s.Metric(id)
+	assert.Equal(t, "requests", m.TagName())
+	assert.Equal(t, []Tag{{"method", "GET"}, {"status", "200"}}, m.Tags())
+
+	var b strings.Builder
+	assert.Nil(t, r.WritePrometheus(&b))
+	assert.Equal(t, `# TYPE plugin_requests counter
+plugin_requests 3
+plugin_requests{method="GET",status="200"} 2
+plugin_requests{method="POST",status="500"} 1
+`, b.String())
+
+	// the tagged series of another type join the renamed family
+	id, err = s.Define(Gauge, "requests.method.PUT")
+	assert.Nil(t, err)
+	_ = s.Record(id, 4)
+
+	b.Reset()
+	assert.Nil(t, r.WritePrometheus(&b))
+	assert.Equal(t, `# TYPE plugin_requests counter
+plugin_requests 3
+plugin_requests{method="GET",status="200"} 2
+plugin_requests{method="POST",status="500"} 1
+# TYPE plugin_requests_gauge gauge
+plugin_requests_gauge{method="PUT"} 4
+`, b.String())
+}
+
+func TestPrometheusFamilies(t *testing.T) {
+	r := NewRegistry()
+	s := r.NewScope("plugin")
+
+	for name, typ := range map[string]Type{
+		"a.b": Counter,
+		"a_a": Counter,
+		"a_b": Counter,
+		"x-y": Gauge,
+		"x.y": Counter,
+	} {
+		id, err := s.Define(typ, name)
+		assert.Nil(t, err)
+		_ = s.Increment(id, 1)
+	}
+
+	// one TYPE line per family, the conflicting type being renamed
+	var b strings.Builder
+	assert.Nil(t, r.WritePrometheus(&b))
+	assert.Equal(t, `# TYPE plugin_a_a counter
+plugin_a_a 1
+# TYPE plugin_a_b counter
+plugin_a_b 1
+# TYPE plugin_x_y gauge
+plugin_x_y 1
+# TYPE plugin_x_y_counter counter
+plugin_x_y_counter 1
+`, b.String())
+}
@@ -0,0 +1,138 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"sync"
+)
+
+// Scope is the view of a plugin instance on the metrics of its namespace,
+// giving ids to the metrics it defines, as expected by the metric imports.
+type Scope struct {
+	registry  *Registry
+	namespace string
+
+	lock    sync.Mutex
+	nextID  uint32
+	metrics map[uint32]*Metric
+	ids     map[string]uint32
+}
+
+// NewScope returns a scope for an instance of the plugin namespace.
+func (r *Registry) NewScope(namespace string) *Scope {
+	return &Scope{
+		registry:  r,
+		namespace: namespace,
+		metrics:   make(map[uint32]*Metric),
+		ids:       make(map[string]uint32),
+	}
+}
+
+// Define defines the metric name, returning the id of the existing metric
+// if the scope already defined it.
+func (s *Scope) Define(t Type, name string) (uint32, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if id, ok := s.ids[name]; ok {
+		if s.metrics[id].typ != t {
+			return 0, ErrType
+		}
+		return id, nil
+	}
+
+	m, err := s.registry.acquire(s.namespace, t, name)
+	if err != nil {
+		return 0, err
+	}
+
+	s.nextID++
+	s.metrics[s.nextID] = m
+	s.ids[name] = s.nextID
+
+	return s.nextID, nil
+}
+
+// Metric returns the metric id.
+func (s *Scope) Metric(id uint32) (*Metric, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	m, ok := s.metrics[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return m, nil
+}
+
+// Increment adds offset to the counter or gauge id.
+func (s *Scope) Increment(id uint32, offset int64) error {
+	m, err := s.Metric(id)
+	if err != nil {
+		return err
+	}
+	return m.Add(offset)
+}
+
+// Record records value into the metric id, see Metric.Record.
+func (s *Scope) Record(id uint32, value int64) error {
+	m, err := s.Metric(id)
+	if err != nil {
+		return err
+	}
+	return m.Record(value)
+}
+
+// Get returns the value of the counter or gauge id.
+func (s *Scope) Get(id uint32) (int64, error) {
+	m, err := s.Metric(id)
+	if err != nil {
+		return 0, err
+	}
+	return m.Value()
+}
+
+// Remove removes the metric id from the scope, and from the registry if no
+// other scope defined it.
+func (s *Scope) Remove(id uint32) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	m, ok := s.metrics[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	delete(s.metrics, id)
+	delete(s.ids, m.name)
+	s.registry.release(m)
+
+	return nil
+}
+
+// Close removes all the metrics of the scope, e.g. when the instance is stopped.
+func (s *Scope) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for id, m := range s.metrics {
+		delete(s.metrics, id)
+		delete(s.ids, m.name)
+		s.registry.release(m)
+	}
+}
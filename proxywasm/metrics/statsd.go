@@ -0,0 +1,314 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatsdFormat is the line format of a StatsdExporter.
+type StatsdFormat int
+
+const (
+	// StatsD writes the names as defined by the plugins, tags included.
+	StatsD StatsdFormat = iota
+	// DogStatsD writes the names without the tags, and the tags in the
+	// DogStatsD extension, e.g. "requests:1|c|#method:GET".
+	DogStatsD
+)
+
+// DefaultMaxPacketSize fits a UDP packet into an Ethernet MTU.
+const DefaultMaxPacketSize = 1432
+
+// StatsdExporter pushes the metrics of a registry over UDP in the StatsD or
+// DogStatsD format.
+//
+// Counters are pushed as the increments since the previous flush, and gauges
+// as their values. Histograms only keep the counts of their buckets, so each
+// bucket which got values since the previous flush is pushed as its upper
+// bound, with a sample rate telling the number of values, e.g.
+// "latency:100|ms|@0.25" for 4 values in the bucket of 100. The values above
+// the last bound are pushed as the last bound.
+//
+// The lines are batched into packets of at most MaxPacketSize bytes. Packets
+// which can't be sent, e.g. while the collector is unreachable, are dropped,
+// the increments they held being pushed again by the next flush.
+type StatsdExporter struct {
+	// MaxPacketSize is the maximum size of the packets, DefaultMaxPacketSize if 0.
+	MaxPacketSize int
+
+	registry *Registry
+	addr     string
+	format   StatsdFormat
+
+	lock     sync.Mutex
+	conn     net.Conn
+	counters map[*Metric]int64
+	buckets  map[*Metric][]uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewStatsdExporter(registry *Registry, addr string, format StatsdFormat) *StatsdExporter {
+	return &StatsdExporter{
+		registry: registry,
+		addr:     addr,
+		format:   format,
+		counters: make(map[*Metric]int64),
+		buckets:  make(map[*Metric][]uint64),
+	}
+}
+
+// Start flushes the metrics every interval until Stop is called. It does
+// nothing if the flushes are already started.
+func (e *StatsdExporter) Start(interval time.Duration) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.stop != nil {
+		return
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	e.stop, e.done = stop, done
+
+	go func() {
+		defer close(done)
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				_ = e.Flush()
+			case <-stop:
+				_ = e.Flush()
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the flushes started by Start after a last one, and closes the connection.
+func (e *StatsdExporter) Stop() {
+	e.lock.Lock()
+	stop, done := e.stop, e.done
+	e.stop, e.done = nil, nil
+	e.lock.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if e.conn != nil {
+		_ = e.conn.Close()
+		e.conn = nil
+	}
+}
+
+// statsdUpdate is the state of a metric once its lines have been pushed.
+type statsdUpdate struct {
+	commit func()
+	failed bool
+}
+
+// Flush pushes the metrics, it returns the first error met while sending.
+// The metrics whose lines could not all be sent are pushed again, since the
+// same previous flush, by the next one.
+func (e *StatsdExporter) Flush() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	max := e.MaxPacketSize
+	if max <= 0 {
+		max = DefaultMaxPacketSize
+	}
+
+	var err error
+	var packet bytes.Buffer
+	var inPacket []*statsdUpdate
+
+	send := func() {
+		if packet.Len() == 0 {
+			return
+		}
+		if sendErr := e.send(packet.Bytes()); sendErr != nil {
+			if err == nil {
+				err = sendErr
+			}
+			for _, u := range inPacket {
+				u.failed = true
+			}
+		}
+		packet.Reset()
+		inPacket = inPacket[:0]
+	}
+
+	seen := make(map[*Metric]bool)
+	var updates []*statsdUpdate
+	for _, m := range e.registry.Metrics() {
+		seen[m] = true
+
+		lines, commit := e.lines(m)
+		u := &statsdUpdate{commit: commit}
+		updates = append(updates, u)
+
+		for _, line := range lines {
+			if packet.Len() > 0 && packet.Len()+1+len(line) > max {
+				send()
+			}
+			if packet.Len() > 0 {
+				packet.WriteByte('\n')
+			}
+			packet.WriteString(line)
+			if len(inPacket) == 0 || inPacket[len(inPacket)-1] != u {
+				inPacket = append(inPacket, u)
+			}
+		}
+	}
+	send()
+
+	for _, u := range updates {
+		if !u.failed {
+			u.commit()
+		}
+	}
+
+	// forget the removed metrics
+	for m := range e.counters {
+		if !seen[m] {
+			delete(e.counters, m)
+		}
+	}
+	for m := range e.buckets {
+		if !seen[m] {
+			delete(e.buckets, m)
+		}
+	}
+
+	return err
+}
+
+// lines returns the lines to push for m since the previous flush, and the
+// func saving the state of m once they have been sent.
+func (e *StatsdExporter) lines(m *Metric) ([]string, func()) {
+	name, tags := m.namespace+"."+m.name, ""
+	if e.format == DogStatsD {
+		name = m.namespace + "." + m.tagName
+		tags = dogStatsdTags(m.tags)
+	}
+	name = statsdEscaper.Replace(name)
+
+	switch m.typ {
+	case Counter:
+		v, _ := m.Value()
+		delta := v - e.counters[m]
+		commit := func() { e.counters[m] = v }
+		if delta == 0 {
+			return nil, commit
+		}
+		return []string{name + ":" + strconv.FormatInt(delta, 10) + "|c" + tags}, commit
+	case Gauge:
+		v, _ := m.Value()
+		return []string{name + ":" + strconv.FormatInt(v, 10) + "|g" + tags}, func() {}
+	}
+
+	h, _ := m.Histogram()
+	if len(h.Bounds) == 0 {
+		return nil, func() {}
+	}
+
+	kind := "|ms"
+	if e.format == DogStatsD {
+		kind = "|h"
+	}
+
+	// the cumulative counts, the last one being the total count
+	counts := append(h.Counts[:len(h.Counts):len(h.Counts)], h.Count)
+	last, ok := e.buckets[m]
+	if !ok {
+		last = make([]uint64, len(counts))
+	}
+	commit := func() { e.buckets[m] = counts }
+
+	var lines []string
+	for i := range counts {
+		n := counts[i] - last[i]
+		if i > 0 {
+			n -= counts[i-1] - last[i-1]
+		}
+		if n == 0 {
+			continue
+		}
+
+		bound := h.Bounds[len(h.Bounds)-1]
+		if i < len(h.Bounds) {
+			bound = h.Bounds[i]
+		}
+
+		line := name + ":" + strconv.FormatFloat(bound, 'g', -1, 64) + kind
+		if n > 1 {
+			line += "|@" + strconv.FormatFloat(1/float64(n), 'g', -1, 64)
+		}
+		lines = append(lines, line+tags)
+	}
+
+	return lines, commit
+}
+
+func (e *StatsdExporter) send(packet []byte) error {
+	if e.conn == nil {
+		conn, err := net.Dial("udp", e.addr)
+		if err != nil {
+			return err
+		}
+		e.conn = conn
+	}
+
+	_, err := e.conn.Write(packet)
+	return err
+}
+
+var statsdEscaper = strings.NewReplacer(":", "_", "|", "_", "@", "_", "\n", "_")
+
+var dogStatsdTagEscaper = strings.NewReplacer(":", "_", "|", "_", "@", "_", ",", "_", "#", "_", "\n", "_")
+
+// dogStatsdValueEscaper keeps the colons, the value being after the first one.
+var dogStatsdValueEscaper = strings.NewReplacer("|", "_", "@", "_", ",", "_", "#", "_", "\n", "_")
+
+func dogStatsdTags(tags []Tag) string {
+	if len(tags) == 0 {
+		return ""
+	}
+
+	s := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		s = append(s, dogStatsdTagEscaper.Replace(tag.Name)+":"+dogStatsdValueEscaper.Replace(tag.Value))
+	}
+	return "|#" + strings.Join(s, ",")
+}
@@ -0,0 +1,181 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// receive returns the lines of the packets received until timeout, and the number of packets.
+func receive(t *testing.T, conn net.PacketConn) ([]string, int) {
+	var lines []string
+	packets := 0
+
+	buf := make([]byte, 65536)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		packets++
+		lines = append(lines, strings.Split(string(buf[:n]), "\n")...)
+	}
+
+	sort.Strings(lines)
+	return lines, packets
+}
+
+func TestStatsdExporter(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	r := NewRegistry()
+	rule, _ := NewTagRule("method", `(\.method\.([^.]+))`)
+	r.AddTagRule(rule)
+	r.SetBuckets("plugin", "latency", []float64{10, 100})
+	s := r.NewScope("plugin")
+
+	requests, _ := s.Define(Counter, "requests.method.GET")
+	active, _ := s.Define(Gauge, "active")
+	latency, _ := s.Define(Histogram, "latency")
+
+	_ = s.Increment(requests, 3)
+	_ = s.Record(active, 2)
+	for _, v := range []int64{5, 50, 60, 500} {
+		_ = s.Record(latency, v)
+	}
+
+	e := NewStatsdExporter(r, conn.LocalAddr().String(), DogStatsD)
+	defer e.Stop()
+
+	assert.Nil(t, e.Flush())
+	lines, _ := receive(t, conn)
+	assert.Equal(t, []string{
+		"plugin.active:2|g",
+		"plugin.latency:100|h",
+		"plugin.latency:100|h|@0.5",
+		"plugin.latency:10|h",
+		"plugin.requests:3|c|#method:GET",
+	}, lines)
+
+	// only the increments since the previous flush are pushed
+	_ = s.Increment(requests, 1)
+	assert.Nil(t, e.Flush())
+	lines, _ = receive(t, conn)
+	assert.Equal(t, []string{"plugin.active:2|g", "plugin.requests:1|c|#method:GET"}, lines)
+}
+
+func TestStatsdExporterBatching(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	r := NewRegistry()
+	s := r.NewScope("plugin")
+	for _, name := range []string{"a", "b", "c", "d"} {
+		id, _ := s.Define(Gauge, name)
+		_ = s.Record(id, 1)
+	}
+
+	e := NewStatsdExporter(r, conn.LocalAddr().String(), StatsD)
+	e.MaxPacketSize = 30 // two lines of 12 bytes per packet
+	defer e.Stop()
+
+	assert.Nil(t, e.Flush())
+	lines, packets := receive(t, conn)
+	assert.Equal(t, []string{"plugin.a:1|g", "plugin.b:1|g", "plugin.c:1|g", "plugin.d:1|g"}, lines)
+	assert.Equal(t, 2, packets)
+}
+
+func TestStatsdExporterUnreachable(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := conn.LocalAddr().String()
+	_ = conn.Close()
+
+	r := NewRegistry()
+	s := r.NewScope("plugin")
+	id, _ := s.Define(Gauge, "active")
+	_ = s.Record(id, 1)
+
+	e := NewStatsdExporter(r, addr, StatsD)
+	e.Start(10 * time.Millisecond)
+	defer e.Stop()
+
+	// the flushes fail while nobody listens
+	time.Sleep(50 * time.Millisecond)
+
+	conn, err = net.ListenPacket("udp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	buf := make([]byte, 512)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "plugin.active:1|g", string(buf[:n]))
+}
+
+// failingConn fails the writes.
+type failingConn struct {
+	net.Conn
+}
+
+func (failingConn) Write(b []byte) (int, error) { return 0, errors.New("unreachable") }
+
+func (failingConn) Close() error { return nil }
+
+func TestStatsdExporterRetry(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	r := NewRegistry()
+	s := r.NewScope("plugin")
+	id, _ := s.Define(Counter, "requests")
+	_ = s.Increment(id, 3)
+
+	e := NewStatsdExporter(r, conn.LocalAddr().String(), StatsD)
+
+	// the increments not sent are pushed by the next flush
+	e.conn = failingConn{}
+	assert.NotNil(t, e.Flush())
+	e.conn = nil
+	_ = s.Increment(id, 1)
+	assert.Nil(t, e.Flush())
+
+	lines, _ := receive(t, conn)
+	assert.Equal(t, []string{"plugin.requests:4|c"}, lines)
+
+	// starting twice keeps the running flushes
+	e.Start(time.Hour)
+	stop := e.stop
+	e.Start(time.Hour)
+	assert.Equal(t, stop, e.stop)
+	e.Stop()
+	assert.Nil(t, e.stop)
+}
@@ -0,0 +1,99 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Tag is a label extracted from the name of a metric.
+type Tag struct {
+	Name  string
+	Value string
+}
+
+// TagRule extracts a tag from metric names, the way the stats_tags of Envoy
+// do. The first capture group of Regex is removed from the name, and the tag
+// value is the second capture group if any, the first one otherwise. E.g.
+// with `(\.method\.([^.]+))$`, "requests.method.GET" becomes the metric
+// "requests" with the tag method="GET".
+type TagRule struct {
+	Name  string
+	Regex *regexp.Regexp
+}
+
+// NewTagRule compiles expr into a TagRule.
+func NewTagRule(name string, expr string) (TagRule, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return TagRule{}, err
+	}
+	if re.NumSubexp() == 0 {
+		return TagRule{}, fmt.Errorf("tag %s: %s has no capture group", name, expr)
+	}
+	return TagRule{Name: name, Regex: re}, nil
+}
+
+// AddTagRule adds a rule applied to the names of the metrics defined
+// afterwards, after the rules added before it.
+func (r *Registry) AddTagRule(rule TagRule) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.tagRules = append(r.tagRules, rule)
+}
+
+// extractTags applies rules to name, returning the name without the tags.
+func extractTags(rules []TagRule, name string) (string, []Tag) {
+	var tags []Tag
+
+	for _, rule := range rules {
+		m := rule.Regex.FindStringSubmatchIndex(name)
+		if m == nil || m[2] < 0 {
+			continue
+		}
+
+		value := name[m[2]:m[3]]
+		if len(m) > 4 && m[4] >= 0 {
+			value = name[m[4]:m[5]]
+		}
+
+		tags = append(tags, Tag{Name: rule.Name, Value: value})
+		name = name[:m[2]] + name[m[3]:]
+	}
+
+	return name, tags
+}
+
+// formatTags formats tags as Prometheus labels, e.g. {method="GET"}.
+func formatTags(tags []Tag, extra ...Tag) string {
+	tags = append(tags[:len(tags):len(tags)], extra...)
+	if len(tags) == 0 {
+		return ""
+	}
+
+	labels := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		labels = append(labels, prometheusName(tag.Name)+`="`+labelEscaper.Replace(tag.Value)+`"`)
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,181 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nethttp
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+)
+
+// RegisterRequestAttributes registers providers for the Envoy request, source,
+// destination and connection attributes of r, e.g. request.path or
+// source.address, start being the time the request was received. See
+// ConnContext for the connection.id. The values are encoded the way Envoy
+// serializes them: request.time as int64 nanoseconds since the epoch,
+// request.duration as int64 nanoseconds, ports and sizes as int64, and
+// request.headers as a pairs map.
+func RegisterRequestAttributes(store *common.PropertyStore, r *http.Request, start time.Time) {
+	headers := NewRequestHeaderMap(r)
+
+	store.RegisterProvider("request", attributes(func(name string) (interface{}, bool) {
+		switch name {
+		case "path":
+			return r.URL.RequestURI(), true
+		case "url_path":
+			return r.URL.Path, true
+		case "host":
+			return headerValue(headers, ":authority")
+		case "scheme":
+			return headerValue(headers, ":scheme")
+		case "method":
+			return r.Method, true
+		case "headers":
+			return headers, true
+		case "referer":
+			return headerValue(headers, "referer")
+		case "useragent":
+			return headerValue(headers, "user-agent")
+		case "id":
+			return headerValue(headers, "x-request-id")
+		case "time":
+			return start, true
+		case "duration":
+			return time.Since(start), true
+		case "protocol":
+			return r.Proto, true
+		case "query":
+			return r.URL.RawQuery, true
+		case "size":
+			if r.ContentLength < 0 {
+				return nil, false
+			}
+			return r.ContentLength, true
+		}
+		return nil, false
+	}))
+
+	store.RegisterProvider("source", addressAttributes(func() string {
+		return r.RemoteAddr
+	}))
+
+	store.RegisterProvider("destination", addressAttributes(func() string {
+		if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			return addr.String()
+		}
+		return ""
+	}))
+
+	registerRequestConnection(store, r)
+}
+
+// RegisterResponseAttributes registers a provider for the Envoy response
+// attributes of resp, e.g. response.code or response.headers.
+func RegisterResponseAttributes(store *common.PropertyStore, resp *http.Response) {
+	headers := NewResponseHeaderMap(resp)
+
+	store.RegisterProvider("response", attributes(func(name string) (interface{}, bool) {
+		switch name {
+		case "code":
+			return int64(resp.StatusCode), true
+		case "headers":
+			return headers, true
+		case "trailers":
+			return NewHeaderMap(resp.Trailer), true
+		case "size":
+			if resp.ContentLength < 0 {
+				return nil, false
+			}
+			return resp.ContentLength, true
+		}
+		return nil, false
+	}))
+}
+
+// SetPluginAttributes sets the plugin_name, plugin_root_id and plugin_vm_id
+// attributes of a plugin.
+func SetPluginAttributes(store *common.PropertyStore, name string, rootID string, vmID string) {
+	store.Set("plugin_name", name)
+	store.Set("plugin_root_id", rootID)
+	store.Set("plugin_vm_id", vmID)
+}
+
+// attributes returns a provider resolving the attribute names under its
+// path with get, descending into the maps, e.g. request.headers.user-agent.
+func attributes(get func(name string) (interface{}, bool)) common.PropertyProvider {
+	return common.PropertyProviderFunc(func(path []string) (interface{}, bool) {
+		if len(path) == 0 {
+			return nil, false
+		}
+
+		v, ok := get(path[0])
+		if !ok {
+			return nil, false
+		}
+
+		for _, key := range path[1:] {
+			m, ok := v.(common.HeaderMap)
+			if !ok {
+				return nil, false
+			}
+			if v, ok = m.Get(key); !ok {
+				return nil, false
+			}
+		}
+
+		return v, true
+	})
+}
+
+// addressAttributes returns a provider for the address and port attributes
+// of the "host:port" returned by addr.
+func addressAttributes(addr func() string) common.PropertyProvider {
+	return attributes(func(name string) (interface{}, bool) {
+		a := addr()
+		if a == "" {
+			return nil, false
+		}
+
+		switch name {
+		case "address":
+			return a, true
+		case "port":
+			_, port, err := net.SplitHostPort(a)
+			if err != nil {
+				return nil, false
+			}
+			p, err := strconv.ParseInt(port, 10, 64)
+			if err != nil {
+				return nil, false
+			}
+			return p, true
+		}
+		return nil, false
+	})
+}
+
+func headerValue(m common.HeaderMap, key string) (interface{}, bool) {
+	v, ok := m.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return v, true
+}
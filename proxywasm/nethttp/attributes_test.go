@@ -0,0 +1,111 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nethttp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+)
+
+func TestRequestAttributes(t *testing.T) {
+	r := httptest.NewRequest("POST", "http://example.com/foo?bar=1", strings.NewReader("body"))
+	r.RemoteAddr = "10.0.0.1:4321"
+	r.Header.Set("User-Agent", "curl")
+	r.Header.Set("X-Request-Id", "abc")
+	local := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080}
+	r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, local))
+
+	start := time.Unix(1, 2)
+	store := common.NewPropertyStore(nil)
+	RegisterRequestAttributes(store, r, start)
+
+	for path, expected := range map[string]interface{}{
+		"request\x00path":                      "/foo?bar=1",
+		"request\x00url_path":                  "/foo",
+		"request\x00host":                      "example.com",
+		"request\x00scheme":                    "http",
+		"request\x00method":                    "POST",
+		"request\x00useragent":                 "curl",
+		"request\x00id":                        "abc",
+		"request\x00query":                     "bar=1",
+		"request\x00protocol":                  "HTTP/1.1",
+		"request\x00size":                      int64(4),
+		"request\x00time":                      start,
+		"request\x00headers\x00user-agent":     "curl",
+		"request\x00headers\x00:method":        "POST",
+		"source\x00address":                    "10.0.0.1:4321",
+		"source\x00port":                       int64(4321),
+		"destination\x00address":               "127.0.0.1:8080",
+		"destination\x00port":                  int64(8080),
+		"request\x00referer":                   nil,
+		"request\x00headers\x00x-missing":      nil,
+		"request\x00path\x00invalid":           nil,
+		"request\x00headers\x00user-agent\x00": nil,
+	} {
+		v, ok := store.Get(path)
+		assert.Equal(t, expected != nil, ok, "%q", path)
+		assert.Equal(t, expected, v, "%q", path)
+	}
+
+	b, ok, err := store.GetBytes("request\x00time")
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{2, 0xca, 0x9a, 0x3b, 0, 0, 0, 0}, b)
+
+	b, _, err = store.GetBytes("request\x00headers")
+	assert.Nil(t, err)
+	m, err := common.DecodeMap(b)
+	assert.Nil(t, err)
+	v, _ := m.Get(":path")
+	assert.Equal(t, "/foo?bar=1", v)
+}
+
+func TestResponseAndPluginAttributes(t *testing.T) {
+	plugin := common.NewPropertyStore(nil)
+	SetPluginAttributes(plugin, "my-plugin", "root", "vm")
+
+	resp := &http.Response{StatusCode: http.StatusNotFound, Header: http.Header{"Content-Type": {"text/plain"}}, ContentLength: -1}
+	store := common.NewPropertyStore(plugin)
+	RegisterResponseAttributes(store, resp)
+
+	for path, expected := range map[string]interface{}{
+		"response\x00code":                    int64(404),
+		"response\x00headers\x00content-type": "text/plain",
+		"response\x00headers\x00:status":      "404",
+		"response\x00size":                    nil,
+		"plugin_name":                         "my-plugin",
+		"plugin_root_id":                      "root",
+		"plugin_vm_id":                        "vm",
+	} {
+		v, ok := store.Get(path)
+		assert.Equal(t, expected != nil, ok, "%q", path)
+		assert.Equal(t, expected, v, "%q", path)
+	}
+
+	b, _, err := store.GetBytes("response\x00code")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x94, 1, 0, 0, 0, 0, 0, 0}, b)
+}
@@ -0,0 +1,91 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package nethttp adapts net/http requests and responses to the types used by
+// the proxy-wasm imports.
+package nethttp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+)
+
+// Body is a buffered HTTP message body. It implements common.MutableBuffer,
+// so plugins can replace, insert or prepend content anywhere in it.
+type Body struct {
+	common.CommonBuffer
+}
+
+var (
+	_ common.MutableBuffer  = &Body{}
+	_ common.ReaderAtBuffer = &Body{}
+)
+
+// ReadBody reads rc until EOF into a new Body and closes it. A nil rc, such
+// as the body of a GET request, results in an empty Body.
+func ReadBody(rc io.ReadCloser) (*Body, error) {
+	b := &Body{}
+	if rc == nil || rc == http.NoBody {
+		return b, nil
+	}
+	defer func() { _ = rc.Close() }()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	_, _ = b.Write(data)
+
+	return b, nil
+}
+
+// ReadRequestBody reads the body of r into a new Body. The request body is
+// replaced by the returned Body, see SetRequestBody.
+func ReadRequestBody(r *http.Request) (*Body, error) {
+	b, err := ReadBody(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	b.SetRequestBody(r)
+
+	return b, nil
+}
+
+// NewReader returns a reader over the current content of the body.
+func (b *Body) NewReader() io.ReadCloser {
+	return ioutil.NopCloser(bytes.NewReader(b.Bytes()))
+}
+
+// SetRequestBody makes r send the content of the body. Changes made to the
+// body after this call are visible through r.GetBody only.
+func (b *Body) SetRequestBody(r *http.Request) {
+	r.Body = b.NewReader()
+	r.ContentLength = int64(b.Len())
+	r.GetBody = func() (io.ReadCloser, error) {
+		return b.NewReader(), nil
+	}
+}
+
+// WriteTo writes the content of the body to w, e.g. an http.ResponseWriter.
+func (b *Body) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(b.Bytes())
+	return int64(n), err
+}
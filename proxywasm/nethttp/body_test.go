@@ -0,0 +1,58 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nethttp
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+)
+
+func TestRequestBody(t *testing.T) {
+	r := httptest.NewRequest("POST", "/", strings.NewReader("hello world"))
+
+	body, err := ReadRequestBody(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", string(body.Bytes()))
+
+	assert.Nil(t, common.ReplaceBuffer(body, 0, 5, []byte("goodbye")))
+	body.SetRequestBody(r)
+
+	data, err := ioutil.ReadAll(r.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "goodbye world", string(data))
+	assert.Equal(t, int64(len(data)), r.ContentLength)
+
+	rc, err := r.GetBody()
+	assert.Nil(t, err)
+	data, _ = ioutil.ReadAll(rc)
+	assert.Equal(t, "goodbye world", string(data))
+
+	w := httptest.NewRecorder()
+	_, err = body.WriteTo(w)
+	assert.Nil(t, err)
+	assert.Equal(t, "goodbye world", w.Body.String())
+
+	body, err = ReadBody(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, body.Len())
+}
@@ -0,0 +1,162 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nethttp
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"sync/atomic"
+
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+)
+
+var connectionIDGenerator uint64
+
+type connContextKey struct{}
+
+type connInfo struct {
+	conn net.Conn
+	id   uint64
+}
+
+// ConnContext is meant for http.Server.ConnContext, it keeps the connection
+// of the requests and gives it an id, so that RegisterRequestAttributes
+// provides the connection.id and the TLS state of the connection.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, &connInfo{
+		conn: c,
+		id:   atomic.AddUint64(&connectionIDGenerator, 1),
+	})
+}
+
+// RegisterConnectionAttributes registers providers for the Envoy connection,
+// source and destination attributes of conn, e.g. for L4 plugins. The TLS
+// attributes are provided once the handshake of a *tls.Conn is complete.
+func RegisterConnectionAttributes(store *common.PropertyStore, conn net.Conn, id uint64) {
+	store.RegisterProvider("connection", connectionAttributes(id, true, func() *tls.ConnectionState {
+		return connectionState(conn)
+	}))
+
+	store.RegisterProvider("source", addressAttributes(func() string {
+		return conn.RemoteAddr().String()
+	}))
+
+	store.RegisterProvider("destination", addressAttributes(func() string {
+		return conn.LocalAddr().String()
+	}))
+}
+
+// registerRequestConnection registers the connection attributes of r, taken
+// from r.TLS and the connection kept by ConnContext if any.
+func registerRequestConnection(store *common.PropertyStore, r *http.Request) {
+	info, ok := r.Context().Value(connContextKey{}).(*connInfo)
+
+	var id uint64
+	if ok {
+		id = info.id
+	}
+
+	store.RegisterProvider("connection", connectionAttributes(id, ok, func() *tls.ConnectionState {
+		return r.TLS
+	}))
+}
+
+// connectionAttributes returns a provider for the connection attributes:
+//
+//   - id: the connection id, as uint64
+//   - mtls: whether the peer presented a certificate, as bool
+//   - requested_server_name: the SNI
+//   - tls_version: e.g. "TLSv1.3"
+//   - tls_cipher_suite: e.g. "TLS_AES_128_GCM_SHA256", not provided by Envoy
+//   - subject_peer_certificate, dns_san_peer_certificate, uri_san_peer_certificate
+//     and sha256_peer_certificate_digest: from the leaf certificate of the peer
+func connectionAttributes(id uint64, hasID bool, state func() *tls.ConnectionState) common.PropertyProvider {
+	return attributes(func(name string) (interface{}, bool) {
+		if name == "id" {
+			return id, hasID
+		}
+
+		s := state()
+		if name == "mtls" {
+			return s != nil && len(s.PeerCertificates) > 0, true
+		}
+		if s == nil {
+			return nil, false
+		}
+
+		switch name {
+		case "requested_server_name":
+			return s.ServerName, true
+		case "tls_version":
+			v, ok := tlsVersions[s.Version]
+			return v, ok
+		case "tls_cipher_suite":
+			return tls.CipherSuiteName(s.CipherSuite), true
+		}
+
+		if len(s.PeerCertificates) == 0 {
+			return nil, false
+		}
+		cert := s.PeerCertificates[0]
+
+		switch name {
+		case "subject_peer_certificate":
+			return cert.Subject.String(), true
+		case "dns_san_peer_certificate":
+			if len(cert.DNSNames) == 0 {
+				return nil, false
+			}
+			return cert.DNSNames[0], true
+		case "uri_san_peer_certificate":
+			if len(cert.URIs) == 0 {
+				return nil, false
+			}
+			return cert.URIs[0].String(), true
+		case "sha256_peer_certificate_digest":
+			digest := sha256.Sum256(cert.Raw)
+			return hex.EncodeToString(digest[:]), true
+		}
+		return nil, false
+	})
+}
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLSv1",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+// connectionState returns the TLS state of conn, nil for a plain connection
+// or before the handshake.
+func connectionState(conn net.Conn) *tls.ConnectionState {
+	c, ok := conn.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return nil
+	}
+
+	s := c.ConnectionState()
+	if !s.HandshakeComplete {
+		return nil
+	}
+	return &s
+}
@@ -0,0 +1,101 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nethttp
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+)
+
+func TestRequestConnectionAttributes(t *testing.T) {
+	values := make(map[string]interface{})
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		store := common.NewPropertyStore(nil)
+		RegisterRequestAttributes(store, r, time.Now())
+		for _, name := range []string{"id", "mtls", "requested_server_name", "tls_version",
+			"subject_peer_certificate", "dns_san_peer_certificate", "sha256_peer_certificate_digest"} {
+			values[name], _ = store.Get(common.PropertyPath("connection", name))
+		}
+	}))
+	server.Config.ConnContext = ConnContext
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	// the client presents the certificate of the server
+	client := server.Client()
+	client.Transport.(*http.Transport).TLSClientConfig.Certificates = server.TLS.Certificates
+
+	resp, err := client.Get(server.URL)
+	assert.Nil(t, err)
+	_ = resp.Body.Close()
+
+	cert := server.Certificate()
+	digest := sha256.Sum256(cert.Raw)
+
+	assert.IsType(t, uint64(0), values["id"])
+	assert.Equal(t, true, values["mtls"])
+	assert.Equal(t, "TLSv1.3", values["tls_version"])
+	assert.Equal(t, cert.Subject.String(), values["subject_peer_certificate"])
+	assert.Equal(t, cert.DNSNames[0], values["dns_san_peer_certificate"])
+	assert.Equal(t, hex.EncodeToString(digest[:]), values["sha256_peer_certificate_digest"])
+}
+
+func TestPlainConnectionAttributes(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+	defer client.Close()
+
+	conn, err := l.Accept()
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	store := common.NewPropertyStore(nil)
+	RegisterConnectionAttributes(store, conn, 7)
+
+	_, port, _ := net.SplitHostPort(client.LocalAddr().String())
+	sourcePort, _ := strconv.ParseInt(port, 10, 64)
+
+	for path, expected := range map[string]interface{}{
+		"connection\x00id":          uint64(7),
+		"connection\x00mtls":        false,
+		"connection\x00tls_version": nil,
+		"source\x00address":         client.LocalAddr().String(),
+		"source\x00port":            sourcePort,
+		"destination\x00address":    l.Addr().String(),
+	} {
+		v, ok := store.Get(path)
+		assert.Equal(t, expected != nil, ok, "%q", path)
+		assert.Equal(t, expected, v, "%q", path)
+	}
+}
@@ -0,0 +1,308 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nethttp
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+)
+
+// HeaderMap adapts an http.Header to common.HeaderMap.
+//
+// Keys are matched case-insensitively and reported with the casing they have
+// in the http.Header, which is kept for the existing keys. New keys are added
+// in canonical form, so that net/http finds them, e.g. Content-Type or
+// Content-Length. The pseudo headers
+// (:method, :path, :authority, :scheme and :status) are mapped to the fields
+// of the request or response, and are ranged over first. The other keys are
+// ranged over in sorted order since http.Header does not keep insertion order.
+type HeaderMap struct {
+	header http.Header
+	pseudo []pseudoHeader
+}
+
+type pseudoHeader struct {
+	key string
+	get func() string
+	set func(value string)
+}
+
+var _ common.HeaderMap = &HeaderMap{}
+
+// NewHeaderMap returns a HeaderMap without pseudo headers, e.g. for trailers.
+func NewHeaderMap(header http.Header) *HeaderMap {
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &HeaderMap{header: header}
+}
+
+// NewRequestHeaderMap returns the HeaderMap of r, mapping :method, :path,
+// :authority and :scheme to the fields of r.
+func NewRequestHeaderMap(r *http.Request) *HeaderMap {
+	if r.Header == nil {
+		r.Header = make(http.Header)
+	}
+
+	return &HeaderMap{
+		header: r.Header,
+		pseudo: []pseudoHeader{
+			{
+				key: ":method",
+				get: func() string { return r.Method },
+				set: func(value string) { r.Method = value },
+			},
+			{
+				key: ":scheme",
+				get: func() string {
+					switch {
+					case r.URL.Scheme != "":
+						return r.URL.Scheme
+					case r.TLS != nil:
+						return "https"
+					}
+					return "http"
+				},
+				set: func(value string) { r.URL.Scheme = value },
+			},
+			{
+				key: ":authority",
+				get: func() string {
+					if r.Host != "" {
+						return r.Host
+					}
+					return r.URL.Host
+				},
+				set: func(value string) { r.Host = value },
+			},
+			{
+				key: ":path",
+				get: func() string { return r.URL.RequestURI() },
+				set: func(value string) {
+					u, err := url.ParseRequestURI(value)
+					if err != nil {
+						return
+					}
+					r.URL.Path, r.URL.RawPath, r.URL.RawQuery = u.Path, u.RawPath, u.RawQuery
+					// only set on server requests, http.Client rejects it
+					if r.RequestURI != "" {
+						r.RequestURI = value
+					}
+				},
+			},
+		},
+	}
+}
+
+// NewResponseHeaderMap returns the HeaderMap of resp, mapping :status to its status code.
+func NewResponseHeaderMap(resp *http.Response) *HeaderMap {
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+
+	return NewStatusHeaderMap(resp.Header, &resp.StatusCode)
+}
+
+// NewStatusHeaderMap returns a HeaderMap mapping :status to *status, e.g. for the
+// headers of an http.ResponseWriter before WriteHeader is called. A zero status
+// is reported as 200.
+func NewStatusHeaderMap(header http.Header, status *int) *HeaderMap {
+	return &HeaderMap{
+		header: header,
+		pseudo: []pseudoHeader{
+			{
+				key: ":status",
+				get: func() string {
+					if *status == 0 {
+						return strconv.Itoa(http.StatusOK)
+					}
+					return strconv.Itoa(*status)
+				},
+				set: func(value string) {
+					if code, err := strconv.Atoi(value); err == nil {
+						*status = code
+					}
+				},
+			},
+		},
+	}
+}
+
+func (h *HeaderMap) pseudoHeader(key string) *pseudoHeader {
+	if !strings.HasPrefix(key, ":") {
+		return nil
+	}
+	for i := range h.pseudo {
+		if strings.EqualFold(h.pseudo[i].key, key) {
+			return &h.pseudo[i]
+		}
+	}
+	return nil
+}
+
+// keys returns the keys of the header matching key case-insensitively.
+func (h *HeaderMap) keys(key string) []string {
+	var keys []string
+	for k := range h.header {
+		if strings.EqualFold(k, key) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// headerKey returns the key under which the values of key are stored, given
+// its existing variants.
+func (h *HeaderMap) headerKey(key string, keys []string) string {
+	if len(keys) > 0 {
+		return keys[0]
+	}
+	return http.CanonicalHeaderKey(key)
+}
+
+func (h *HeaderMap) Get(key string) (string, bool) {
+	if p := h.pseudoHeader(key); p != nil {
+		return p.get(), true
+	}
+	for _, k := range h.keys(key) {
+		if values := h.header[k]; len(values) > 0 {
+			return values[0], true
+		}
+	}
+	return "", false
+}
+
+func (h *HeaderMap) GetAll(key string) []string {
+	if p := h.pseudoHeader(key); p != nil {
+		return []string{p.get()}
+	}
+
+	var values []string
+	for _, k := range h.keys(key) {
+		values = append(values, h.header[k]...)
+	}
+	return values
+}
+
+func (h *HeaderMap) Values(key string) []string {
+	return h.GetAll(key)
+}
+
+func (h *HeaderMap) Set(key, value string) {
+	if p := h.pseudoHeader(key); p != nil {
+		p.set(value)
+		return
+	}
+
+	// keep the casing of the existing key
+	keys := h.keys(key)
+	key = h.headerKey(key, keys)
+	for _, k := range keys {
+		delete(h.header, k)
+	}
+	h.header[key] = []string{value}
+}
+
+func (h *HeaderMap) Add(key, value string) {
+	if p := h.pseudoHeader(key); p != nil {
+		p.set(value)
+		return
+	}
+
+	key = h.headerKey(key, h.keys(key))
+	h.header[key] = append(h.header[key], value)
+}
+
+// Del removes all values of key, pseudo headers can not be removed.
+func (h *HeaderMap) Del(key string) {
+	if h.pseudoHeader(key) != nil {
+		return
+	}
+	for _, k := range h.keys(key) {
+		delete(h.header, k)
+	}
+}
+
+func (h *HeaderMap) Range(f func(key, value string) bool) {
+	for _, p := range h.pseudo {
+		if value := p.get(); value != "" && !f(p.key, value) {
+			return
+		}
+	}
+
+	keys := make([]string, 0, len(h.header))
+	for k := range h.header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		for _, v := range h.header[k] {
+			if !f(k, v) {
+				return
+			}
+		}
+	}
+}
+
+func (h *HeaderMap) Len() int {
+	n := 0
+	h.Range(func(key, value string) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// Clone returns a detached copy of the map, changing it does not affect the
+// underlying request or response.
+func (h *HeaderMap) Clone() common.HeaderMap {
+	clone := &HeaderMap{
+		header: h.header.Clone(),
+		pseudo: make([]pseudoHeader, 0, len(h.pseudo)),
+	}
+	if clone.header == nil {
+		clone.header = make(http.Header)
+	}
+
+	for _, p := range h.pseudo {
+		value := p.get()
+		clone.pseudo = append(clone.pseudo, pseudoHeader{
+			key: p.key,
+			get: func() string { return value },
+			set: func(v string) { value = v },
+		})
+	}
+
+	return clone
+}
+
+func (h *HeaderMap) ByteSize() uint64 {
+	var size uint64
+	h.Range(func(key, value string) bool {
+		size += uint64(len(key) + len(value))
+		return true
+	})
+	return size
+}
@@ -0,0 +1,141 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nethttp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+)
+
+func pairsOf(h common.HeaderMap) [][2]string {
+	var pairs [][2]string
+	h.Range(func(key, value string) bool {
+		pairs = append(pairs, [2]string{key, value})
+		return true
+	})
+	return pairs
+}
+
+func TestRequestHeaderMap(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://example.com/foo?bar=1", nil)
+	r.Header["x-lower"] = []string{"a"}
+	r.Header.Add("Set-Cookie", "b")
+	r.Header.Add("Set-Cookie", "c")
+
+	h := NewRequestHeaderMap(r)
+
+	v, ok := h.Get(":path")
+	assert.True(t, ok)
+	assert.Equal(t, "/foo?bar=1", v)
+
+	v, ok = h.Get("X-LOWER")
+	assert.True(t, ok)
+	assert.Equal(t, "a", v)
+
+	_, ok = h.Get("x-missing")
+	assert.False(t, ok)
+
+	assert.Equal(t, []string{"b", "c"}, h.Values("set-cookie"))
+	assert.Equal(t, []string{"b", "c"}, h.GetAll("Set-Cookie"))
+	assert.Equal(t, []string{"/foo?bar=1"}, h.GetAll(":path"))
+	assert.Equal(t, [][2]string{
+		{":method", "GET"},
+		{":scheme", "http"},
+		{":authority", "example.com"},
+		{":path", "/foo?bar=1"},
+		{"Set-Cookie", "b"},
+		{"Set-Cookie", "c"},
+		{"x-lower", "a"},
+	}, pairsOf(h))
+	assert.Equal(t, 7, h.Len())
+
+	clone := h.Clone()
+
+	// the casing of the existing keys is kept, new keys are canonical
+	h.Set("X-Lower", "d")
+	h.Add("x-new", "e")
+	assert.Equal(t, []string{"d"}, r.Header["x-lower"])
+	assert.Equal(t, []string{"e"}, r.Header["X-New"])
+
+	h.Del("SET-COOKIE")
+	assert.Empty(t, r.Header.Values("Set-Cookie"))
+
+	h.Set(":method", "POST")
+	h.Set(":path", "/baz?q=2")
+	h.Set(":authority", "example.org")
+	h.Set(":scheme", "https")
+	assert.Equal(t, "POST", r.Method)
+	assert.Equal(t, "/baz", r.URL.Path)
+	assert.Equal(t, "q=2", r.URL.RawQuery)
+	assert.Equal(t, "example.org", r.Host)
+	assert.Equal(t, "https", r.URL.Scheme)
+
+	// pseudo headers can not be removed
+	h.Del(":method")
+	assert.Equal(t, "POST", r.Method)
+
+	v, _ = clone.Get(":method")
+	assert.Equal(t, "GET", v)
+	assert.Equal(t, []string{"b", "c"}, clone.Values("set-cookie"))
+	assert.Equal(t, uint64(len(":methodGET:schemehttp:authorityexample.com:path/foo?bar=1Set-CookiebSet-Cookiecx-lowera")), clone.ByteSize())
+}
+
+func TestClientRequestHeaderMap(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer server.Close()
+
+	r, err := http.NewRequest("GET", server.URL+"/foo", nil)
+	assert.Nil(t, err)
+
+	// the client requests can still be sent once rewritten
+	NewRequestHeaderMap(r).Set(":path", "/bar?q=1")
+	assert.Equal(t, "", r.RequestURI)
+
+	resp, err := http.DefaultClient.Do(r)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "/bar?q=1", string(body))
+}
+
+func TestResponseHeaderMap(t *testing.T) {
+	resp := &http.Response{StatusCode: http.StatusNotFound}
+	h := NewResponseHeaderMap(resp)
+
+	v, _ := h.Get(":status")
+	assert.Equal(t, "404", v)
+
+	h.Set(":status", "503")
+	h.Set("content-type", "text/plain")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+
+	h.Set(":status", "invalid")
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	status := 0
+	v, _ = NewStatusHeaderMap(make(http.Header), &status).Get(":status")
+	assert.Equal(t, "200", v)
+}
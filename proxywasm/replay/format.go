@@ -0,0 +1,464 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package replay records the ABI traffic between a host and a wasm plugin and
+// replays it offline against the same module.
+//
+// The log is a sequence of records, each one starting with a tag byte:
+//
+//	magic "PWRL" | version uvarint | record*
+//
+//	name     : string                          (interned, referenced by index afterwards)
+//	import   : name-idx, kinds(args), kinds(rets) (declared by RegisterFunc)
+//	start    :                                  (instance Start)
+//	call     : name-idx, values(args)           (host calls a guest export)
+//	return   : values(rets), error string
+//	invoke   : name-idx, values(args)           (guest calls a host import)
+//	malloc   : size uvarint, addr uvarint       (host allocates guest memory)
+//	write    : addr uvarint, bytes              (host writes guest memory)
+//	result   : values(rets)                     (host import returns)
+//
+// Values are stored as the unsigned varint of their bits, floats using their
+// IEEE-754 representation.
+package replay
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+)
+
+const (
+	logMagic   = "PWRL"
+	logVersion = 1
+)
+
+type tag byte
+
+const (
+	tagName tag = iota + 1
+	tagImport
+	tagStart
+	tagCall
+	tagReturn
+	tagInvoke
+	tagMalloc
+	tagWrite
+	tagResult
+)
+
+func (t tag) String() string {
+	switch t {
+	case tagName:
+		return "name"
+	case tagImport:
+		return "import"
+	case tagStart:
+		return "start"
+	case tagCall:
+		return "call"
+	case tagReturn:
+		return "return"
+	case tagInvoke:
+		return "invoke"
+	case tagMalloc:
+		return "malloc"
+	case tagWrite:
+		return "write"
+	case tagResult:
+		return "result"
+	}
+	return fmt.Sprintf("tag(%d)", byte(t))
+}
+
+// Kind is the wasm type of a recorded value.
+type Kind byte
+
+const (
+	KindI32 Kind = iota + 1
+	KindI64
+	KindF32
+	KindF64
+)
+
+var ErrInvalidLog = errors.New("invalid replay log")
+
+// Value is a recorded wasm value.
+type Value struct {
+	Kind Kind
+	Bits uint64
+}
+
+func (v Value) String() string {
+	switch v.Kind {
+	case KindI32:
+		return fmt.Sprintf("i32:%d", int32(v.Bits))
+	case KindI64:
+		return fmt.Sprintf("i64:%d", int64(v.Bits))
+	case KindF32:
+		return fmt.Sprintf("f32:%v", math.Float32frombits(uint32(v.Bits)))
+	case KindF64:
+		return fmt.Sprintf("f64:%v", math.Float64frombits(v.Bits))
+	}
+	return "<nil>"
+}
+
+func kindOf(t reflect.Type) Kind {
+	switch t.Kind() {
+	case reflect.Int32, reflect.Uint32:
+		return KindI32
+	case reflect.Int64, reflect.Uint64, reflect.Int, reflect.Uint:
+		return KindI64
+	case reflect.Float32:
+		return KindF32
+	case reflect.Float64:
+		return KindF64
+	}
+	return 0
+}
+
+func typeOf(k Kind) reflect.Type {
+	switch k {
+	case KindI32:
+		return reflect.TypeOf(int32(0))
+	case KindI64:
+		return reflect.TypeOf(int64(0))
+	case KindF32:
+		return reflect.TypeOf(float32(0))
+	case KindF64:
+		return reflect.TypeOf(float64(0))
+	}
+	return nil
+}
+
+func valueOf(v reflect.Value) Value {
+	switch v.Kind() {
+	case reflect.Int32:
+		return Value{Kind: KindI32, Bits: uint64(uint32(v.Int()))}
+	case reflect.Uint32:
+		return Value{Kind: KindI32, Bits: v.Uint()}
+	case reflect.Int64, reflect.Int:
+		return Value{Kind: KindI64, Bits: uint64(v.Int())}
+	case reflect.Uint64, reflect.Uint:
+		return Value{Kind: KindI64, Bits: v.Uint()}
+	case reflect.Float32:
+		return Value{Kind: KindF32, Bits: uint64(math.Float32bits(float32(v.Float())))}
+	case reflect.Float64:
+		return Value{Kind: KindF64, Bits: math.Float64bits(v.Float())}
+	}
+	return Value{}
+}
+
+// goValue converts v into a reflect.Value of type t, or of its natural type if t is nil.
+func (v Value) goValue(t reflect.Type) reflect.Value {
+	if t == nil {
+		t = typeOf(v.Kind)
+	}
+	if t == nil {
+		return reflect.Value{}
+	}
+
+	res := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Int32:
+		res.SetInt(int64(int32(v.Bits)))
+	case reflect.Int64, reflect.Int:
+		res.SetInt(int64(v.Bits))
+	case reflect.Uint32, reflect.Uint64, reflect.Uint:
+		res.SetUint(v.Bits)
+	case reflect.Float32:
+		res.SetFloat(float64(math.Float32frombits(uint32(v.Bits))))
+	case reflect.Float64:
+		res.SetFloat(math.Float64frombits(v.Bits))
+	}
+	return res
+}
+
+func valuesEqual(a, b []Value) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// event is a decoded log record.
+type event struct {
+	tag   tag
+	name  string
+	kinds []Kind
+	rets  []Kind
+	args  []Value
+	addr  uint64
+	size  uint64
+	data  []byte
+	err   string
+}
+
+type encoder struct {
+	w     *bufio.Writer
+	names map[string]uint64
+	buf   [binary.MaxVarintLen64]byte
+	err   error
+}
+
+func newEncoder(w io.Writer) *encoder {
+	e := &encoder{
+		w:     bufio.NewWriter(w),
+		names: make(map[string]uint64),
+	}
+	e.raw([]byte(logMagic))
+	e.uvarint(logVersion)
+	return e
+}
+
+func (e *encoder) raw(p []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(p)
+	}
+}
+
+func (e *encoder) tag(t tag) {
+	e.raw([]byte{byte(t)})
+}
+
+func (e *encoder) uvarint(v uint64) {
+	n := binary.PutUvarint(e.buf[:], v)
+	e.raw(e.buf[:n])
+}
+
+func (e *encoder) bytes(p []byte) {
+	e.uvarint(uint64(len(p)))
+	e.raw(p)
+}
+
+// intern returns the index of name s, defining it first if it is new.
+// It must be called before the tag of the record that references s.
+func (e *encoder) intern(s string) uint64 {
+	idx, ok := e.names[s]
+	if !ok {
+		idx = uint64(len(e.names))
+		e.names[s] = idx
+		e.tag(tagName)
+		e.bytes([]byte(s))
+	}
+	return idx
+}
+
+func (e *encoder) kinds(ks []Kind) {
+	e.uvarint(uint64(len(ks)))
+	for _, k := range ks {
+		e.raw([]byte{byte(k)})
+	}
+}
+
+func (e *encoder) values(vs []Value) {
+	e.uvarint(uint64(len(vs)))
+	for _, v := range vs {
+		e.raw([]byte{byte(v.Kind)})
+		switch v.Kind {
+		case KindI32:
+			e.uvarint(uint64(uint32(v.Bits)))
+		default:
+			e.uvarint(v.Bits)
+		}
+	}
+}
+
+func (e *encoder) flush() error {
+	if e.err == nil {
+		e.err = e.w.Flush()
+	}
+	return e.err
+}
+
+type decoder struct {
+	r     *bufio.Reader
+	names []string
+}
+
+func (d *decoder) uvarint() (uint64, error) {
+	return binary.ReadUvarint(d.r)
+}
+
+func (d *decoder) bytes() ([]byte, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > math.MaxInt32 {
+		return nil, ErrInvalidLog
+	}
+	p := make([]byte, n)
+	_, err = io.ReadFull(d.r, p)
+	return p, err
+}
+
+func (d *decoder) name() (string, error) {
+	idx, err := d.uvarint()
+	if err != nil {
+		return "", err
+	}
+	if idx >= uint64(len(d.names)) {
+		return "", ErrInvalidLog
+	}
+	return d.names[idx], nil
+}
+
+func (d *decoder) kinds() ([]Kind, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > math.MaxUint16 {
+		return nil, ErrInvalidLog
+	}
+	ks := make([]Kind, n)
+	for i := range ks {
+		b, err := d.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		ks[i] = Kind(b)
+	}
+	return ks, nil
+}
+
+func (d *decoder) values() ([]Value, error) {
+	n, err := d.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > math.MaxUint16 {
+		return nil, ErrInvalidLog
+	}
+	vs := make([]Value, n)
+	for i := range vs {
+		b, err := d.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		bits, err := d.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		vs[i] = Value{Kind: Kind(b), Bits: bits}
+	}
+	return vs, nil
+}
+
+// next decodes the next record, returning io.EOF at the end of the log.
+func (d *decoder) next() (*event, error) {
+	b, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	// names are defined lazily in front of the first record using them
+	for tag(b) == tagName {
+		s, err := d.bytes()
+		if err != nil {
+			return nil, err
+		}
+		d.names = append(d.names, string(s))
+
+		if b, err = d.r.ReadByte(); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+	}
+
+	ev := &event{tag: tag(b)}
+
+	switch ev.tag {
+	case tagImport:
+		if ev.name, err = d.name(); err != nil {
+			return nil, err
+		}
+		if ev.kinds, err = d.kinds(); err != nil {
+			return nil, err
+		}
+		ev.rets, err = d.kinds()
+	case tagStart:
+	case tagCall, tagInvoke:
+		if ev.name, err = d.name(); err != nil {
+			return nil, err
+		}
+		ev.args, err = d.values()
+	case tagReturn:
+		if ev.args, err = d.values(); err != nil {
+			return nil, err
+		}
+		var msg []byte
+		msg, err = d.bytes()
+		ev.err = string(msg)
+	case tagResult:
+		ev.args, err = d.values()
+	case tagMalloc:
+		if ev.size, err = d.uvarint(); err != nil {
+			return nil, err
+		}
+		ev.addr, err = d.uvarint()
+	case tagWrite:
+		if ev.addr, err = d.uvarint(); err != nil {
+			return nil, err
+		}
+		ev.data, err = d.bytes()
+	default:
+		return nil, fmt.Errorf("%w: unknown record %v", ErrInvalidLog, ev.tag)
+	}
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return ev, err
+}
+
+// readLog decodes a whole log.
+func readLog(r io.Reader) ([]*event, error) {
+	d := &decoder{r: bufio.NewReader(r)}
+
+	magic := make([]byte, len(logMagic))
+	if _, err := io.ReadFull(d.r, magic); err != nil || string(magic) != logMagic {
+		return nil, ErrInvalidLog
+	}
+
+	version, err := d.uvarint()
+	if err != nil || version != logVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidLog, version)
+	}
+
+	var events []*event
+	for {
+		ev, err := d.next()
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+}
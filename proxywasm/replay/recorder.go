@@ -0,0 +1,245 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package replay
+
+import (
+	"encoding/binary"
+	"io"
+	"reflect"
+	"sync"
+
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+)
+
+// Recorder is a WasmInstance decorator logging every call into the guest and
+// every host import the guest makes, together with the host side effects on
+// guest memory, so that the plugin can be replayed offline by a Replayer.
+//
+// Recording happens at the ABI boundary, it works the same for the v1 and v2
+// imports. The Recorder must be used in place of the wrapped instance, e.g.
+//
+//	recorder := replay.NewRecorder(instance, file)
+//	v1.RegisterImports(recorder)
+//	_ = recorder.Start()
+type Recorder struct {
+	common.WasmInstance
+
+	lock sync.Mutex
+	enc  *encoder
+}
+
+func NewRecorder(instance common.WasmInstance, w io.Writer) *Recorder {
+	return &Recorder{
+		WasmInstance: instance,
+		enc:          newEncoder(w),
+	}
+}
+
+// Flush writes the buffered records to the underlying writer.
+func (r *Recorder) Flush() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.enc.flush()
+}
+
+func (r *Recorder) record(f func(e *encoder)) {
+	r.lock.Lock()
+	f(r.enc)
+	r.lock.Unlock()
+}
+
+func (r *Recorder) Start() error {
+	r.record(func(e *encoder) {
+		e.tag(tagStart)
+	})
+
+	err := r.WasmInstance.Start()
+	_ = r.Flush()
+
+	return err
+}
+
+func (r *Recorder) RegisterFunc(namespace string, funcName string, f interface{}) error {
+	fv := reflect.ValueOf(f)
+	if f == nil || fv.Kind() != reflect.Func || fv.Type().NumIn() < 1 ||
+		!reflect.TypeOf(r).AssignableTo(fv.Type().In(0)) {
+		return r.WasmInstance.RegisterFunc(namespace, funcName, f)
+	}
+
+	ft := fv.Type()
+
+	args := make([]Kind, 0, ft.NumIn()-1)
+	for i := 1; i < ft.NumIn(); i++ {
+		args = append(args, kindOf(ft.In(i)))
+	}
+
+	rets := make([]Kind, 0, ft.NumOut())
+	for i := 0; i < ft.NumOut(); i++ {
+		rets = append(rets, kindOf(ft.Out(i)))
+	}
+
+	r.record(func(e *encoder) {
+		idx := e.intern(funcName)
+		e.tag(tagImport)
+		e.uvarint(idx)
+		e.kinds(args)
+		e.kinds(rets)
+	})
+
+	self := reflect.ValueOf(r)
+	wrapped := reflect.MakeFunc(ft, func(in []reflect.Value) []reflect.Value {
+		r.record(func(e *encoder) {
+			idx := e.intern(funcName)
+			e.tag(tagInvoke)
+			e.uvarint(idx)
+			e.values(toValues(in[1:]))
+		})
+
+		// route the memory writes of the import through the recorder
+		in[0] = self
+		out := fv.Call(in)
+
+		r.record(func(e *encoder) {
+			e.tag(tagResult)
+			e.values(toValues(out))
+		})
+
+		return out
+	})
+
+	return r.WasmInstance.RegisterFunc(namespace, funcName, wrapped.Interface())
+}
+
+func (r *Recorder) GetExportsFunc(funcName string) (common.WasmFunction, error) {
+	f, err := r.WasmInstance.GetExportsFunc(funcName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &recordedFunction{WasmFunction: f, name: funcName, recorder: r}, nil
+}
+
+func (r *Recorder) Malloc(size int32) (uint64, error) {
+	addr, err := r.WasmInstance.Malloc(size)
+	if err == nil {
+		r.record(func(e *encoder) {
+			e.tag(tagMalloc)
+			e.uvarint(uint64(size))
+			e.uvarint(addr)
+		})
+	}
+	return addr, err
+}
+
+func (r *Recorder) recordWrite(addr uint64, content []byte) {
+	r.record(func(e *encoder) {
+		e.tag(tagWrite)
+		e.uvarint(addr)
+		e.bytes(content)
+	})
+}
+
+func (r *Recorder) PutMemory(addr uint64, size uint64, content []byte) error {
+	err := r.WasmInstance.PutMemory(addr, size, content)
+	if err == nil {
+		if size < uint64(len(content)) {
+			content = content[:size]
+		}
+		r.recordWrite(addr, content)
+	}
+	return err
+}
+
+func (r *Recorder) PutByte(addr uint64, b byte) error {
+	err := r.WasmInstance.PutByte(addr, b)
+	if err == nil {
+		r.recordWrite(addr, []byte{b})
+	}
+	return err
+}
+
+func (r *Recorder) PutUint32(addr uint64, value uint32) error {
+	err := r.WasmInstance.PutUint32(addr, value)
+	if err == nil {
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], value)
+		r.recordWrite(addr, b[:])
+	}
+	return err
+}
+
+func (r *Recorder) PutUint64(addr uint64, value uint64) error {
+	err := r.WasmInstance.PutUint64(addr, value)
+	if err == nil {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], value)
+		r.recordWrite(addr, b[:])
+	}
+	return err
+}
+
+type recordedFunction struct {
+	common.WasmFunction
+	name     string
+	recorder *Recorder
+}
+
+func (f *recordedFunction) Call(args ...interface{}) (interface{}, error) {
+	in := make([]reflect.Value, 0, len(args))
+	for _, a := range args {
+		in = append(in, reflect.ValueOf(a))
+	}
+
+	f.recorder.record(func(e *encoder) {
+		idx := e.intern(f.name)
+		e.tag(tagCall)
+		e.uvarint(idx)
+		e.values(toValues(in))
+	})
+
+	res, err := f.WasmFunction.Call(args...)
+
+	f.recorder.record(func(e *encoder) {
+		var out []reflect.Value
+		if res != nil {
+			out = append(out, reflect.ValueOf(res))
+		}
+
+		msg := ""
+		if err != nil {
+			msg = err.Error()
+		}
+
+		e.tag(tagReturn)
+		e.values(toValues(out))
+		e.bytes([]byte(msg))
+	})
+
+	_ = f.recorder.Flush()
+
+	return res, err
+}
+
+func toValues(in []reflect.Value) []Value {
+	res := make([]Value, 0, len(in))
+	for _, v := range in {
+		res = append(res, valueOf(v))
+	}
+	return res
+}
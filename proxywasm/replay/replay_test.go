@@ -0,0 +1,249 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package replay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+	v2 "mosn.io/proxy-wasm-go-host/proxywasm/v2"
+)
+
+// fakeGuest is a WasmInstance whose exports are Go funcs calling the registered imports.
+type fakeGuest struct {
+	common.WasmInstance // unused methods panic
+	mem                 []byte
+	brk                 uint64
+	data                interface{}
+	imports             map[string]reflect.Value
+	exports             map[string]func(g *fakeGuest, args ...interface{}) int32
+}
+
+func newFakeGuest(exports map[string]func(g *fakeGuest, args ...interface{}) int32) *fakeGuest {
+	return &fakeGuest{
+		mem:     make([]byte, 256),
+		brk:     16,
+		imports: make(map[string]reflect.Value),
+		exports: exports,
+	}
+}
+
+// callImport calls an import like an engine, recovering panics into errors.
+func (g *fakeGuest) callImport(name string, args ...int32) (res int32, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic [%v] when calling func [%v]", r, name)
+		}
+	}()
+
+	in := []reflect.Value{reflect.ValueOf(g)}
+	for _, a := range args {
+		in = append(in, reflect.ValueOf(a))
+	}
+	return int32(g.imports[name].Call(in)[0].Int()), nil
+}
+
+type fakeFunction struct {
+	g *fakeGuest
+	f func(g *fakeGuest, args ...interface{}) int32
+}
+
+func (f *fakeFunction) Call(args ...interface{}) (res interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			res, err = nil, fmt.Errorf("%v", r)
+		}
+	}()
+	return f.f(f.g, args...), nil
+}
+
+func (g *fakeGuest) Start() error { return nil }
+
+func (g *fakeGuest) RegisterFunc(namespace string, funcName string, f interface{}) error {
+	g.imports[funcName] = reflect.ValueOf(f)
+	return nil
+}
+
+func (g *fakeGuest) GetExportsFunc(funcName string) (common.WasmFunction, error) {
+	if f, ok := g.exports[funcName]; ok {
+		return &fakeFunction{g: g, f: f}, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func (g *fakeGuest) GetData() interface{} { return g.data }
+
+func (g *fakeGuest) GetMemory(addr uint64, size uint64) ([]byte, error) {
+	return g.mem[addr : addr+size], nil
+}
+
+func (g *fakeGuest) PutMemory(addr uint64, size uint64, content []byte) error {
+	copy(g.mem[addr:addr+size], content)
+	return nil
+}
+
+func (g *fakeGuest) PutUint32(addr uint64, value uint32) error {
+	binary.LittleEndian.PutUint32(g.mem[addr:], value)
+	return nil
+}
+
+func (g *fakeGuest) Malloc(size int32) (uint64, error) {
+	addr := g.brk
+	g.brk += uint64(size)
+	return addr, nil
+}
+
+// a guest export reading a host property and returning its first byte
+func onRequestHeaders(g *fakeGuest, args ...interface{}) int32 {
+	res, err := g.callImport("proxy_get_property", 0, 4, 8)
+	if err != nil {
+		panic(err)
+	}
+	if res != 0 {
+		return -1
+	}
+	addr := binary.LittleEndian.Uint32(g.mem[4:])
+	return int32(g.mem[addr]) + args[0].(int32)
+}
+
+// a host import writing "v" into guest memory
+func proxyGetProperty(instance common.WasmInstance, key int32, retPtr int32, retSize int32) int32 {
+	addr, _ := instance.Malloc(1)
+	_ = instance.PutMemory(addr, 1, []byte("v"))
+	_ = instance.PutUint32(uint64(retPtr), uint32(addr))
+	_ = instance.PutUint32(uint64(retSize), 1)
+	return 0
+}
+
+func record(t *testing.T) []byte {
+	var log bytes.Buffer
+
+	guest := newFakeGuest(map[string]func(g *fakeGuest, args ...interface{}) int32{
+		"proxy_on_request_headers": onRequestHeaders,
+	})
+	recorder := NewRecorder(guest, &log)
+
+	assert.Nil(t, recorder.RegisterFunc("env", "proxy_get_property", proxyGetProperty))
+	assert.Nil(t, recorder.Start())
+
+	f, err := recorder.GetExportsFunc("proxy_on_request_headers")
+	assert.Nil(t, err)
+
+	for i := int32(0); i < 2; i++ {
+		res, err := f.Call(i)
+		assert.Nil(t, err)
+		assert.Equal(t, int32('v')+i, res)
+	}
+
+	return log.Bytes()
+}
+
+func TestRecordReplay(t *testing.T) {
+	log := record(t)
+
+	guest := newFakeGuest(map[string]func(g *fakeGuest, args ...interface{}) int32{
+		"proxy_on_request_headers": onRequestHeaders,
+	})
+	replayer, err := NewReplayer(guest, bytes.NewReader(log))
+	assert.Nil(t, err)
+	assert.Nil(t, replayer.RegisterImports())
+	assert.Nil(t, replayer.Run())
+}
+
+func TestReplayDivergence(t *testing.T) {
+	log := record(t)
+
+	// the new guest passes a different key pointer to the host
+	guest := newFakeGuest(map[string]func(g *fakeGuest, args ...interface{}) int32{
+		"proxy_on_request_headers": func(g *fakeGuest, args ...interface{}) int32 {
+			res, _ := g.callImport("proxy_get_property", 1, 4, 8)
+			return res
+		},
+	})
+	replayer, err := NewReplayer(guest, bytes.NewReader(log))
+	assert.Nil(t, err)
+	assert.Nil(t, replayer.RegisterImports())
+
+	err = replayer.Run()
+
+	var divergence *Divergence
+	assert.True(t, errors.As(err, &divergence))
+	assert.Equal(t, "proxy_on_request_headers", divergence.Export)
+	assert.Equal(t, "proxy_get_property(i32:0, i32:4, i32:8)", divergence.Expected)
+	assert.Equal(t, "proxy_get_property(i32:1, i32:4, i32:8)", divergence.Actual)
+}
+
+func TestReplayInvalidLog(t *testing.T) {
+	_, err := NewReplayer(newFakeGuest(nil), bytes.NewReader([]byte("nope")))
+	assert.True(t, errors.Is(err, ErrInvalidLog))
+}
+
+// bodyHandler serves the request body of a v2 stream.
+type bodyHandler struct {
+	v2.DefaultImportsHandler
+}
+
+func (h *bodyHandler) GetHttpRequestBody() common.IoBuffer {
+	return common.NewIoBufferBytes([]byte("hello"))
+}
+
+// a v2 guest export reading the first bytes of the request body
+func onRequestBodyV2(g *fakeGuest, args ...interface{}) int32 {
+	res, err := g.callImport("proxy_get_buffer", int32(v2.BufferTypeHttpRequestBody), 1, 3, 4, 8)
+	if err != nil {
+		panic(err)
+	}
+	if res != int32(v2.ResultOk) {
+		return -1
+	}
+	addr := binary.LittleEndian.Uint32(g.mem[4:])
+	size := binary.LittleEndian.Uint32(g.mem[8:])
+	return int32(bytes.Compare(g.mem[addr:addr+size], []byte("ell")))
+}
+
+func TestRecordReplayV2(t *testing.T) {
+	var log bytes.Buffer
+
+	exports := map[string]func(g *fakeGuest, args ...interface{}) int32{
+		"proxy_on_request_body": onRequestBodyV2,
+	}
+
+	guest := newFakeGuest(exports)
+	guest.data = &v2.ABIContext{Imports: &bodyHandler{}, Instance: guest}
+	recorder := NewRecorder(guest, &log)
+	v2.RegisterImports(recorder)
+	assert.Nil(t, recorder.Start())
+
+	f, err := recorder.GetExportsFunc("proxy_on_request_body")
+	assert.Nil(t, err)
+	res, err := f.Call(int32(1), int32(5), int32(1))
+	assert.Nil(t, err)
+	assert.Equal(t, int32(0), res)
+
+	// the body is replayed from the log, without any handler
+	replayer, err := NewReplayer(newFakeGuest(exports), bytes.NewReader(log.Bytes()))
+	assert.Nil(t, err)
+	assert.Nil(t, replayer.RegisterImports())
+	assert.Nil(t, replayer.Run())
+}
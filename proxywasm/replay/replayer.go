@@ -0,0 +1,308 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package replay
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+)
+
+// Divergence describes the first point where the replayed plugin did not
+// behave as recorded.
+type Divergence struct {
+	// Record is the index of the log record that did not match.
+	Record int
+	// Export is the guest export being replayed, empty outside of export calls.
+	Export   string
+	Expected string
+	Actual   string
+}
+
+func (d *Divergence) Error() string {
+	where := "outside of any export call"
+	if d.Export != "" {
+		where = "in " + d.Export
+	}
+	return fmt.Sprintf("replay diverged at record %d %s: expected %s, got %s", d.Record, where, d.Expected, d.Actual)
+}
+
+// Replayer runs a module against a log written by a Recorder. The host imports
+// are replaced by stubs returning the recorded results and repeating the
+// recorded writes into guest memory, the guest exports are called with the
+// recorded arguments, and any difference is reported as a *Divergence.
+//
+// Note that WASI functions are provided by the engine and are not recorded, a
+// plugin depending on e.g. random_get may therefore not replay identically.
+type Replayer struct {
+	instance   common.WasmInstance
+	events     []*event
+	pos        int
+	export     string
+	divergence *Divergence
+}
+
+func NewReplayer(instance common.WasmInstance, r io.Reader) (*Replayer, error) {
+	events, err := readLog(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Replayer{instance: instance, events: events}, nil
+}
+
+// Len returns the number of records of the log.
+func (r *Replayer) Len() int {
+	return len(r.events)
+}
+
+// RegisterImports registers a stub for every import declared in the log, it is
+// used in place of v1.RegisterImports or v2.RegisterImports.
+func (r *Replayer) RegisterImports() error {
+	instanceType := reflect.TypeOf((*common.WasmInstance)(nil)).Elem()
+
+	for _, ev := range r.events {
+		if ev.tag != tagImport {
+			continue
+		}
+
+		in := []reflect.Type{instanceType}
+		for _, k := range ev.kinds {
+			in = append(in, typeOf(k))
+		}
+
+		out := make([]reflect.Type, 0, len(ev.rets))
+		for _, k := range ev.rets {
+			out = append(out, typeOf(k))
+		}
+
+		for _, t := range append(in[1:], out...) {
+			if t == nil {
+				return fmt.Errorf("%w: import %s has an unsupported type", ErrInvalidLog, ev.name)
+			}
+		}
+
+		name := ev.name
+		stub := reflect.MakeFunc(reflect.FuncOf(in, out, false), func(args []reflect.Value) []reflect.Value {
+			return r.invoke(name, args[1:], out)
+		})
+
+		if err := r.instance.RegisterFunc("env", name, stub.Interface()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Run replays the whole log. It returns a *Divergence if the plugin did not
+// behave as recorded.
+func (r *Replayer) Run() error {
+	for r.pos < len(r.events) {
+		ev := r.events[r.pos]
+		r.pos++
+
+		switch ev.tag {
+		case tagImport:
+		case tagStart:
+			if err := r.instance.Start(); err != nil {
+				return r.failure(err)
+			}
+		case tagCall:
+			if err := r.call(ev); err != nil {
+				return err
+			}
+		case tagMalloc, tagWrite:
+			r.pos--
+			if err := r.applyEffects(); err != nil {
+				return err
+			}
+		default:
+			return r.diverge(r.pos-1, describe(ev), "end of host activity")
+		}
+	}
+
+	return nil
+}
+
+func (r *Replayer) call(ev *event) error {
+	f, err := r.instance.GetExportsFunc(ev.name)
+	if err != nil {
+		return r.diverge(r.pos-1, "export "+ev.name, err.Error())
+	}
+
+	args := make([]interface{}, 0, len(ev.args))
+	for _, v := range ev.args {
+		args = append(args, v.goValue(nil).Interface())
+	}
+
+	r.export = ev.name
+	res, callErr := f.Call(args...)
+	if callErr != nil && r.divergence != nil {
+		return r.divergence
+	}
+
+	var out []Value
+	if res != nil {
+		out = append(out, valueOf(reflect.ValueOf(res)))
+	}
+
+	actual := formatReturn(out, callErr)
+
+	next := r.peek()
+	if next == nil || next.tag != tagReturn {
+		return r.diverge(r.pos, describe(next), actual)
+	}
+	r.pos++
+
+	if !valuesEqual(next.args, out) || (next.err == "") != (callErr == nil) {
+		expected := formatReturn(next.args, nil)
+		if next.err != "" {
+			expected = "error " + next.err
+		}
+		return r.diverge(r.pos-1, expected, actual)
+	}
+
+	r.export = ""
+
+	return nil
+}
+
+// invoke runs in place of the host import name.
+func (r *Replayer) invoke(name string, in []reflect.Value, out []reflect.Type) []reflect.Value {
+	if r.divergence != nil {
+		panic(r.divergence)
+	}
+
+	actual := formatInvoke(name, toValues(in))
+
+	ev := r.peek()
+	if ev == nil || ev.tag != tagInvoke || ev.name != name || !valuesEqual(ev.args, toValues(in)) {
+		panic(r.diverge(r.pos, describe(ev), actual))
+	}
+	r.pos++
+
+	if err := r.applyEffects(); err != nil {
+		panic(err)
+	}
+
+	ev = r.peek()
+	if ev == nil || ev.tag != tagResult || len(ev.args) != len(out) {
+		panic(r.diverge(r.pos, describe(ev), "result of "+actual))
+	}
+	r.pos++
+
+	res := make([]reflect.Value, 0, len(out))
+	for i, t := range out {
+		res = append(res, ev.args[i].goValue(t))
+	}
+
+	return res
+}
+
+// applyEffects repeats the recorded allocations and writes into guest memory.
+func (r *Replayer) applyEffects() error {
+	for ev := r.peek(); ev != nil; ev = r.peek() {
+		switch ev.tag {
+		case tagMalloc:
+			addr, err := r.instance.Malloc(int32(ev.size))
+			if err != nil {
+				return r.diverge(r.pos, describe(ev), "malloc error "+err.Error())
+			}
+			if addr != ev.addr {
+				return r.diverge(r.pos, describe(ev), fmt.Sprintf("malloc(%d) = %d", ev.size, addr))
+			}
+		case tagWrite:
+			if err := r.instance.PutMemory(ev.addr, uint64(len(ev.data)), ev.data); err != nil {
+				return r.diverge(r.pos, describe(ev), "write error "+err.Error())
+			}
+		default:
+			return nil
+		}
+		r.pos++
+	}
+
+	return nil
+}
+
+func (r *Replayer) peek() *event {
+	if r.pos >= len(r.events) {
+		return nil
+	}
+	return r.events[r.pos]
+}
+
+func (r *Replayer) diverge(record int, expected string, actual string) *Divergence {
+	if r.divergence == nil {
+		r.divergence = &Divergence{
+			Record:   record,
+			Export:   r.export,
+			Expected: expected,
+			Actual:   actual,
+		}
+	}
+	return r.divergence
+}
+
+func (r *Replayer) failure(err error) error {
+	if r.divergence != nil {
+		return r.divergence
+	}
+	return err
+}
+
+func describe(ev *event) string {
+	if ev == nil {
+		return "end of log"
+	}
+
+	switch ev.tag {
+	case tagInvoke:
+		return formatInvoke(ev.name, ev.args)
+	case tagReturn:
+		return formatReturn(ev.args, nil)
+	case tagCall:
+		return "call " + formatInvoke(ev.name, ev.args)
+	case tagMalloc:
+		return fmt.Sprintf("malloc(%d) = %d", ev.size, ev.addr)
+	case tagWrite:
+		return fmt.Sprintf("write of %d bytes at %d", len(ev.data), ev.addr)
+	}
+	return ev.tag.String()
+}
+
+func formatInvoke(name string, args []Value) string {
+	s := make([]string, 0, len(args))
+	for _, a := range args {
+		s = append(s, a.String())
+	}
+	return name + "(" + strings.Join(s, ", ") + ")"
+}
+
+func formatReturn(vs []Value, err error) string {
+	if err != nil {
+		return "error " + err.Error()
+	}
+	if len(vs) == 0 {
+		return "return"
+	}
+	return "return " + vs[0].String()
+}
@@ -54,30 +54,21 @@ func ProxyGetBufferBytes(instance common.WasmInstance, bufferType int32, start i
 		return WasmResultNotFound.Int32()
 	}
 
-	if start > start+length {
+	if start < 0 || length < 0 || int(start) > buf.Len() {
 		return WasmResultBadArgument.Int32()
 	}
 
-	if start+length > int32(buf.Len()) {
-		length = int32(buf.Len()) - start
-	}
-
-	addr, err := instance.Malloc(int32(length))
+	addr, size, err := common.CopyBufferIntoInstance(instance, buf, int(start), int(length))
 	if err != nil {
 		return WasmResultInvalidMemoryAccess.Int32()
 	}
 
-	err = instance.PutMemory(addr, uint64(length), buf.Bytes())
-	if err != nil {
-		return WasmResultInternalFailure.Int32()
-	}
-
 	err = instance.PutUint32(uint64(returnBufferData), uint32(addr))
 	if err != nil {
 		return WasmResultInvalidMemoryAccess.Int32()
 	}
 
-	err = instance.PutUint32(uint64(returnBufferSize), uint32(length))
+	err = instance.PutUint32(uint64(returnBufferSize), uint32(size))
 	if err != nil {
 		return WasmResultInvalidMemoryAccess.Int32()
 	}
@@ -96,19 +87,11 @@ func ProxySetBufferBytes(instance common.WasmInstance, bufferType int32, start i
 		return WasmResultInvalidMemoryAccess.Int32()
 	}
 
-	if start == 0 {
-		if length == 0 || int(length) >= buf.Len() {
-			buf.Drain(buf.Len())
-			_, err = buf.Write(content)
-		} else {
-			return WasmResultBadArgument.Int32()
-		}
-	} else if int(start) >= buf.Len() {
-		_, err = buf.Write(content)
-	} else {
+	if start < 0 || length < 0 {
 		return WasmResultBadArgument.Int32()
 	}
 
+	err = common.ReplaceBuffer(buf, int(start), int(length), content)
 	if err != nil {
 		return WasmResultInternalFailure.Int32()
 	}
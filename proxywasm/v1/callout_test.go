@@ -0,0 +1,325 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"mosn.io/proxy-wasm-go-host/proxywasm/callout"
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+)
+
+func TestHttpCallResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Auth", "ok")
+		_, _ = w.Write([]byte("allowed"))
+	}))
+	defer server.Close()
+
+	instance := newFakeInstance()
+	handler := &DefaultImportsHandler{HttpCallouts: callout.NewDispatcher(nil)}
+	ctx := &ABIContext{Imports: handler, Instance: instance}
+
+	upstream := server.Listener.Addr().String()
+	headers := common.EncodeMap(common.NewCommonHeader(
+		common.HeaderPair{Key: ":method", Value: "GET"},
+		common.HeaderPair{Key: ":path", Value: "/"},
+		common.HeaderPair{Key: ":authority", Value: "auth"},
+	))
+	copy(instance.mem[64:], upstream)
+	copy(instance.mem[128:], headers)
+
+	// the stream context sends a callout from proxy_on_request_headers
+	instance.exports["proxy_on_request_headers"] = func(args ...interface{}) (interface{}, error) {
+		res := ProxyHttpCall(instance, 64, int32(len(upstream)), 128, int32(len(headers)), 0, 0, 0, 0, 1000, 0)
+		assert.Equal(t, WasmResultOk.Int32(), res)
+		return int32(ActionPause), nil
+	}
+
+	instance.exports["proxy_on_context_create"] = func(args ...interface{}) (interface{}, error) {
+		return nil, nil
+	}
+
+	called := make(chan []interface{}, 1)
+	instance.exports["proxy_on_http_call_response"] = func(args ...interface{}) (interface{}, error) {
+		// the response is available through the handler while delivered
+		status, _ := handler.GetHttpCallResponseHeaders().Get(":status")
+		assert.Equal(t, "200", status)
+		assert.Equal(t, "allowed", string(handler.GetHttpCallResponseBody().Bytes()))
+		called <- args
+		return nil, nil
+	}
+
+	instance.Lock(ctx)
+	assert.Nil(t, ctx.ProxyOnContextCreate(1, 0))
+	assert.Nil(t, ctx.ProxyOnContextCreate(5, 1))
+	_, err := ctx.ProxyOnRequestHeaders(5, 0, 1)
+	instance.Unlock()
+	assert.Nil(t, err)
+
+	calloutID, _ := instance.GetUint32(0)
+
+	select {
+	case args := <-called:
+		// to the root context, :status, content-length, content-type, date and x-auth
+		assert.Equal(t, []interface{}{int32(1), int32(calloutID), int32(5), int32(7), int32(0)}, args)
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy_on_http_call_response not called")
+	}
+
+	// the response is released once delivered
+	instance.Lock(ctx)
+	assert.Nil(t, handler.GetHttpCallResponseHeaders())
+	instance.Unlock()
+}
+
+func TestHttpCallResponseDeletedContext(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+
+	instance := newFakeInstance()
+	policy := &callout.Policy{}
+	handler := &DefaultImportsHandler{HttpCallouts: callout.NewDispatcher(nil), CalloutPolicy: policy}
+	ctx := &ABIContext{Imports: handler, Instance: instance}
+
+	upstream := server.Listener.Addr().String()
+	headers := common.EncodeMap(common.NewCommonHeader(
+		common.HeaderPair{Key: ":method", Value: "GET"},
+		common.HeaderPair{Key: ":path", Value: "/"},
+		common.HeaderPair{Key: ":authority", Value: "auth"},
+	))
+	copy(instance.mem[64:], upstream)
+	copy(instance.mem[128:], headers)
+
+	instance.exports["proxy_on_context_create"] = func(args ...interface{}) (interface{}, error) {
+		return nil, nil
+	}
+	instance.exports["proxy_on_delete"] = func(args ...interface{}) (interface{}, error) {
+		return nil, nil
+	}
+	instance.exports["proxy_on_request_headers"] = func(args ...interface{}) (interface{}, error) {
+		res := ProxyHttpCall(instance, 64, int32(len(upstream)), 128, int32(len(headers)), 0, 0, 0, 0, 1000, 0)
+		assert.Equal(t, WasmResultOk.Int32(), res)
+		return int32(ActionPause), nil
+	}
+	called := make(chan struct{}, 1)
+	instance.exports["proxy_on_http_call_response"] = func(args ...interface{}) (interface{}, error) {
+		called <- struct{}{}
+		return nil, nil
+	}
+
+	instance.Lock(ctx)
+	assert.Nil(t, ctx.ProxyOnContextCreate(1, 0))
+	assert.Nil(t, ctx.ProxyOnContextCreate(5, 1))
+	_, err := ctx.ProxyOnRequestHeaders(5, 0, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, policy.InFlight())
+	// the root context goes away before the response arrives
+	assert.Nil(t, ctx.ProxyOnDelete(5))
+	assert.Nil(t, ctx.ProxyOnDelete(1))
+	instance.Unlock()
+	close(release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for policy.InFlight() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, 0, policy.InFlight())
+	assert.Empty(t, called)
+}
+
+// fakeGrpcTransport hands the deliver func of the last call to the test.
+type fakeGrpcTransport struct {
+	ctx      context.Context
+	req      *callout.GrpcRequest
+	deliver  func(ev *callout.GrpcEvent)
+	messages []string
+}
+
+func (t *fakeGrpcTransport) Open(ctx context.Context, req *callout.GrpcRequest, deliver func(ev *callout.GrpcEvent)) (callout.GrpcStream, error) {
+	t.ctx, t.req, t.deliver = ctx, req, deliver
+	return t, nil
+}
+
+func (t *fakeGrpcTransport) Send(msg []byte) error {
+	t.messages = append(t.messages, string(msg))
+	return nil
+}
+
+func (t *fakeGrpcTransport) CloseSend() error { return nil }
+
+func TestGrpcCallEvents(t *testing.T) {
+	transport := &fakeGrpcTransport{}
+	instance := newFakeInstance()
+	handler := &DefaultImportsHandler{GrpcCallouts: callout.NewGrpcDispatcher(transport)}
+	ctx := &ABIContext{Imports: handler, Instance: instance}
+
+	copy(instance.mem[64:], "authecho.EchoEchohello")
+
+	instance.exports["proxy_on_request_headers"] = func(args ...interface{}) (interface{}, error) {
+		res := ProxyGrpcCall(instance, 64, 4, 68, 9, 77, 4, 81, 5, 1000, 0)
+		assert.Equal(t, WasmResultOk.Int32(), res)
+		return int32(ActionPause), nil
+	}
+
+	instance.exports["proxy_on_context_create"] = func(args ...interface{}) (interface{}, error) {
+		return nil, nil
+	}
+
+	called := make(chan []interface{}, 4)
+	instance.exports["proxy_on_grpc_call_response_header_metadata"] = func(args ...interface{}) (interface{}, error) {
+		assert.NotNil(t, handler.GetGrpcReceiveInitialMetaData())
+		called <- args
+		return nil, nil
+	}
+	instance.exports["proxy_on_grpc_call_response_message"] = func(args ...interface{}) (interface{}, error) {
+		assert.Equal(t, "hello", string(handler.GetGrpcReceiveBuffer().Bytes()))
+		called <- args
+		return nil, nil
+	}
+	instance.exports["proxy_on_grpc_call_response_trailer_metadata"] = func(args ...interface{}) (interface{}, error) {
+		assert.NotNil(t, handler.GetGrpcReceiveTrailerMetaData())
+		called <- args
+		return nil, nil
+	}
+	instance.exports["proxy_on_grpc_call_close"] = func(args ...interface{}) (interface{}, error) {
+		called <- args
+		return nil, nil
+	}
+
+	instance.Lock(ctx)
+	assert.Nil(t, ctx.ProxyOnContextCreate(1, 0))
+	assert.Nil(t, ctx.ProxyOnContextCreate(5, 1))
+	_, err := ctx.ProxyOnRequestHeaders(5, 0, 1)
+	instance.Unlock()
+	assert.Nil(t, err)
+
+	assert.Equal(t, "auth", transport.req.Upstream)
+	assert.Equal(t, "echo.Echo", transport.req.Service)
+	assert.Equal(t, []string{"hello"}, transport.messages)
+	calloutID, _ := instance.GetUint32(0)
+
+	transport.deliver(&callout.GrpcEvent{Type: callout.GrpcHeaders, Metadata: common.NewCommonHeader()})
+	transport.deliver(&callout.GrpcEvent{Type: callout.GrpcMessage, Message: common.NewIoBufferBytes([]byte("hello"))})
+	transport.deliver(&callout.GrpcEvent{Type: callout.GrpcTrailers, Metadata: common.NewCommonHeader()})
+	transport.deliver(&callout.GrpcEvent{Type: callout.GrpcClose, Status: callout.GrpcStatusOk})
+
+	for _, expected := range [][]interface{}{
+		{int32(1), int32(calloutID), int32(0)},
+		{int32(1), int32(calloutID), int32(5)},
+		{int32(1), int32(calloutID), int32(0)},
+		{int32(1), int32(calloutID), callout.GrpcStatusOk},
+	} {
+		select {
+		case args := <-called:
+			assert.Equal(t, expected, args)
+		case <-time.After(5 * time.Second):
+			t.Fatal("grpc event not delivered")
+		}
+	}
+
+	// the call is over
+	instance.Lock(ctx)
+	assert.Equal(t, WasmResultNotFound.Int32(), ProxyCancelGrpcCall(instance, int32(calloutID)))
+	instance.Unlock()
+}
+
+func TestCalloutPolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	instance := newFakeInstance()
+	upstream := server.Listener.Addr().String()
+	policy := &callout.Policy{AllowedUpstreams: []string{upstream}, MaxInFlightPerContext: 1}
+	handler := &DefaultImportsHandler{HttpCallouts: callout.NewDispatcher(nil), CalloutPolicy: policy}
+	ctx := &ABIContext{Imports: handler, Instance: instance}
+
+	headers := common.EncodeMap(common.NewCommonHeader(
+		common.HeaderPair{Key: ":method", Value: "GET"},
+		common.HeaderPair{Key: ":path", Value: "/"},
+		common.HeaderPair{Key: ":authority", Value: "auth"},
+	))
+	copy(instance.mem[64:], upstream)
+	copy(instance.mem[128:], headers)
+	copy(instance.mem[256:], "billing")
+
+	instance.exports["proxy_on_request_headers"] = func(args ...interface{}) (interface{}, error) {
+		res := ProxyHttpCall(instance, 64, int32(len(upstream)), 128, int32(len(headers)), 0, 0, 0, 0, 1000, 0)
+		assert.Equal(t, WasmResultOk.Int32(), res)
+
+		// a single callout in flight per stream, to the allowed upstreams only
+		res = ProxyHttpCall(instance, 64, int32(len(upstream)), 128, int32(len(headers)), 0, 0, 0, 0, 1000, 0)
+		assert.Equal(t, WasmResultBadArgument.Int32(), res)
+		res = ProxyHttpCall(instance, 256, 7, 128, int32(len(headers)), 0, 0, 0, 0, 1000, 0)
+		assert.Equal(t, WasmResultBadArgument.Int32(), res)
+
+		return int32(ActionPause), nil
+	}
+
+	called := make(chan struct{}, 1)
+	instance.exports["proxy_on_http_call_response"] = func(args ...interface{}) (interface{}, error) {
+		called <- struct{}{}
+		return nil, nil
+	}
+
+	instance.Lock(ctx)
+	_, err := ctx.ProxyOnRequestHeaders(5, 0, 1)
+	instance.Unlock()
+	assert.Nil(t, err)
+
+	select {
+	case <-called:
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy_on_http_call_response not called")
+	}
+
+	// the callout is over once delivered
+	instance.Lock(ctx)
+	assert.Equal(t, 0, policy.InFlight())
+	instance.Unlock()
+}
+
+func TestGrpcCallInvalidMemory(t *testing.T) {
+	transport := &fakeGrpcTransport{}
+	instance := newFakeInstance()
+	policy := &callout.Policy{}
+	handler := &DefaultImportsHandler{GrpcCallouts: callout.NewGrpcDispatcher(transport), CalloutPolicy: policy}
+	ctx := &ABIContext{Imports: handler, Instance: instance}
+
+	copy(instance.mem[64:], "authecho.EchoEchohello")
+
+	// the id of the call can't be returned to the guest
+	instance.Lock(ctx)
+	assert.Equal(t, WasmResultInvalidMemoryAccess.Int32(), ProxyGrpcCall(instance, 64, 4, 68, 9, 77, 4, 81, 5, 0, 2000))
+	instance.Unlock()
+
+	select {
+	case <-transport.ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("grpc call not canceled")
+	}
+	assert.Equal(t, 0, policy.InFlight())
+}
@@ -38,6 +38,9 @@ type ContextHandler interface {
 type ABIContext struct {
 	Imports  ImportsHandler
 	Instance common.WasmInstance
+
+	// contextID is the context of the guest function being called.
+	contextID int32
 }
 
 func (a *ABIContext) Name() string {
@@ -0,0 +1,87 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+)
+
+func TestEffectiveContext(t *testing.T) {
+	instance := newFakeInstance()
+
+	rootHandler := &DefaultImportsHandler{}
+	httpHandler := &DefaultImportsHandler{}
+	root := &ABIContext{Imports: rootHandler, Instance: instance}
+	stream := &ABIContext{Imports: httpHandler, Instance: instance}
+
+	instance.exports["proxy_on_context_create"] = func(args ...interface{}) (interface{}, error) { return nil, nil }
+	instance.exports["proxy_on_delete"] = func(args ...interface{}) (interface{}, error) { return nil, nil }
+
+	instance.Lock(root)
+	assert.Nil(t, root.ProxyOnContextCreate(1, 0))
+	instance.Unlock()
+	instance.Lock(stream)
+	assert.Nil(t, stream.ProxyOnContextCreate(2, 1))
+	instance.Unlock()
+
+	rootContextID, ok := common.GetContextRegistry(instance).RootContextID(2)
+	assert.True(t, ok)
+	assert.Equal(t, int32(1), rootContextID)
+
+	// the root context switches to the stream context, e.g. to answer it
+	instance.exports["proxy_on_tick"] = func(args ...interface{}) (interface{}, error) {
+		assert.Equal(t, rootHandler, getImportHandler(instance))
+
+		assert.Equal(t, WasmResultOk.Int32(), ProxySetEffectiveContext(instance, 2))
+		ctx := getContextHandler(instance)
+		assert.Equal(t, httpHandler, getImportHandler(instance))
+		assert.Equal(t, int32(2), getCurrentContextID(ctx))
+		rootContextID, ok := getRootContextID(instance, ctx, httpHandler)
+		assert.True(t, ok)
+		assert.Equal(t, int32(1), rootContextID)
+
+		assert.Equal(t, WasmResultOk.Int32(), ProxySetEffectiveContext(instance, 1))
+		assert.Equal(t, rootHandler, getImportHandler(instance))
+
+		// unknown contexts are left to the handler
+		assert.Equal(t, WasmResultUnimplemented.Int32(), ProxySetEffectiveContext(instance, 9))
+		return nil, nil
+	}
+
+	instance.Lock(root)
+	assert.Nil(t, root.ProxyOnTick(1))
+	// the switch only lasts for the guest call
+	assert.Equal(t, root, instance.GetData())
+	instance.Unlock()
+
+	// deleted contexts are forgotten
+	instance.Lock(stream)
+	assert.Nil(t, stream.ProxyOnDelete(2))
+	instance.Unlock()
+	_, ok = common.LookupContext(instance, 2)
+	assert.False(t, ok)
+	assert.Equal(t, root, lookupContext(instance, 1, nil))
+
+	// the registry is dropped along with the instance
+	instance.Stop()
+	_, ok = common.LookupContext(instance, 1)
+	assert.False(t, ok)
+}
@@ -18,15 +18,56 @@
 package v1
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"mosn.io/proxy-wasm-go-host/proxywasm/callout"
 	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+	"mosn.io/proxy-wasm-go-host/proxywasm/metrics"
 )
 
-type DefaultImportsHandler struct{}
+type DefaultImportsHandler struct {
+	// MonotonicClock makes GetCurrentTimeNanoseconds return the nanoseconds
+	// elapsed on a monotonic clock since the host started, instead of the
+	// wall clock time since the Unix epoch.
+	MonotonicClock bool
+
+	// Properties is read by GetProperty and written by SetProperty, e.g. a
+	// store per stream whose parent is the store of the plugin.
+	Properties *common.PropertyStore
+
+	// Metrics holds the metrics defined by the plugin instance, e.g. a scope
+	// of a registry shared by all the plugins.
+	Metrics *metrics.Scope
+
+	// HttpCallouts sends the requests of HttpCall, their responses being
+	// delivered to the calling context through proxy_on_http_call_response.
+	HttpCallouts *callout.Dispatcher
+
+	// httpCallResponse is the callout response being delivered.
+	httpCallResponse *callout.Response
+
+	// GrpcCallouts runs the calls of GrpcCall and OpenGrpcStream, their
+	// events being delivered to the calling context through the
+	// proxy_on_grpc_call_* callbacks.
+	GrpcCallouts *callout.GrpcDispatcher
+
+	// grpcEvent is the gRPC event being delivered.
+	grpcEvent *callout.GrpcEvent
+
+	// CalloutPolicy bounds the HTTP and gRPC callouts of the plugin, it is
+	// shared by the handlers of the plugin.
+	CalloutPolicy *callout.Policy
+
+	// stream is resumed by the Resume* imports, see NewStream.
+	stream *Stream
+}
+
+// monotonicStart is the origin of the monotonic clock.
+var monotonicStart = time.Now()
 
 // for golang host environment, no-op
 func (d *DefaultImportsHandler) Wait() Action { return ActionContinue }
@@ -47,13 +88,17 @@ func (d *DefaultImportsHandler) SetEffectiveContextID(contextID int32) WasmResul
 	return WasmResultUnimplemented
 }
 
+// SetTickPeriodMilliseconds accepts the period, proxy_on_tick is then called
+// by the host at that rate.
 func (d *DefaultImportsHandler) SetTickPeriodMilliseconds(tickPeriodMilliseconds int32) WasmResult {
-	return WasmResultUnimplemented
+	return WasmResultOk
 }
 
-func (d *DefaultImportsHandler) GetCurrentTimeNanoseconds() (int32, WasmResult) {
-	nano := time.Now().Nanosecond()
-	return int32(nano), WasmResultOk
+func (d *DefaultImportsHandler) GetCurrentTimeNanoseconds() (int64, WasmResult) {
+	if d.MonotonicClock {
+		return int64(time.Since(monotonicStart)), WasmResultOk
+	}
+	return time.Now().UnixNano(), WasmResultOk
 }
 
 func (d *DefaultImportsHandler) Done() WasmResult { return WasmResultUnimplemented }
@@ -64,9 +109,19 @@ func (d *DefaultImportsHandler) GetDownStreamData() common.IoBuffer { return nil
 
 func (d *DefaultImportsHandler) GetUpstreamData() common.IoBuffer { return nil }
 
-func (d *DefaultImportsHandler) ResumeDownstream() WasmResult { return WasmResultUnimplemented }
+func (d *DefaultImportsHandler) ResumeDownstream() WasmResult {
+	if d.stream == nil {
+		return WasmResultUnimplemented
+	}
+	return d.stream.resume(directionRequest)
+}
 
-func (d *DefaultImportsHandler) ResumeUpstream() WasmResult { return WasmResultUnimplemented }
+func (d *DefaultImportsHandler) ResumeUpstream() WasmResult {
+	if d.stream == nil {
+		return WasmResultUnimplemented
+	}
+	return d.stream.resume(directionResponse)
+}
 
 // http
 
@@ -82,19 +137,72 @@ func (d *DefaultImportsHandler) GetHttpResponseBody() common.IoBuffer { return n
 
 func (d *DefaultImportsHandler) GetHttpResponseTrailer() common.HeaderMap { return nil }
 
-func (d *DefaultImportsHandler) GetHttpCallResponseHeaders() common.HeaderMap { return nil }
+func (d *DefaultImportsHandler) GetHttpCallResponseHeaders() common.HeaderMap {
+	if d.httpCallResponse == nil {
+		return nil
+	}
+	return d.httpCallResponse.Headers
+}
 
-func (d *DefaultImportsHandler) GetHttpCallResponseBody() common.IoBuffer { return nil }
+func (d *DefaultImportsHandler) GetHttpCallResponseBody() common.IoBuffer {
+	if d.httpCallResponse == nil {
+		return nil
+	}
+	return d.httpCallResponse.Body
+}
 
-func (d *DefaultImportsHandler) GetHttpCallResponseTrailer() common.HeaderMap { return nil }
+func (d *DefaultImportsHandler) GetHttpCallResponseTrailer() common.HeaderMap {
+	if d.httpCallResponse == nil {
+		return nil
+	}
+	return d.httpCallResponse.Trailers
+}
 
+// HttpCall sends the callout with HttpCallouts, url being the upstream name.
 func (d *DefaultImportsHandler) HttpCall(url string, headers common.HeaderMap, body common.IoBuffer, trailer common.HeaderMap, timeoutMilliseconds int32) (int32, WasmResult) {
-	return 0, WasmResultUnimplemented
+	if d.HttpCallouts == nil {
+		return 0, WasmResultUnimplemented
+	}
+	if timeoutMilliseconds < 0 {
+		return 0, WasmResultBadArgument
+	}
+
+	id, err := d.HttpCallouts.Dispatch(&callout.Request{
+		Upstream:        url,
+		Headers:         headers,
+		Body:            body.Bytes(),
+		Trailers:        trailer,
+		Timeout:         time.Duration(timeoutMilliseconds) * time.Millisecond,
+		MaxResponseSize: d.CalloutPolicy.ResponseLimit(),
+	})
+	if err != nil {
+		return 0, WasmResultBadArgument
+	}
+
+	return int32(id), WasmResultOk
 }
 
-func (d *DefaultImportsHandler) ResumeHttpRequest() WasmResult { return WasmResultUnimplemented }
+func (d *DefaultImportsHandler) httpCallouts() *callout.Dispatcher { return d.HttpCallouts }
 
-func (d *DefaultImportsHandler) ResumeHttpResponse() WasmResult { return WasmResultUnimplemented }
+func (d *DefaultImportsHandler) setHttpCallResponse(resp *callout.Response) {
+	d.httpCallResponse = resp
+}
+
+func (d *DefaultImportsHandler) ResumeHttpRequest() WasmResult {
+	if d.stream == nil {
+		return WasmResultUnimplemented
+	}
+	return d.stream.resume(directionRequest)
+}
+
+func (d *DefaultImportsHandler) ResumeHttpResponse() WasmResult {
+	if d.stream == nil {
+		return WasmResultUnimplemented
+	}
+	return d.stream.resume(directionResponse)
+}
+
+func (d *DefaultImportsHandler) setStream(s *Stream) { d.stream = s }
 
 func (d *DefaultImportsHandler) SendHttpResp(respCode int32, respCodeDetail common.IoBuffer, respBody common.IoBuffer, additionalHeaderMap common.HeaderMap, grpcCode int32) WasmResult {
 	return WasmResultUnimplemented
@@ -102,29 +210,109 @@ func (d *DefaultImportsHandler) SendHttpResp(respCode int32, respCodeDetail comm
 
 // grpc
 
+// OpenGrpcStream opens a stream with GrpcCallouts, grpcService being a
+// serialized GrpcService or the upstream name, see callout.GrpcUpstream.
 func (d *DefaultImportsHandler) OpenGrpcStream(grpcService string, serviceName string, method string) (int32, WasmResult) {
-	return 0, WasmResultUnimplemented
+	if d.GrpcCallouts == nil {
+		return 0, WasmResultUnimplemented
+	}
+
+	id, err := d.GrpcCallouts.Open(&callout.GrpcRequest{
+		Upstream:       callout.GrpcUpstream([]byte(grpcService)),
+		Service:        serviceName,
+		Method:         method,
+		MaxMessageSize: d.CalloutPolicy.ResponseLimit(),
+	})
+	if err != nil {
+		return 0, WasmResultBadArgument
+	}
+
+	return int32(id), WasmResultOk
 }
 
 func (d *DefaultImportsHandler) SendGrpcCallMsg(token int32, data common.IoBuffer, endOfStream int32) WasmResult {
-	return WasmResultUnimplemented
+	if d.GrpcCallouts == nil {
+		return WasmResultUnimplemented
+	}
+	return grpcResult(d.GrpcCallouts.Send(uint32(token), data.Bytes(), endOfStream != 0))
 }
 
 func (d *DefaultImportsHandler) CancelGrpcCall(token int32) WasmResult {
-	return WasmResultUnimplemented
+	if d.GrpcCallouts == nil {
+		return WasmResultUnimplemented
+	}
+	return grpcResult(d.GrpcCallouts.Cancel(uint32(token)))
 }
 
-func (d *DefaultImportsHandler) CloseGrpcCall(token int32) WasmResult { return WasmResultUnimplemented }
+// CloseGrpcCall ends the messages sent on the call, its response keeps being
+// delivered.
+func (d *DefaultImportsHandler) CloseGrpcCall(token int32) WasmResult {
+	if d.GrpcCallouts == nil {
+		return WasmResultUnimplemented
+	}
+	return grpcResult(d.GrpcCallouts.Close(uint32(token)))
+}
 
+// GrpcCall sends a unary call with GrpcCallouts, see OpenGrpcStream.
 func (d *DefaultImportsHandler) GrpcCall(grpcService string, serviceName string, method string, data common.IoBuffer, timeoutMilliseconds int32) (int32, WasmResult) {
-	return 0, WasmResultUnimplemented
+	if d.GrpcCallouts == nil {
+		return 0, WasmResultUnimplemented
+	}
+	if timeoutMilliseconds < 0 {
+		return 0, WasmResultBadArgument
+	}
+
+	id, err := d.GrpcCallouts.Call(&callout.GrpcRequest{
+		Upstream:       callout.GrpcUpstream([]byte(grpcService)),
+		Service:        serviceName,
+		Method:         method,
+		Timeout:        time.Duration(timeoutMilliseconds) * time.Millisecond,
+		MaxMessageSize: d.CalloutPolicy.ResponseLimit(),
+	}, data.Bytes())
+	if err != nil {
+		return 0, WasmResultBadArgument
+	}
+
+	return int32(id), WasmResultOk
 }
 
-func (d *DefaultImportsHandler) GetGrpcReceiveInitialMetaData() common.HeaderMap { return nil }
+func (d *DefaultImportsHandler) GetGrpcReceiveInitialMetaData() common.HeaderMap {
+	if d.grpcEvent == nil || d.grpcEvent.Type != callout.GrpcHeaders {
+		return nil
+	}
+	return d.grpcEvent.Metadata
+}
 
-func (d *DefaultImportsHandler) GetGrpcReceiveBuffer() common.IoBuffer { return nil }
+func (d *DefaultImportsHandler) GetGrpcReceiveBuffer() common.IoBuffer {
+	if d.grpcEvent == nil || d.grpcEvent.Type != callout.GrpcMessage {
+		return nil
+	}
+	return d.grpcEvent.Message
+}
+
+func (d *DefaultImportsHandler) GetGrpcReceiveTrailerMetaData() common.HeaderMap {
+	if d.grpcEvent == nil || d.grpcEvent.Type != callout.GrpcTrailers {
+		return nil
+	}
+	return d.grpcEvent.Metadata
+}
 
-func (d *DefaultImportsHandler) GetGrpcReceiveTrailerMetaData() common.HeaderMap { return nil }
+func (d *DefaultImportsHandler) grpcCallouts() *callout.GrpcDispatcher { return d.GrpcCallouts }
+
+func (d *DefaultImportsHandler) setGrpcEvent(ev *callout.GrpcEvent) { d.grpcEvent = ev }
+
+func (d *DefaultImportsHandler) calloutPolicy() *callout.Policy { return d.CalloutPolicy }
+
+func grpcResult(err error) WasmResult {
+	switch {
+	case err == nil:
+		return WasmResultOk
+	case errors.Is(err, callout.ErrCallNotFound):
+		return WasmResultNotFound
+	default:
+		return WasmResultBrokenConnection
+	}
+}
 
 // foreign
 
@@ -137,33 +325,92 @@ func (d *DefaultImportsHandler) GetFuncCallData() common.IoBuffer { return nil }
 // property
 
 func (d *DefaultImportsHandler) GetProperty(key string) (string, WasmResult) {
-	return "", WasmResultOk
+	if d.Properties == nil {
+		return "", WasmResultNotFound
+	}
+
+	value, ok, err := d.Properties.GetBytes(key)
+	if !ok {
+		return "", WasmResultNotFound
+	}
+	if err != nil {
+		return "", WasmResultSerializationFailure
+	}
+
+	return string(value), WasmResultOk
 }
 
+// SetProperty sets the property in Properties, as bytes.
 func (d *DefaultImportsHandler) SetProperty(key string, value string) WasmResult {
-	return WasmResultUnimplemented
+	if d.Properties == nil {
+		return WasmResultUnimplemented
+	}
+
+	d.Properties.Set(key, []byte(value))
+
+	return WasmResultOk
 }
 
 // metric
 
 func (d *DefaultImportsHandler) DefineMetric(metricType MetricType, name string) (int32, WasmResult) {
-	return 0, WasmResultUnimplemented
+	if d.Metrics == nil {
+		return 0, WasmResultUnimplemented
+	}
+
+	id, err := d.Metrics.Define(metrics.Type(metricType), name)
+	if err != nil {
+		return 0, metricResult(err)
+	}
+
+	return int32(id), WasmResultOk
 }
 
 func (d *DefaultImportsHandler) IncrementMetric(metricID int32, offset int64) WasmResult {
-	return WasmResultUnimplemented
+	if d.Metrics == nil {
+		return WasmResultUnimplemented
+	}
+
+	return metricResult(d.Metrics.Increment(uint32(metricID), offset))
 }
 
 func (d *DefaultImportsHandler) RecordMetric(metricID int32, value int64) WasmResult {
-	return WasmResultUnimplemented
+	if d.Metrics == nil {
+		return WasmResultUnimplemented
+	}
+
+	return metricResult(d.Metrics.Record(uint32(metricID), value))
 }
 
 func (d *DefaultImportsHandler) GetMetric(metricID int32) (int64, WasmResult) {
-	return 0, WasmResultUnimplemented
+	if d.Metrics == nil {
+		return 0, WasmResultUnimplemented
+	}
+
+	v, err := d.Metrics.Get(uint32(metricID))
+	if err != nil {
+		return 0, metricResult(err)
+	}
+
+	return v, WasmResultOk
 }
 
 func (d *DefaultImportsHandler) RemoveMetric(metricID int32) WasmResult {
-	return WasmResultUnimplemented
+	if d.Metrics == nil {
+		return WasmResultUnimplemented
+	}
+
+	return metricResult(d.Metrics.Remove(uint32(metricID)))
+}
+
+func metricResult(err error) WasmResult {
+	switch {
+	case err == nil:
+		return WasmResultOk
+	case errors.Is(err, metrics.ErrNotFound):
+		return WasmResultNotFound
+	}
+	return WasmResultBadArgument
 }
 
 // shared data
@@ -17,12 +17,27 @@
 
 package v1
 
+import "mosn.io/proxy-wasm-go-host/proxywasm/common"
+
 func (a *ABIContext) CallWasmFunction(funcName string, args ...interface{}) (interface{}, Action, error) {
 	ff, err := a.Instance.GetExportsFunc(funcName)
 	if err != nil {
 		return nil, ActionContinue, err
 	}
 
+	// the guest may switch context with proxy_set_effective_context, which
+	// only lasts for this call
+	data := a.Instance.GetData()
+	e, switched := data.(*effectiveContext)
+	if switched {
+		a.Instance.SetData(e.ContextHandler)
+	}
+	defer func() {
+		if _, ok := a.Instance.GetData().(*effectiveContext); ok || switched {
+			a.Instance.SetData(data)
+		}
+	}()
+
 	res, err := ff.Call(args...)
 	if err != nil {
 		a.Instance.HandleError(err)
@@ -35,16 +50,45 @@ func (a *ABIContext) CallWasmFunction(funcName string, args ...interface{}) (int
 	return res, action, nil
 }
 
+// callContextFunction calls a callback of the context contextID, its first
+// argument, which is the current context of the imports until it returns.
+func (a *ABIContext) callContextFunction(funcName string, contextID int32, args ...interface{}) (interface{}, Action, error) {
+	prev := a.contextID
+	a.contextID = contextID
+	defer func() { a.contextID = prev }()
+
+	return a.CallWasmFunction(funcName, append([]interface{}{contextID}, args...)...)
+}
+
+// callStreamFunction calls a callback whose result is the action to take on
+// the stream, e.g. proxy_on_request_headers, see Stream. A handler with
+// synchronous calls may still decide the action once they complete.
+func (a *ABIContext) callStreamFunction(funcName string, contextID int32, args ...interface{}) (Action, error) {
+	res, action, err := a.callContextFunction(funcName, contextID, args...)
+	if err != nil {
+		return ActionPause, err
+	}
+	if action != ActionContinue {
+		return action, nil
+	}
+
+	if v, ok := res.(int32); ok {
+		return Action(v), nil
+	}
+	return ActionContinue, nil
+}
+
 func (a *ABIContext) ProxyOnContextCreate(contextID int32, parentContextID int32) error {
-	_, _, err := a.CallWasmFunction("proxy_on_context_create", contextID, parentContextID)
+	_, _, err := a.callContextFunction("proxy_on_context_create", contextID, parentContextID)
 	if err != nil {
 		return err
 	}
+	common.GetContextRegistry(a.Instance).Register(contextID, parentContextID, a)
 	return nil
 }
 
 func (a *ABIContext) ProxyOnDone(contextID int32) (int32, error) {
-	res, _, err := a.CallWasmFunction("proxy_on_done", contextID)
+	res, _, err := a.callContextFunction("proxy_on_done", contextID)
 	if err != nil {
 		return 0, err
 	}
@@ -52,7 +96,7 @@ func (a *ABIContext) ProxyOnDone(contextID int32) (int32, error) {
 }
 
 func (a *ABIContext) ProxyOnLog(contextID int32) error {
-	_, _, err := a.CallWasmFunction("proxy_on_log", contextID)
+	_, _, err := a.callContextFunction("proxy_on_log", contextID)
 	if err != nil {
 		return err
 	}
@@ -60,7 +104,8 @@ func (a *ABIContext) ProxyOnLog(contextID int32) error {
 }
 
 func (a *ABIContext) ProxyOnVmStart(rootContextID int32, vmConfigurationSize int32) (int32, error) {
-	res, _, err := a.CallWasmFunction("proxy_on_vm_start", rootContextID, vmConfigurationSize)
+	a.registerRootContext(rootContextID)
+	res, _, err := a.callContextFunction("proxy_on_vm_start", rootContextID, vmConfigurationSize)
 	if err != nil {
 		return 0, err
 	}
@@ -68,7 +113,8 @@ func (a *ABIContext) ProxyOnVmStart(rootContextID int32, vmConfigurationSize int
 }
 
 func (a *ABIContext) ProxyOnDelete(contextID int32) error {
-	_, _, err := a.CallWasmFunction("proxy_on_delete", contextID)
+	_, _, err := a.callContextFunction("proxy_on_delete", contextID)
+	common.GetContextRegistry(a.Instance).Unregister(contextID)
 	if err != nil {
 		return err
 	}
@@ -76,7 +122,8 @@ func (a *ABIContext) ProxyOnDelete(contextID int32) error {
 }
 
 func (a *ABIContext) ProxyOnConfigure(rootContextID int32, configurationSize int32) (int32, error) {
-	res, _, err := a.CallWasmFunction("proxy_on_configure", rootContextID, configurationSize)
+	a.registerRootContext(rootContextID)
+	res, _, err := a.callContextFunction("proxy_on_configure", rootContextID, configurationSize)
 	if err != nil {
 		return 0, err
 	}
@@ -84,7 +131,7 @@ func (a *ABIContext) ProxyOnConfigure(rootContextID int32, configurationSize int
 }
 
 func (a *ABIContext) ProxyOnTick(rootContextID int32) error {
-	_, _, err := a.CallWasmFunction("proxy_on_tick", rootContextID)
+	_, _, err := a.callContextFunction("proxy_on_tick", rootContextID)
 	if err != nil {
 		return err
 	}
@@ -92,23 +139,15 @@ func (a *ABIContext) ProxyOnTick(rootContextID int32) error {
 }
 
 func (a *ABIContext) ProxyOnNewConnection(contextID int32) (Action, error) {
-	_, action, err := a.CallWasmFunction("proxy_on_new_connection", contextID)
-	if err != nil {
-		return ActionPause, err
-	}
-	return action, nil
+	return a.callStreamFunction("proxy_on_new_connection", contextID)
 }
 
 func (a *ABIContext) ProxyOnDownstreamData(contextID int32, dataLength int32, endOfStream int32) (Action, error) {
-	_, action, err := a.CallWasmFunction("proxy_on_downstream_data", contextID, dataLength, endOfStream)
-	if err != nil {
-		return ActionPause, err
-	}
-	return action, nil
+	return a.callStreamFunction("proxy_on_downstream_data", contextID, dataLength, endOfStream)
 }
 
 func (a *ABIContext) ProxyOnDownstreamConnectionClose(contextID int32, closeType int32) error {
-	_, _, err := a.CallWasmFunction("proxy_on_downstream_connection_close", contextID, closeType)
+	_, _, err := a.callContextFunction("proxy_on_downstream_connection_close", contextID, closeType)
 	if err != nil {
 		return err
 	}
@@ -116,15 +155,11 @@ func (a *ABIContext) ProxyOnDownstreamConnectionClose(contextID int32, closeType
 }
 
 func (a *ABIContext) ProxyOnUpstreamData(contextID int32, dataLength int32, endOfStream int32) (Action, error) {
-	_, action, err := a.CallWasmFunction("proxy_on_upstream_data", contextID, dataLength, endOfStream)
-	if err != nil {
-		return ActionPause, err
-	}
-	return action, nil
+	return a.callStreamFunction("proxy_on_upstream_data", contextID, dataLength, endOfStream)
 }
 
 func (a *ABIContext) ProxyOnUpstreamConnectionClose(contextID int32, closeType int32) error {
-	_, _, err := a.CallWasmFunction("proxy_on_upstream_connection_close", contextID, closeType)
+	_, _, err := a.callContextFunction("proxy_on_upstream_connection_close", contextID, closeType)
 	if err != nil {
 		return err
 	}
@@ -132,71 +167,39 @@ func (a *ABIContext) ProxyOnUpstreamConnectionClose(contextID int32, closeType i
 }
 
 func (a *ABIContext) ProxyOnRequestHeaders(contextID int32, numHeaders int32, endOfStream int32) (Action, error) {
-	_, action, err := a.CallWasmFunction("proxy_on_request_headers", contextID, numHeaders, endOfStream)
-	if err != nil {
-		return ActionPause, err
-	}
-	return action, nil
+	return a.callStreamFunction("proxy_on_request_headers", contextID, numHeaders, endOfStream)
 }
 
 func (a *ABIContext) ProxyOnRequestBody(contextID int32, bodyBufferLength int32, endOfStream int32) (Action, error) {
-	_, action, err := a.CallWasmFunction("proxy_on_request_body", contextID, bodyBufferLength, endOfStream)
-	if err != nil {
-		return ActionPause, err
-	}
-	return action, nil
+	return a.callStreamFunction("proxy_on_request_body", contextID, bodyBufferLength, endOfStream)
 }
 
 func (a *ABIContext) ProxyOnRequestTrailers(contextID int32, trailers int32) (Action, error) {
-	_, action, err := a.CallWasmFunction("proxy_on_request_trailers", contextID, trailers)
-	if err != nil {
-		return ActionPause, err
-	}
-	return action, nil
+	return a.callStreamFunction("proxy_on_request_trailers", contextID, trailers)
 }
 
 func (a *ABIContext) ProxyOnRequestMetadata(contextID int32, nElements int32) (Action, error) {
-	_, action, err := a.CallWasmFunction("proxy_on_request_metadata", contextID, nElements)
-	if err != nil {
-		return ActionPause, err
-	}
-	return action, nil
+	return a.callStreamFunction("proxy_on_request_metadata", contextID, nElements)
 }
 
 func (a *ABIContext) ProxyOnResponseHeaders(contextID int32, headers int32, endOfStream int32) (Action, error) {
-	_, action, err := a.CallWasmFunction("proxy_on_response_headers", contextID, headers, endOfStream)
-	if err != nil {
-		return ActionPause, err
-	}
-	return action, nil
+	return a.callStreamFunction("proxy_on_response_headers", contextID, headers, endOfStream)
 }
 
 func (a *ABIContext) ProxyOnResponseBody(contextID int32, bodyBufferLength int32, endOfStream int32) (Action, error) {
-	_, action, err := a.CallWasmFunction("proxy_on_response_body", contextID, bodyBufferLength, endOfStream)
-	if err != nil {
-		return ActionPause, err
-	}
-	return action, nil
+	return a.callStreamFunction("proxy_on_response_body", contextID, bodyBufferLength, endOfStream)
 }
 
 func (a *ABIContext) ProxyOnResponseTrailers(contextID int32, trailers int32) (Action, error) {
-	_, action, err := a.CallWasmFunction("proxy_on_response_trailers", contextID, trailers)
-	if err != nil {
-		return ActionPause, err
-	}
-	return action, nil
+	return a.callStreamFunction("proxy_on_response_trailers", contextID, trailers)
 }
 
 func (a *ABIContext) ProxyOnResponseMetadata(contextID int32, nElements int32) (Action, error) {
-	_, action, err := a.CallWasmFunction("proxy_on_response_metadata", contextID, nElements)
-	if err != nil {
-		return ActionPause, err
-	}
-	return action, nil
+	return a.callStreamFunction("proxy_on_response_metadata", contextID, nElements)
 }
 
 func (a *ABIContext) ProxyOnHttpCallResponse(contextID int32, token int32, headers int32, bodySize int32, trailers int32) error {
-	_, _, err := a.CallWasmFunction("proxy_on_http_call_response", contextID, token, headers, bodySize, trailers)
+	_, _, err := a.callContextFunction("proxy_on_http_call_response", contextID, token, headers, bodySize, trailers)
 	if err != nil {
 		return err
 	}
@@ -204,7 +207,7 @@ func (a *ABIContext) ProxyOnHttpCallResponse(contextID int32, token int32, heade
 }
 
 func (a *ABIContext) ProxyOnQueueReady(rootContextID int32, token int32) error {
-	_, _, err := a.CallWasmFunction("proxy_on_queue_ready", rootContextID, token)
+	_, _, err := a.callContextFunction("proxy_on_queue_ready", rootContextID, token)
 	if err != nil {
 		return err
 	}
@@ -220,7 +223,7 @@ func (a *ABIContext) ProxyOnMemoryAllocate(size int32) (int32, error) {
 }
 
 func (a *ABIContext) ProxyOnGrpcCallResponseHeaderMetadata(contextID int32, calloutID int32, nElements int32) error {
-	_, _, err := a.CallWasmFunction("proxy_on_grpc_call_response_header_metadata", contextID, calloutID, nElements)
+	_, _, err := a.callContextFunction("proxy_on_grpc_call_response_header_metadata", contextID, calloutID, nElements)
 	if err != nil {
 		return err
 	}
@@ -228,7 +231,7 @@ func (a *ABIContext) ProxyOnGrpcCallResponseHeaderMetadata(contextID int32, call
 }
 
 func (a *ABIContext) ProxyOnGrpcCallResponseMessage(contextID int32, calloutID int32, msgSize int32) error {
-	_, _, err := a.CallWasmFunction("proxy_on_grpc_call_response_message", contextID, calloutID, msgSize)
+	_, _, err := a.callContextFunction("proxy_on_grpc_call_response_message", contextID, calloutID, msgSize)
 	if err != nil {
 		return err
 	}
@@ -236,7 +239,7 @@ func (a *ABIContext) ProxyOnGrpcCallResponseMessage(contextID int32, calloutID i
 }
 
 func (a *ABIContext) ProxyOnGrpcCallResponseTrailerMetadata(contextID int32, calloutID int32, nElements int32) error {
-	_, _, err := a.CallWasmFunction("proxy_on_grpc_call_response_trailer_metadata", contextID, calloutID, nElements)
+	_, _, err := a.callContextFunction("proxy_on_grpc_call_response_trailer_metadata", contextID, calloutID, nElements)
 	if err != nil {
 		return err
 	}
@@ -244,9 +247,18 @@ func (a *ABIContext) ProxyOnGrpcCallResponseTrailerMetadata(contextID int32, cal
 }
 
 func (a *ABIContext) ProxyOnGrpcCallClose(contextID int32, calloutID int32, statusCode int32) error {
-	_, _, err := a.CallWasmFunction("proxy_on_grpc_call_close", contextID, calloutID, statusCode)
+	_, _, err := a.callContextFunction("proxy_on_grpc_call_close", contextID, calloutID, statusCode)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// registerRootContext registers rootContextID, given to the root context
+// callbacks, unless the host created it with proxy_on_context_create.
+func (a *ABIContext) registerRootContext(rootContextID int32) {
+	registry := common.GetContextRegistry(a.Instance)
+	if _, ok := registry.Get(rootContextID); !ok {
+		registry.Register(rootContextID, 0, a)
+	}
+}
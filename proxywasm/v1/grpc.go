@@ -18,6 +18,7 @@
 package v1
 
 import (
+	"mosn.io/proxy-wasm-go-host/proxywasm/callout"
 	"mosn.io/proxy-wasm-go-host/proxywasm/common"
 )
 
@@ -41,16 +42,31 @@ func ProxyOpenGrpcStream(instance common.WasmInstance, grpcServiceData int32, gr
 
 	ctx := getImportHandler(instance)
 
+	_, admission, err := admitCallout(instance, ctx, callout.GrpcUpstream(grpcService), 0)
+	if err != nil {
+		return WasmResultBadArgument.Int32()
+	}
+
 	calloutID, res := ctx.OpenGrpcStream(string(grpcService), string(serviceName), string(method))
 	if res != WasmResultOk {
+		admission.Done(nil)
 		return res.Int32()
 	}
 
 	err = instance.PutUint32(uint64(returnCalloutID), uint32(calloutID))
 	if err != nil {
+		cancelGrpcCall(ctx, calloutID)
+		admission.Done(nil)
 		return WasmResultInvalidMemoryAccess.Int32()
 	}
 
+	if handler := getContextHandler(instance); handler != nil {
+		awaitGrpcEvents(instance, handler, ctx, calloutID, admission)
+	} else {
+		cancelGrpcCall(ctx, calloutID)
+		admission.Done(nil)
+	}
+
 	return WasmResultOk.Int32()
 }
 
@@ -103,16 +119,31 @@ func ProxyGrpcCall(instance common.WasmInstance, grpcServiceData int32, grpcServ
 
 	ctx := getImportHandler(instance)
 
+	timeoutMilliseconds, admission, err := admitCallout(instance, ctx, callout.GrpcUpstream(grpcService), timeoutMilliseconds)
+	if err != nil {
+		return WasmResultBadArgument.Int32()
+	}
+
 	calloutID, res := ctx.GrpcCall(string(grpcService), string(serviceName), string(method),
 		common.NewIoBufferBytes(msg), timeoutMilliseconds)
 	if res != WasmResultOk {
+		admission.Done(nil)
 		return res.Int32()
 	}
 
 	err = instance.PutUint32(uint64(returnCalloutID), uint32(calloutID))
 	if err != nil {
+		cancelGrpcCall(ctx, calloutID)
+		admission.Done(nil)
 		return WasmResultInvalidMemoryAccess.Int32()
 	}
 
+	if handler := getContextHandler(instance); handler != nil {
+		awaitGrpcEvents(instance, handler, ctx, calloutID, admission)
+	} else {
+		cancelGrpcCall(ctx, calloutID)
+		admission.Done(nil)
+	}
+
 	return WasmResultOk.Int32()
 }
@@ -52,56 +52,7 @@ func ProxyGetHeaderMapPairs(instance common.WasmInstance, mapType int32, returnD
 		return WasmResultNotFound.Int32()
 	}
 
-	cloneMap := make(map[string]string)
-	totalBytesLen := 4
-	header.Range(func(key, value string) bool {
-		cloneMap[key] = value
-		totalBytesLen += 4 + 4                         // keyLen + valueLen
-		totalBytesLen += len(key) + 1 + len(value) + 1 // key + \0 + value + \0
-		return true
-	})
-
-	addr, err := instance.Malloc(int32(totalBytesLen))
-	if err != nil {
-		return WasmResultInvalidMemoryAccess.Int32()
-	}
-
-	err = instance.PutUint32(addr, uint32(len(cloneMap)))
-	if err != nil {
-		return WasmResultInvalidMemoryAccess.Int32()
-	}
-
-	lenPtr := addr + 4
-	dataPtr := lenPtr + uint64(8*len(cloneMap))
-
-	for k, v := range cloneMap {
-		_ = instance.PutUint32(lenPtr, uint32(len(k)))
-		lenPtr += 4
-		_ = instance.PutUint32(lenPtr, uint32(len(v)))
-		lenPtr += 4
-
-		_ = instance.PutMemory(dataPtr, uint64(len(k)), []byte(k))
-		dataPtr += uint64(len(k))
-		_ = instance.PutByte(dataPtr, 0)
-		dataPtr++
-
-		_ = instance.PutMemory(dataPtr, uint64(len(v)), []byte(v))
-		dataPtr += uint64(len(v))
-		_ = instance.PutByte(dataPtr, 0)
-		dataPtr++
-	}
-
-	err = instance.PutUint32(uint64(returnDataPtr), uint32(addr))
-	if err != nil {
-		return WasmResultInvalidMemoryAccess.Int32()
-	}
-
-	err = instance.PutUint32(uint64(returnDataSize), uint32(totalBytesLen))
-	if err != nil {
-		return WasmResultInvalidMemoryAccess.Int32()
-	}
-
-	return WasmResultOk.Int32()
+	return copyMapIntoInstance(instance, header, returnDataPtr, returnDataSize).Int32()
 }
 
 func ProxySetHeaderMapPairs(instance common.WasmInstance, mapType int32, ptr int32, size int32) int32 {
@@ -115,12 +66,21 @@ func ProxySetHeaderMapPairs(instance common.WasmInstance, mapType int32, ptr int
 		return WasmResultInvalidMemoryAccess.Int32()
 	}
 
-	newMap := common.DecodeMap(newMapContent)
-
-	for k, v := range newMap {
-		headerMap.Set(k, v)
+	newMap, err := common.DecodeMap(newMapContent)
+	if err != nil {
+		return WasmResultBadArgument.Int32()
 	}
 
+	// the pairs of a key replace all its previous values, keeping repeated keys
+	newMap.Range(func(key, _ string) bool {
+		headerMap.Del(key)
+		return true
+	})
+	newMap.Range(func(key, value string) bool {
+		headerMap.Add(key, value)
+		return true
+	})
+
 	return WasmResultOk.Int32()
 }
 
@@ -192,7 +152,7 @@ func ProxyAddHeaderMapValue(instance common.WasmInstance, mapType int32, keyData
 		return WasmResultInvalidMemoryAccess.Int32()
 	}
 
-	headerMap.Set(string(key), string(value))
+	headerMap.Add(string(key), string(value))
 
 	return WasmResultOk.Int32()
 }
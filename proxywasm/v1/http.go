@@ -51,14 +51,17 @@ func ProxySendHttpResponse(instance common.WasmInstance, respCode int32, respCod
 		return WasmResultInvalidMemoryAccess.Int32()
 	}
 
-	additionalHeaderMap := common.DecodeMap(additionalHeaderMapData)
+	additionalHeaderMap, err := common.DecodeMap(additionalHeaderMapData)
+	if err != nil {
+		return WasmResultBadArgument.Int32()
+	}
 
 	ctx := getImportHandler(instance)
 
 	return ctx.SendHttpResp(respCode,
 		common.NewIoBufferBytes(respCodeDetail),
 		common.NewIoBufferBytes(respBody),
-		common.CommonHeader(additionalHeaderMap), grpcStatus).Int32()
+		additionalHeaderMap, grpcStatus).Int32()
 }
 
 func ProxyHttpCall(instance common.WasmInstance, uriPtr int32, uriSize int32,
@@ -74,36 +77,60 @@ func ProxyHttpCall(instance common.WasmInstance, uriPtr int32, uriSize int32,
 	if err != nil {
 		return WasmResultInvalidMemoryAccess.Int32()
 	}
-	headerMap := common.DecodeMap(headerMapData)
+	headerMap, err := common.DecodeMap(headerMapData)
+	if err != nil {
+		return WasmResultBadArgument.Int32()
+	}
 
 	body, err := instance.GetMemory(uint64(bodyPtr), uint64(bodySize))
 	if err != nil {
 		return WasmResultInvalidMemoryAccess.Int32()
 	}
+	// the callout is sent once the import has returned and the guest may
+	// have reused its memory, the pairs are decoded into strings already
+	body = append([]byte(nil), body...)
 
 	trailerMapData, err := instance.GetMemory(uint64(trailerPairsPtr), uint64(trailerPairsSize))
 	if err != nil {
 		return WasmResultInvalidMemoryAccess.Int32()
 	}
-	trailerMap := common.DecodeMap(trailerMapData)
+	trailerMap, err := common.DecodeMap(trailerMapData)
+	if err != nil {
+		return WasmResultBadArgument.Int32()
+	}
 
 	ctx := getImportHandler(instance)
 
+	timeoutMilliseconds, admission, err := admitCallout(instance, ctx, string(url), timeoutMilliseconds)
+	if err != nil {
+		return WasmResultBadArgument.Int32()
+	}
+
 	calloutID, res := ctx.HttpCall(
 		string(url),
-		common.CommonHeader(headerMap),
+		headerMap,
 		common.NewIoBufferBytes(body),
-		common.CommonHeader(trailerMap),
+		trailerMap,
 		timeoutMilliseconds,
 	)
 	if res != WasmResultOk {
+		admission.Done(nil)
 		return res.Int32()
 	}
 
 	err = instance.PutUint32(uint64(calloutIDPtr), uint32(calloutID))
 	if err != nil {
+		cancelHttpCall(ctx, calloutID)
+		admission.Done(nil)
 		return WasmResultInvalidMemoryAccess.Int32()
 	}
 
+	if handler := getContextHandler(instance); handler != nil {
+		awaitHttpCallResponse(instance, handler, ctx, calloutID, admission)
+	} else {
+		cancelHttpCall(ctx, calloutID)
+		admission.Done(nil)
+	}
+
 	return WasmResultOk.Int32()
 }
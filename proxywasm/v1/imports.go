@@ -18,6 +18,8 @@
 package v1
 
 import (
+	"time"
+
 	"mosn.io/proxy-wasm-go-host/proxywasm/common"
 )
 
@@ -92,14 +94,50 @@ func ProxyLog(instance common.WasmInstance, level int32, logDataPtr int32, logDa
 	return callback.Log(LogLevel(level), string(logContent)).Int32()
 }
 
+// ProxySetEffectiveContext makes the following imports of the guest call in
+// progress act for contextID, e.g. from a root context handling the callout
+// made for an HTTP context. The contexts unknown to the registry of the
+// instance are left to the import handler.
 func ProxySetEffectiveContext(instance common.WasmInstance, contextID int32) int32 {
+	registry := common.GetContextRegistry(instance)
+	if v, ok := registry.Get(contextID); ok {
+		if ctx, ok := v.(ContextHandler); ok {
+			rootContextID, _ := registry.RootContextID(contextID)
+			instance.SetData(&effectiveContext{ContextHandler: ctx, contextID: contextID, rootContextID: rootContextID})
+			return WasmResultOk.Int32()
+		}
+	}
+
 	ctx := getImportHandler(instance)
 	return ctx.SetEffectiveContextID(contextID).Int32()
 }
 
 func ProxySetTickPeriodMilliseconds(instance common.WasmInstance, tickPeriodMilliseconds int32) int32 {
-	ctx := getImportHandler(instance)
-	return ctx.SetTickPeriodMilliseconds(tickPeriodMilliseconds).Int32()
+	if tickPeriodMilliseconds < 0 {
+		return WasmResultBadArgument.Int32()
+	}
+
+	ctx := getContextHandler(instance)
+	if ctx == nil {
+		return WasmResultInternalFailure.Int32()
+	}
+
+	im := getImportHandler(instance)
+
+	// the ticks are delivered to a root context
+	rootContextID, ok := getRootContextID(instance, ctx, im)
+	if !ok {
+		return WasmResultBadArgument.Int32()
+	}
+
+	res := im.SetTickPeriodMilliseconds(tickPeriodMilliseconds)
+	if res != WasmResultOk {
+		return res.Int32()
+	}
+
+	getTickScheduler(instance).set(ctx, rootContextID, time.Duration(tickPeriodMilliseconds)*time.Millisecond)
+
+	return WasmResultOk.Int32()
 }
 
 func ProxyGetCurrentTimeNanoseconds(instance common.WasmInstance, resultUint64Ptr int32) int32 {
@@ -110,7 +148,7 @@ func ProxyGetCurrentTimeNanoseconds(instance common.WasmInstance, resultUint64Pt
 		return res.Int32()
 	}
 
-	err := instance.PutUint32(uint64(resultUint64Ptr), uint32(nano))
+	err := instance.PutUint64(uint64(resultUint64Ptr), uint64(nano))
 	if err != nil {
 		return WasmResultInvalidMemoryAccess.Int32()
 	}
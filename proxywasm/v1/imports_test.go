@@ -0,0 +1,100 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+	"mosn.io/proxy-wasm-go-host/proxywasm/metrics"
+)
+
+func TestProxyGetCurrentTimeNanoseconds(t *testing.T) {
+	instance := newFakeInstance()
+
+	before := time.Now().UnixNano()
+	assert.Equal(t, WasmResultOk.Int32(), ProxyGetCurrentTimeNanoseconds(instance, 8))
+	after := time.Now().UnixNano()
+
+	nano, _ := instance.GetUint64(8)
+	assert.True(t, int64(nano) >= before && int64(nano) <= after)
+
+	ctx := &ABIContext{Imports: &DefaultImportsHandler{MonotonicClock: true}, Instance: instance}
+	instance.Lock(ctx)
+	defer instance.Unlock()
+
+	assert.Equal(t, WasmResultOk.Int32(), ProxyGetCurrentTimeNanoseconds(instance, 8))
+	first, _ := instance.GetUint64(8)
+	assert.Equal(t, WasmResultOk.Int32(), ProxyGetCurrentTimeNanoseconds(instance, 8))
+	second, _ := instance.GetUint64(8)
+	assert.True(t, second >= first)
+	assert.True(t, first < uint64(before))
+
+	assert.Equal(t, WasmResultInvalidMemoryAccess.Int32(), ProxyGetCurrentTimeNanoseconds(instance, 1020))
+}
+
+func TestProperties(t *testing.T) {
+	handler := &DefaultImportsHandler{}
+
+	_, res := handler.GetProperty("plugin_name")
+	assert.Equal(t, WasmResultNotFound, res)
+	assert.Equal(t, WasmResultUnimplemented, handler.SetProperty("plugin_name", "a"))
+
+	handler.Properties = common.NewPropertyStore(nil)
+	handler.Properties.Set("plugin_name", "my-plugin")
+	handler.Properties.Set("response\x00code", int64(200))
+
+	v, res := handler.GetProperty("plugin_name")
+	assert.Equal(t, WasmResultOk, res)
+	assert.Equal(t, "my-plugin", v)
+
+	v, res = handler.GetProperty("response\x00code")
+	assert.Equal(t, WasmResultOk, res)
+	assert.Equal(t, "\xc8\x00\x00\x00\x00\x00\x00\x00", v)
+
+	_, res = handler.GetProperty("missing")
+	assert.Equal(t, WasmResultNotFound, res)
+
+	assert.Equal(t, WasmResultOk, handler.SetProperty("filter_state\x00key", "value"))
+	v, _ = handler.GetProperty("filter_state\x00key")
+	assert.Equal(t, "value", v)
+}
+
+func TestMetrics(t *testing.T) {
+	handler := &DefaultImportsHandler{}
+
+	_, res := handler.DefineMetric(MetricTypeCounter, "requests")
+	assert.Equal(t, WasmResultUnimplemented, res)
+
+	handler.Metrics = metrics.NewRegistry().NewScope("plugin")
+
+	id, res := handler.DefineMetric(MetricTypeCounter, "requests")
+	assert.Equal(t, WasmResultOk, res)
+	assert.Equal(t, WasmResultOk, handler.IncrementMetric(id, 2))
+	assert.Equal(t, WasmResultBadArgument, handler.IncrementMetric(id, -1))
+
+	v, res := handler.GetMetric(id)
+	assert.Equal(t, WasmResultOk, res)
+	assert.Equal(t, int64(2), v)
+
+	assert.Equal(t, WasmResultOk, handler.RemoveMetric(id))
+	_, res = handler.GetMetric(id)
+	assert.Equal(t, WasmResultNotFound, res)
+}
@@ -66,7 +66,7 @@ type ImportsHandler interface {
 	GetRootContextID() int32
 	SetEffectiveContextID(contextID int32) WasmResult
 	SetTickPeriodMilliseconds(tickPeriodMilliseconds int32) WasmResult
-	GetCurrentTimeNanoseconds() (int32, WasmResult)
+	GetCurrentTimeNanoseconds() (int64, WasmResult)
 	Done() WasmResult
 
 	// config
@@ -134,7 +134,9 @@ type ImportsHandler interface {
 	DequeueSharedQueue(queueID uint32) (string, WasmResult)
 
 	// for golang host environment
-	// Wait until async call return, eg. sync http call in golang
+	// Wait until async call return, eg. sync http call in golang. Returning
+	// ActionContinue keeps the action of the plugin, the handlers with
+	// asynchronous calls letting the plugin pause the stream, see Stream.
 	Wait() Action
 
 	// custom extension
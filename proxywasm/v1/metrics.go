@@ -24,7 +24,7 @@ import (
 func ProxyDefineMetric(instance common.WasmInstance, metricType int32, namePtr int32, nameSize int32, returnMetricId int32) int32 {
 	ctx := getImportHandler(instance)
 
-	if MetricType(metricType) > MetricTypeMax {
+	if metricType < 0 || MetricType(metricType) > MetricTypeMax {
 		return WasmResultBadArgument.Int32()
 	}
 
@@ -73,7 +73,7 @@ func ProxyGetMetric(instance common.WasmInstance, metricId int32, resultUint64Pt
 		return res.Int32()
 	}
 
-	err := instance.PutUint32(uint64(resultUint64Ptr), uint32(value))
+	err := instance.PutUint64(uint64(resultUint64Ptr), uint64(value))
 	if err != nil {
 		return WasmResultInvalidMemoryAccess.Int32()
 	}
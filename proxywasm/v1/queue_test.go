@@ -0,0 +1,74 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueueReady(t *testing.T) {
+	instance := newFakeInstance()
+	root := &ABIContext{Imports: &DefaultImportsHandler{}, Instance: instance}
+
+	copy(instance.mem[64:], "my-queue")
+
+	// the root context registers the queue from proxy_on_vm_start
+	instance.exports["proxy_on_vm_start"] = func(args ...interface{}) (interface{}, error) {
+		assert.Equal(t, WasmResultOk.Int32(), ProxyRegisterSharedQueue(instance, 64, 8, 0))
+		return int32(1), nil
+	}
+
+	ready := make(chan [2]int32, 10)
+	instance.exports["proxy_on_queue_ready"] = func(args ...interface{}) (interface{}, error) {
+		// the owner is locked while notified
+		assert.Equal(t, root, instance.GetData())
+		ready <- [2]int32{args[0].(int32), args[1].(int32)}
+		return nil, nil
+	}
+
+	instance.Lock(root)
+	_, err := root.ProxyOnVmStart(3, 0)
+	instance.Unlock()
+	assert.Nil(t, err)
+
+	queueID, _ := instance.GetUint32(0)
+
+	// an other context enqueues two items
+	other := &ABIContext{Imports: &DefaultImportsHandler{}, Instance: instance}
+	instance.Lock(other)
+	assert.Equal(t, WasmResultOk.Int32(), ProxyEnqueueSharedQueue(instance, int32(queueID), 64, 2))
+	assert.Equal(t, WasmResultOk.Int32(), ProxyEnqueueSharedQueue(instance, int32(queueID), 66, 2))
+	instance.Unlock()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case v := <-ready:
+			assert.Equal(t, [2]int32{3, int32(queueID)}, v)
+		case <-time.After(time.Second):
+			t.Fatal("proxy_on_queue_ready not called")
+		}
+	}
+
+	instance.Lock(other)
+	assert.Equal(t, WasmResultOk.Int32(), ProxyRemoveSharedQueue(instance, int32(queueID)))
+	instance.Unlock()
+	assert.Nil(t, globalQueueOwners.get(queueID))
+}
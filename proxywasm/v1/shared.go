@@ -80,11 +80,21 @@ func ProxyRegisterSharedQueue(instance common.WasmInstance, queueNamePtr int32,
 		return WasmResultInvalidMemoryAccess.Int32()
 	}
 
+	// the registering root context is notified of the enqueued items
+	if handler := getContextHandler(instance); handler != nil {
+		if rootContextID, ok := getRootContextID(instance, handler, ctx); ok {
+			globalQueueOwners.set(queueID, instance, handler, rootContextID)
+		}
+	}
+
 	return WasmResultOk.Int32()
 }
 
 func ProxyRemoveSharedQueue(instance common.WasmInstance, queueID int32) int32 {
 	res := globalSharedQueueRegistry.delete(uint32(queueID))
+	if res == WasmResultOk {
+		globalQueueOwners.delete(uint32(queueID))
+	}
 	return res.Int32()
 }
 
@@ -131,7 +141,12 @@ func ProxyEnqueueSharedQueue(instance common.WasmInstance, token int32, dataPtr
 
 	ctx := getImportHandler(instance)
 
-	return ctx.EnqueueSharedQueue(uint32(token), string(value)).Int32()
+	res := ctx.EnqueueSharedQueue(uint32(token), string(value))
+	if res == WasmResultOk {
+		globalQueueOwners.notify(uint32(token))
+	}
+
+	return res.Int32()
 }
 
 func ProxyGetSharedData(instance common.WasmInstance, keyPtr int32, keySize int32, valuePtr int32, valueSizePtr int32, casPtr int32) int32 {
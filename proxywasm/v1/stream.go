@@ -0,0 +1,171 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1
+
+import (
+	"context"
+	"sync"
+)
+
+// direction is a direction of a stream, each being paused on its own.
+type direction int
+
+const (
+	// directionRequest is the HTTP request, or the downstream data.
+	directionRequest direction = iota
+	// directionResponse is the HTTP response, or the upstream data.
+	directionResponse
+)
+
+// Stream runs the callbacks of a stream context, e.g. an HTTP request. When a
+// callback pauses the stream, the instance is released to the other streams
+// while the call waits for the plugin to resume it, e.g. from the response of
+// a callout, through ResumeHttpRequest, ResumeHttpResponse, ResumeDownstream
+// or ResumeUpstream.
+type Stream struct {
+	ctx       *ABIContext
+	contextID int32
+
+	lock    sync.Mutex
+	resumed [2]chan struct{}
+}
+
+// streamHandler is implemented by the handlers embedding
+// DefaultImportsHandler, whose Resume* imports resume their stream.
+type streamHandler interface {
+	setStream(s *Stream)
+}
+
+// NewStream returns the stream of contextID, whose callbacks are run with
+// ctx, its handler resuming the stream if it embeds DefaultImportsHandler.
+func NewStream(ctx *ABIContext, contextID int32) *Stream {
+	s := &Stream{ctx: ctx, contextID: contextID}
+	if h, ok := ctx.Imports.(streamHandler); ok {
+		h.setStream(s)
+	}
+	return s
+}
+
+// OnRequestHeaders calls proxy_on_request_headers, and returns once the
+// request may carry on, waiting for the plugin if it paused the stream. The
+// wait ends with the error of c if it is done first.
+func (s *Stream) OnRequestHeaders(c context.Context, numHeaders int32, endOfStream bool) (Action, error) {
+	return s.run(c, directionRequest, false, func(e Exports) (Action, error) {
+		return e.ProxyOnRequestHeaders(s.contextID, numHeaders, boolToInt32(endOfStream))
+	})
+}
+
+// OnRequestBody calls proxy_on_request_body, see OnRequestHeaders. Before the
+// end of the stream ActionPause asks for more data, the body being buffered
+// by the caller until the next call.
+func (s *Stream) OnRequestBody(c context.Context, bodySize int32, endOfStream bool) (Action, error) {
+	return s.run(c, directionRequest, !endOfStream, func(e Exports) (Action, error) {
+		return e.ProxyOnRequestBody(s.contextID, bodySize, boolToInt32(endOfStream))
+	})
+}
+
+// OnRequestTrailers calls proxy_on_request_trailers, see OnRequestHeaders.
+func (s *Stream) OnRequestTrailers(c context.Context, numTrailers int32) (Action, error) {
+	return s.run(c, directionRequest, false, func(e Exports) (Action, error) {
+		return e.ProxyOnRequestTrailers(s.contextID, numTrailers)
+	})
+}
+
+// OnResponseHeaders calls proxy_on_response_headers, see OnRequestHeaders.
+func (s *Stream) OnResponseHeaders(c context.Context, numHeaders int32, endOfStream bool) (Action, error) {
+	return s.run(c, directionResponse, false, func(e Exports) (Action, error) {
+		return e.ProxyOnResponseHeaders(s.contextID, numHeaders, boolToInt32(endOfStream))
+	})
+}
+
+// OnResponseBody calls proxy_on_response_body, see OnRequestBody.
+func (s *Stream) OnResponseBody(c context.Context, bodySize int32, endOfStream bool) (Action, error) {
+	return s.run(c, directionResponse, !endOfStream, func(e Exports) (Action, error) {
+		return e.ProxyOnResponseBody(s.contextID, bodySize, boolToInt32(endOfStream))
+	})
+}
+
+// OnResponseTrailers calls proxy_on_response_trailers, see OnRequestHeaders.
+func (s *Stream) OnResponseTrailers(c context.Context, numTrailers int32) (Action, error) {
+	return s.run(c, directionResponse, false, func(e Exports) (Action, error) {
+		return e.ProxyOnResponseTrailers(s.contextID, numTrailers)
+	})
+}
+
+// OnDownstreamData calls proxy_on_downstream_data, see OnRequestBody.
+func (s *Stream) OnDownstreamData(c context.Context, dataLength int32, endOfStream bool) (Action, error) {
+	return s.run(c, directionRequest, !endOfStream, func(e Exports) (Action, error) {
+		return e.ProxyOnDownstreamData(s.contextID, dataLength, boolToInt32(endOfStream))
+	})
+}
+
+// OnUpstreamData calls proxy_on_upstream_data, see OnRequestBody.
+func (s *Stream) OnUpstreamData(c context.Context, dataLength int32, endOfStream bool) (Action, error) {
+	return s.run(c, directionResponse, !endOfStream, func(e Exports) (Action, error) {
+		return e.ProxyOnUpstreamData(s.contextID, dataLength, boolToInt32(endOfStream))
+	})
+}
+
+// run calls f with the instance locked, then waits for the stream to be
+// resumed if f paused it, unless buffering.
+func (s *Stream) run(c context.Context, dir direction, buffering bool, f func(e Exports) (Action, error)) (Action, error) {
+	var resumed chan struct{}
+
+	s.ctx.Instance.Lock(s.ctx)
+	action, err := f(s.ctx.GetExports())
+	if err == nil && action == ActionPause && !buffering {
+		// waited for before the instance is released, the plugin resuming
+		// the stream with the instance locked
+		resumed = make(chan struct{})
+		s.lock.Lock()
+		s.resumed[dir] = resumed
+		s.lock.Unlock()
+	}
+	s.ctx.Instance.Unlock()
+
+	if resumed == nil {
+		return action, err
+	}
+
+	select {
+	case <-resumed:
+		return ActionContinue, nil
+	case <-c.Done():
+		return ActionPause, c.Err()
+	}
+}
+
+// resume resumes the direction dir of the stream if paused.
+func (s *Stream) resume(dir direction) WasmResult {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if resumed := s.resumed[dir]; resumed != nil {
+		close(resumed)
+		s.resumed[dir] = nil
+	}
+
+	return WasmResultOk
+}
+
+func boolToInt32(b bool) int32 {
+	if b {
+		return 1
+	}
+	return 0
+}
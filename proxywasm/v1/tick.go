@@ -0,0 +1,160 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1
+
+import (
+	"sync"
+	"time"
+
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+)
+
+// ticker calls proxy_on_tick for a root context until it is stopped.
+type ticker struct {
+	rootContextID int32
+	ctx           ContextHandler
+	stop          chan struct{}
+}
+
+// tickScheduler calls proxy_on_tick for the root contexts of an instance.
+// It is dropped, along with its tickers, once the instance stops.
+type tickScheduler struct {
+	instance common.WasmInstance
+
+	lock    sync.Mutex
+	tickers map[int32]*ticker
+	stopped bool
+}
+
+var tickSchedulers = struct {
+	sync.Mutex
+	m map[common.WasmInstance]*tickScheduler
+}{m: make(map[common.WasmInstance]*tickScheduler)}
+
+// getTickScheduler returns the tick scheduler of instance, creating it on
+// first use.
+func getTickScheduler(instance common.WasmInstance) *tickScheduler {
+	tickSchedulers.Lock()
+	s, ok := tickSchedulers.m[instance]
+	if !ok {
+		s = &tickScheduler{instance: instance, tickers: make(map[int32]*ticker)}
+		tickSchedulers.m[instance] = s
+	}
+	tickSchedulers.Unlock()
+
+	if !ok {
+		instance.OnStop(s.stopAll)
+	}
+
+	return s
+}
+
+// set replaces the tick period of the root context, a zero period stops the ticks.
+// It does not wait for a running tick, so it can be called from within proxy_on_tick.
+func (s *tickScheduler) set(ctx ContextHandler, rootContextID int32, period time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if t, ok := s.tickers[rootContextID]; ok {
+		close(t.stop)
+		delete(s.tickers, rootContextID)
+	}
+
+	if period <= 0 || s.stopped {
+		return
+	}
+
+	t := &ticker{rootContextID: rootContextID, ctx: ctx, stop: make(chan struct{})}
+	s.tickers[rootContextID] = t
+
+	go t.run(s, period)
+}
+
+// stopAll stops the ticks of all the root contexts and drops the scheduler.
+func (s *tickScheduler) stopAll() {
+	tickSchedulers.Lock()
+	if tickSchedulers.m[s.instance] == s {
+		delete(tickSchedulers.m, s.instance)
+	}
+	tickSchedulers.Unlock()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.stopped = true
+	for rootContextID, t := range s.tickers {
+		close(t.stop)
+		delete(s.tickers, rootContextID)
+	}
+}
+
+func (s *tickScheduler) remove(t *ticker) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.tickers[t.rootContextID] == t {
+		close(t.stop)
+		delete(s.tickers, t.rootContextID)
+	}
+}
+
+func (t *ticker) run(s *tickScheduler, period time.Duration) {
+	tk := time.NewTicker(period)
+	defer tk.Stop()
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-tk.C:
+			if !t.tick(s.instance) {
+				// the instance has been stopped
+				s.remove(t)
+				return
+			}
+		}
+	}
+}
+
+// tick calls proxy_on_tick on the handler of the root context, serialized
+// with the other calls into the instance.
+func (t *ticker) tick(instance common.WasmInstance) bool {
+	ctx := lookupContext(instance, t.rootContextID, t.ctx)
+	return common.InvokeLocked(instance, ctx, func() {
+		// the period may have changed while waiting for the instance
+		select {
+		case <-t.stop:
+			return
+		default:
+		}
+
+		_ = ctx.GetExports().ProxyOnTick(t.rootContextID)
+	})
+}
+
+// StopTicks stops calling proxy_on_tick for all the root contexts of
+// instance. The ticks also stop once instance has been stopped.
+func StopTicks(instance common.WasmInstance) {
+	tickSchedulers.Lock()
+	s, ok := tickSchedulers.m[instance]
+	tickSchedulers.Unlock()
+
+	if ok {
+		s.stopAll()
+	}
+}
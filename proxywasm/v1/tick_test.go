@@ -0,0 +1,230 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v1
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+)
+
+// fakeInstance is a WasmInstance whose exports are Go funcs.
+type fakeInstance struct {
+	common.WasmInstance // unused methods panic
+	lock                sync.Mutex
+	data                interface{}
+	stopped             int32
+	hookLock            sync.Mutex
+	stopHooks           []func()
+	mem                 []byte
+	exports             map[string]fakeFunction
+}
+
+func newFakeInstance() *fakeInstance {
+	return &fakeInstance{
+		mem:     make([]byte, 1024),
+		exports: make(map[string]fakeFunction),
+	}
+}
+
+type fakeFunction func(args ...interface{}) (interface{}, error)
+
+func (f fakeFunction) Call(args ...interface{}) (interface{}, error) { return f(args...) }
+
+func (i *fakeInstance) GetExportsFunc(funcName string) (common.WasmFunction, error) {
+	if f, ok := i.exports[funcName]; ok {
+		return f, nil
+	}
+	return nil, errors.New("export not found")
+}
+
+func (i *fakeInstance) Acquire() bool { return atomic.LoadInt32(&i.stopped) == 0 }
+
+func (i *fakeInstance) Release() {}
+
+func (i *fakeInstance) Lock(data interface{}) {
+	i.lock.Lock()
+	i.data = data
+}
+
+func (i *fakeInstance) Unlock() {
+	i.data = nil
+	i.lock.Unlock()
+}
+
+func (i *fakeInstance) GetData() interface{} { return i.data }
+
+func (i *fakeInstance) SetData(data interface{}) { i.data = data }
+
+func (i *fakeInstance) HandleError(err error) {}
+
+func (i *fakeInstance) Stop() {
+	atomic.StoreInt32(&i.stopped, 1)
+
+	i.hookLock.Lock()
+	hooks := i.stopHooks
+	i.stopHooks = nil
+	i.hookLock.Unlock()
+
+	for _, f := range hooks {
+		f()
+	}
+}
+
+func (i *fakeInstance) OnStop(f func()) {
+	i.hookLock.Lock()
+	if atomic.LoadInt32(&i.stopped) == 0 {
+		i.stopHooks = append(i.stopHooks, f)
+		i.hookLock.Unlock()
+		return
+	}
+	i.hookLock.Unlock()
+
+	f()
+}
+
+func (i *fakeInstance) GetMemory(addr uint64, size uint64) ([]byte, error) {
+	if addr+size > uint64(len(i.mem)) {
+		return nil, errors.New("addr overflow")
+	}
+	return i.mem[addr : addr+size], nil
+}
+
+func (i *fakeInstance) GetUint32(addr uint64) (uint32, error) {
+	if addr+4 > uint64(len(i.mem)) {
+		return 0, errors.New("addr overflow")
+	}
+	return binary.LittleEndian.Uint32(i.mem[addr:]), nil
+}
+
+func (i *fakeInstance) PutUint32(addr uint64, value uint32) error {
+	if addr+4 > uint64(len(i.mem)) {
+		return errors.New("addr overflow")
+	}
+	binary.LittleEndian.PutUint32(i.mem[addr:], value)
+	return nil
+}
+
+func (i *fakeInstance) GetUint64(addr uint64) (uint64, error) {
+	if addr+8 > uint64(len(i.mem)) {
+		return 0, errors.New("addr overflow")
+	}
+	return binary.LittleEndian.Uint64(i.mem[addr:]), nil
+}
+
+func (i *fakeInstance) PutUint64(addr uint64, value uint64) error {
+	if addr+8 > uint64(len(i.mem)) {
+		return errors.New("addr overflow")
+	}
+	binary.LittleEndian.PutUint64(i.mem[addr:], value)
+	return nil
+}
+
+func tickerCount(instance common.WasmInstance) int {
+	tickSchedulers.Lock()
+	s, ok := tickSchedulers.m[instance]
+	tickSchedulers.Unlock()
+	if !ok {
+		return 0
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.tickers)
+}
+
+func TestTickPeriod(t *testing.T) {
+	instance := newFakeInstance()
+	ctx := &ABIContext{Imports: &DefaultImportsHandler{}, Instance: instance}
+
+	instance.exports["proxy_on_vm_start"] = func(args ...interface{}) (interface{}, error) {
+		assert.Equal(t, WasmResultOk.Int32(), ProxySetTickPeriodMilliseconds(instance, 5))
+		return int32(1), nil
+	}
+
+	ticks := make(chan int32, 10)
+	count := 0
+	instance.exports["proxy_on_tick"] = func(args ...interface{}) (interface{}, error) {
+		ticks <- args[0].(int32)
+		// the guest stops the ticks from within proxy_on_tick
+		if count++; count == 3 {
+			assert.Equal(t, WasmResultOk.Int32(), ProxySetTickPeriodMilliseconds(instance, 0))
+		}
+		return nil, nil
+	}
+
+	instance.Lock(ctx)
+	_, err := ctx.ProxyOnVmStart(7, 0)
+	instance.Unlock()
+	assert.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case id := <-ticks:
+			assert.Equal(t, int32(7), id)
+		case <-time.After(time.Second):
+			t.Fatal("proxy_on_tick not called")
+		}
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Empty(t, ticks)
+	assert.Equal(t, 0, tickerCount(instance))
+
+	instance.Lock(ctx)
+	assert.Equal(t, WasmResultBadArgument.Int32(), ProxySetTickPeriodMilliseconds(instance, -1))
+	// outside of a known root context
+	assert.Equal(t, WasmResultBadArgument.Int32(), ProxySetTickPeriodMilliseconds(instance, 5))
+	instance.Unlock()
+	assert.Equal(t, 0, tickerCount(instance))
+}
+
+func TestTickStopOnShutdown(t *testing.T) {
+	instance := newFakeInstance()
+	ctx := &ABIContext{Imports: &DefaultImportsHandler{}, Instance: instance}
+
+	ticks := make(chan int32, 100)
+	instance.exports["proxy_on_tick"] = func(args ...interface{}) (interface{}, error) {
+		ticks <- args[0].(int32)
+		return nil, nil
+	}
+
+	getTickScheduler(instance).set(ctx, 1, time.Millisecond)
+	getTickScheduler(instance).set(ctx, 2, time.Millisecond)
+	assert.Equal(t, 2, tickerCount(instance))
+
+	<-ticks
+	StopTicks(instance)
+	assert.Equal(t, 0, tickerCount(instance))
+
+	// the scheduler is dropped once the instance stops
+	getTickScheduler(instance).set(ctx, 3, time.Millisecond)
+	assert.Equal(t, 1, tickerCount(instance))
+	instance.Stop()
+	assert.Equal(t, 0, tickerCount(instance))
+
+	getTickScheduler(instance).set(ctx, 4, time.Millisecond)
+	assert.Equal(t, 0, tickerCount(instance))
+}
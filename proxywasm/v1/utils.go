@@ -67,6 +67,49 @@ func copyBytesIntoInstance(instance common.WasmInstance, value []byte, retPtr in
 	return WasmResultOk
 }
 
+func copyMapIntoInstance(instance common.WasmInstance, m common.HeaderMap, retPtr int32, retSize int32) WasmResult {
+	addr, size, err := common.CopyMapIntoInstance(instance, m)
+	if err != nil {
+		return WasmResultInvalidMemoryAccess
+	}
+
+	err = instance.PutUint32(uint64(retPtr), uint32(addr))
+	if err != nil {
+		return WasmResultInvalidMemoryAccess
+	}
+
+	err = instance.PutUint32(uint64(retSize), uint32(size))
+	if err != nil {
+		return WasmResultInvalidMemoryAccess
+	}
+
+	return WasmResultOk
+}
+
+// effectiveContext is the data of an instance whose guest switched to the
+// context contextID with proxy_set_effective_context.
+type effectiveContext struct {
+	ContextHandler
+	contextID     int32
+	rootContextID int32
+}
+
+// lookupContext returns the handler registered for contextID in instance,
+// or fallback if there is none.
+func lookupContext(instance common.WasmInstance, contextID int32, fallback ContextHandler) ContextHandler {
+	if v, ok := common.LookupContext(instance, contextID); ok {
+		if ctx, ok := v.(ContextHandler); ok {
+			return ctx
+		}
+	}
+
+	if e, ok := fallback.(*effectiveContext); ok {
+		return e.ContextHandler
+	}
+
+	return fallback
+}
+
 func getContextHandler(instance common.WasmInstance) ContextHandler {
 	if v := instance.GetData(); v != nil {
 		if im, ok := v.(ContextHandler); ok {
@@ -77,6 +120,32 @@ func getContextHandler(instance common.WasmInstance) ContextHandler {
 	return nil
 }
 
+// getCurrentContextID returns the ID of the context the guest is being called
+// for, or 0 if it is unknown.
+func getCurrentContextID(ctx ContextHandler) int32 {
+	if e, ok := ctx.(*effectiveContext); ok {
+		return e.contextID
+	}
+	if a, ok := ctx.(*ABIContext); ok {
+		return a.contextID
+	}
+
+	return 0
+}
+
+// getRootContextID returns the root context of the guest call in progress,
+// false if it is unknown, i.e. neither given by the handler nor registered.
+func getRootContextID(instance common.WasmInstance, ctx ContextHandler, im ImportsHandler) (int32, bool) {
+	if e, ok := ctx.(*effectiveContext); ok {
+		return e.rootContextID, true
+	}
+	if rootContextID := im.GetRootContextID(); rootContextID != 0 {
+		return rootContextID, true
+	}
+
+	return common.GetContextRegistry(instance).RootContextID(getCurrentContextID(ctx))
+}
+
 func getImportHandler(instance common.WasmInstance) ImportsHandler {
 	if ctx := getContextHandler(instance); ctx != nil {
 		if im := ctx.GetImports(); im != nil {
@@ -0,0 +1,218 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v2
+
+import (
+	"time"
+
+	"mosn.io/proxy-wasm-go-host/proxywasm/callout"
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+)
+
+// httpCalloutHandler is implemented by the handlers embedding
+// DefaultImportsHandler, whose callout responses are delivered by the host.
+type httpCalloutHandler interface {
+	httpCallouts() *callout.Dispatcher
+	setHttpCallResponse(resp *callout.Response)
+}
+
+// awaitHttpCallResponse schedules proxy_on_http_call_response on the root
+// context of the caller once the response of the callout arrives.
+func awaitHttpCallResponse(instance common.WasmInstance, ctx ContextHandler, im ImportsHandler, calloutID uint32, admission *callout.Admission) {
+	h, ok := im.(httpCalloutHandler)
+	if !ok || h.httpCallouts() == nil {
+		admission.Done(nil)
+		return
+	}
+
+	contextID, registered := calloutContext(instance, ctx, im)
+	events := common.NewEventQueue(instance)
+
+	ok = h.httpCallouts().OnResponse(calloutID, func(resp *callout.Response) {
+		drop := func() { admission.Done(resp.Err) }
+
+		ctx, ok := deliveryContext(instance, contextID, registered, ctx)
+		if !ok {
+			drop()
+			return
+		}
+		posted := events.PostOrDrop(ctx, func() {
+			defer admission.Done(resp.Err)
+
+			// the guest reads it from the handler of the context it runs in
+			dh := h
+			if ch, ok := ctx.GetImports().(httpCalloutHandler); ok {
+				dh = ch
+			}
+			dh.setHttpCallResponse(resp)
+			defer dh.setHttpCallResponse(nil)
+
+			_ = ctx.GetExports().ProxyOnHttpCallResponse(contextID, int32(calloutID),
+				int32(resp.Headers.Len()), int32(resp.Body.Len()), int32(resp.Trailers.Len()))
+		}, drop)
+		if !posted {
+			drop()
+		}
+	})
+	if !ok {
+		admission.Done(nil)
+	}
+}
+
+// calloutContext returns the root context of ctx, which gets the callbacks of
+// the callouts it issues as with Envoy, and whether it is registered, the
+// callbacks of a registered context being dropped once it is deleted.
+func calloutContext(instance common.WasmInstance, ctx ContextHandler, im ImportsHandler) (int32, bool) {
+	contextID := getCurrentContextID(ctx)
+	if rootContextID, ok := common.GetContextRegistry(instance).RootContextID(contextID); ok {
+		contextID = rootContextID
+	}
+
+	_, registered := common.LookupContext(instance, contextID)
+	return contextID, registered
+}
+
+// deliveryContext returns the handler a callback of contextID is delivered
+// to, false if contextID was registered and has been deleted since.
+func deliveryContext(instance common.WasmInstance, contextID int32, registered bool, fallback ContextHandler) (ContextHandler, bool) {
+	if !registered {
+		return lookupContext(instance, contextID, fallback), true
+	}
+
+	v, ok := common.LookupContext(instance, contextID)
+	if !ok {
+		return nil, false
+	}
+	ctx, ok := v.(ContextHandler)
+	return ctx, ok
+}
+
+// cancelHttpCall cancels a callout whose response can't be delivered, e.g.
+// when its id could not be written into guest memory.
+func cancelHttpCall(im ImportsHandler, calloutID uint32) {
+	if h, ok := im.(httpCalloutHandler); ok && h.httpCallouts() != nil {
+		h.httpCallouts().Cancel(calloutID)
+	}
+}
+
+// grpcCalloutHandler is implemented by the handlers embedding
+// DefaultImportsHandler, whose gRPC events are delivered by the host.
+type grpcCalloutHandler interface {
+	grpcCallouts() *callout.GrpcDispatcher
+	setGrpcEvent(ev *callout.GrpcEvent)
+}
+
+// cancelGrpcCall cancels a gRPC call whose events can't be delivered, e.g.
+// when its id could not be written into guest memory.
+func cancelGrpcCall(im ImportsHandler, calloutID uint32) {
+	if h, ok := im.(grpcCalloutHandler); ok && h.grpcCallouts() != nil {
+		_ = h.grpcCallouts().Cancel(calloutID)
+	}
+}
+
+// awaitGrpcEvents schedules the proxy_on_grpc_call_* callbacks on the root
+// context of the caller, in order, as the events of the call arrive.
+func awaitGrpcEvents(instance common.WasmInstance, ctx ContextHandler, im ImportsHandler, calloutID uint32, admission *callout.Admission) {
+	h, ok := im.(grpcCalloutHandler)
+	if !ok || h.grpcCallouts() == nil {
+		admission.Done(nil)
+		return
+	}
+
+	contextID, registered := calloutContext(instance, ctx, im)
+	events := common.NewEventQueue(instance)
+
+	ok = h.grpcCallouts().OnEvent(calloutID, func(ev *callout.GrpcEvent) {
+		// the call ends with the first event which can't be delivered
+		drop := func() {
+			admission.Done(ev.Err)
+			// the dispatcher is locked while the event is given
+			go func() { _ = h.grpcCallouts().Cancel(calloutID) }()
+		}
+
+		ctx, ok := deliveryContext(instance, contextID, registered, ctx)
+		if !ok {
+			drop()
+			return
+		}
+		posted := events.PostOrDrop(ctx, func() {
+			if ev.Type == callout.GrpcClose {
+				defer admission.Done(ev.Err)
+			}
+
+			// the call may have been canceled since the event was posted
+			if ev.Canceled() {
+				return
+			}
+
+			// the guest reads it from the handler of the context it runs in
+			dh := h
+			if ch, ok := ctx.GetImports().(grpcCalloutHandler); ok {
+				dh = ch
+			}
+			dh.setGrpcEvent(ev)
+			defer dh.setGrpcEvent(nil)
+
+			exports := ctx.GetExports()
+			switch ev.Type {
+			case callout.GrpcHeaders:
+				_ = exports.ProxyOnGrpcCallResponseHeaderMetadata(int32(calloutID), int32(ev.Metadata.Len()))
+			case callout.GrpcMessage:
+				_ = exports.ProxyOnGrpcCallResponseMessage(int32(calloutID), int32(ev.Message.Len()))
+			case callout.GrpcTrailers:
+				_ = exports.ProxyOnGrpcCallResponseTrailerMetadata(int32(calloutID), int32(ev.Metadata.Len()))
+			case callout.GrpcClose:
+				_ = exports.ProxyOnGrpcCallClose(int32(calloutID), ev.Status)
+			}
+		}, drop)
+		if !posted {
+			drop()
+		}
+	})
+	if !ok {
+		admission.Done(nil)
+	}
+}
+
+// calloutPolicyHandler is implemented by the handlers embedding
+// DefaultImportsHandler, whose callouts are bounded by a policy.
+type calloutPolicyHandler interface {
+	calloutPolicy() *callout.Policy
+}
+
+// admitCallout checks a callout to upstream against the policy of im,
+// returning the timeout it must use. The imports fail the rejected callouts
+// with NotAllowed.
+func admitCallout(instance common.WasmInstance, im ImportsHandler, upstream string, timeoutMilliseconds uint32) (uint32, *callout.Admission, error) {
+	var policy *callout.Policy
+	if h, ok := im.(calloutPolicyHandler); ok {
+		policy = h.calloutPolicy()
+	}
+
+	var contextID int32
+	if ctx := getContextHandler(instance); ctx != nil {
+		contextID = getCurrentContextID(ctx)
+	}
+
+	timeout, admission, err := policy.Admit(instance, contextID, upstream, time.Duration(timeoutMilliseconds)*time.Millisecond)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return uint32(timeout / time.Millisecond), admission, nil
+}
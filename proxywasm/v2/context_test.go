@@ -0,0 +1,85 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v2
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+)
+
+func TestEffectiveContext(t *testing.T) {
+	instance := newFakeInstance()
+
+	pluginHandler := &DefaultImportsHandler{}
+	httpHandler := &DefaultImportsHandler{}
+	plugin := &ABIContext{Imports: pluginHandler, Instance: instance}
+	stream := &ABIContext{Imports: httpHandler, Instance: instance}
+
+	instance.exports["proxy_on_context_create"] = func(args ...interface{}) (interface{}, error) { return nil, nil }
+	instance.exports["proxy_on_done"] = func(args ...interface{}) (interface{}, error) { return int32(1), nil }
+
+	instance.Lock(plugin)
+	assert.Nil(t, plugin.ProxyOnContextCreate(1, 0, ContextTypePluginContext))
+	instance.Unlock()
+	instance.Lock(stream)
+	assert.Nil(t, stream.ProxyOnContextCreate(2, 1, ContextTypeHttpContext))
+	instance.Unlock()
+
+	rootContextID, ok := common.GetContextRegistry(instance).RootContextID(2)
+	assert.True(t, ok)
+	assert.Equal(t, int32(1), rootContextID)
+
+	// the plugin context switches to the stream context, e.g. to answer it
+	instance.exports["proxy_on_timer_ready"] = func(args ...interface{}) (interface{}, error) {
+		assert.Equal(t, pluginHandler, getImportHandler(instance))
+
+		assert.Equal(t, ResultOk, ProxySetEffectiveContext(instance, 2))
+		ctx := getContextHandler(instance)
+		assert.Equal(t, httpHandler, getImportHandler(instance))
+		assert.Equal(t, int32(2), getCurrentContextID(ctx))
+
+		assert.Equal(t, ResultOk, ProxySetEffectiveContext(instance, 1))
+		assert.Equal(t, pluginHandler, getImportHandler(instance))
+
+		// unknown contexts are left to the handler
+		assert.Equal(t, ResultUnimplemented, ProxySetEffectiveContext(instance, 9))
+		return nil, nil
+	}
+
+	instance.Lock(plugin)
+	assert.Nil(t, plugin.ProxyOnTimerReady(3))
+	// the switch only lasts for the guest call
+	assert.Equal(t, plugin, instance.GetData())
+	instance.Unlock()
+
+	// the contexts which are done are forgotten
+	instance.Lock(stream)
+	_, err := stream.ProxyOnDone(2)
+	assert.Nil(t, err)
+	instance.Unlock()
+	_, ok = common.LookupContext(instance, 2)
+	assert.False(t, ok)
+	assert.Equal(t, plugin, lookupContext(instance, 1, nil))
+
+	// the registry is dropped along with the instance
+	instance.Stop()
+	_, ok = common.LookupContext(instance, 1)
+	assert.False(t, ok)
+}
@@ -17,9 +17,42 @@
 
 package v2
 
-import "mosn.io/proxy-wasm-go-host/proxywasm/common"
+import (
+	"errors"
+	"sync"
+	"time"
 
-type DefaultImportsHandler struct{}
+	"mosn.io/proxy-wasm-go-host/proxywasm/callout"
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+	"mosn.io/proxy-wasm-go-host/proxywasm/metrics"
+)
+
+type DefaultImportsHandler struct {
+	// Metrics holds the metrics defined by the plugin instance, e.g. a scope
+	// of a registry shared by all the plugins.
+	Metrics *metrics.Scope
+
+	// HttpCallouts sends the requests of DispatchHttpCall, their responses
+	// being delivered to the calling context through proxy_on_http_call_response.
+	HttpCallouts *callout.Dispatcher
+
+	// httpCallResponse is the callout response being delivered.
+	httpCallResponse *callout.Response
+
+	// GrpcCallouts runs the calls of DispatchGrpcCall and OpenGrpcStream,
+	// their events being delivered through the proxy_on_grpc_call_* callbacks.
+	GrpcCallouts *callout.GrpcDispatcher
+
+	// grpcEvent is the gRPC event being delivered.
+	grpcEvent *callout.GrpcEvent
+
+	// CalloutPolicy bounds the HTTP and gRPC callouts of the plugin, it is
+	// shared by the handlers of the plugin.
+	CalloutPolicy *callout.Policy
+
+	// stream is resumed by the Resume* imports, see NewStream.
+	stream *Stream
+}
 
 func (d *DefaultImportsHandler) Wait() Action { return ActionContinue }
 
@@ -31,13 +64,35 @@ func (d *DefaultImportsHandler) SetEffectiveContext(contextID int32) Result {
 
 func (d *DefaultImportsHandler) ContextFinalize() Result { return ResultUnimplemented }
 
-func (d *DefaultImportsHandler) ResumeDownStream() Result { return ResultUnimplemented }
+func (d *DefaultImportsHandler) ResumeDownStream() Result {
+	if d.stream == nil {
+		return ResultUnimplemented
+	}
+	return d.stream.resume(directionRequest)
+}
+
+func (d *DefaultImportsHandler) ResumeUpStream() Result {
+	if d.stream == nil {
+		return ResultUnimplemented
+	}
+	return d.stream.resume(directionResponse)
+}
 
-func (d *DefaultImportsHandler) ResumeUpStream() Result { return ResultUnimplemented }
+func (d *DefaultImportsHandler) ResumeHttpRequest() Result {
+	if d.stream == nil {
+		return ResultUnimplemented
+	}
+	return d.stream.resume(directionRequest)
+}
 
-func (d *DefaultImportsHandler) ResumeHttpRequest() Result { return ResultUnimplemented }
+func (d *DefaultImportsHandler) ResumeHttpResponse() Result {
+	if d.stream == nil {
+		return ResultUnimplemented
+	}
+	return d.stream.resume(directionResponse)
+}
 
-func (d *DefaultImportsHandler) ResumeHttpResponse() Result { return ResultUnimplemented }
+func (d *DefaultImportsHandler) setStream(s *Stream) { d.stream = s }
 
 func (d *DefaultImportsHandler) ResumeCustomStream(streamType StreamType) Result {
 	return ResultUnimplemented
@@ -67,13 +122,24 @@ func (d *DefaultImportsHandler) GetDownStreamData() common.IoBuffer { return nil
 
 func (d *DefaultImportsHandler) GetUpstreamData() common.IoBuffer { return nil }
 
-func (d *DefaultImportsHandler) GetHttpCalloutResponseBody() common.IoBuffer { return nil }
+func (d *DefaultImportsHandler) GetHttpCalloutResponseBody() common.IoBuffer {
+	if d.httpCallResponse == nil {
+		return nil
+	}
+	return d.httpCallResponse.Body
+}
 
 func (d *DefaultImportsHandler) GetPluginConfig() common.IoBuffer { return nil }
 
 func (d *DefaultImportsHandler) GetVmConfig() common.IoBuffer { return nil }
 
-func (d *DefaultImportsHandler) GetCustomBuffer(bufferType BufferType) common.IoBuffer { return nil }
+// GetCustomBuffer serves the message of the gRPC event being delivered.
+func (d *DefaultImportsHandler) GetCustomBuffer(bufferType BufferType) common.IoBuffer {
+	if bufferType != BufferTypeGrpcReceiveBuffer || d.grpcEvent == nil || d.grpcEvent.Type != callout.GrpcMessage {
+		return nil
+	}
+	return d.grpcEvent.Message
+}
 
 func (d *DefaultImportsHandler) GetHttpRequestHeader() common.HeaderMap { return nil }
 
@@ -87,13 +153,36 @@ func (d *DefaultImportsHandler) GetHttpResponseTrailer() common.HeaderMap { retu
 
 func (d *DefaultImportsHandler) GetHttpResponseMetadata() common.HeaderMap { return nil }
 
-func (d *DefaultImportsHandler) GetHttpCallResponseHeaders() common.HeaderMap { return nil }
+func (d *DefaultImportsHandler) GetHttpCallResponseHeaders() common.HeaderMap {
+	if d.httpCallResponse == nil {
+		return nil
+	}
+	return d.httpCallResponse.Headers
+}
 
-func (d *DefaultImportsHandler) GetHttpCallResponseTrailer() common.HeaderMap { return nil }
+func (d *DefaultImportsHandler) GetHttpCallResponseTrailer() common.HeaderMap {
+	if d.httpCallResponse == nil {
+		return nil
+	}
+	return d.httpCallResponse.Trailers
+}
 
 func (d *DefaultImportsHandler) GetHttpCallResponseMetadata() common.HeaderMap { return nil }
 
-func (d *DefaultImportsHandler) GetCustomMap(mapType MapType) common.HeaderMap { return nil }
+// GetCustomMap serves the metadata of the gRPC event being delivered.
+func (d *DefaultImportsHandler) GetCustomMap(mapType MapType) common.HeaderMap {
+	if d.grpcEvent == nil {
+		return nil
+	}
+
+	switch {
+	case mapType == MapTypeGrpcReceiveInitialMetadata && d.grpcEvent.Type == callout.GrpcHeaders,
+		mapType == MapTypeGrpcReceiveTrailingMetadata && d.grpcEvent.Type == callout.GrpcTrailers:
+		return d.grpcEvent.Metadata
+	default:
+		return nil
+	}
+}
 
 func (d *DefaultImportsHandler) OpenSharedKvstore(kvstoreName string, createIfNotExist bool) (uint32, Result) {
 	return 0, ResultUnimplemented
@@ -104,19 +193,120 @@ func (d *DefaultImportsHandler) DeleteSharedKvstore(kvstoreID uint32) Result {
 	return ResultUnimplemented
 }
 
+// shared queue
+
+type sharedQueue struct {
+	id    uint32
+	name  string
+	lock  sync.Mutex
+	queue []string
+}
+
+func (s *sharedQueue) enqueue(value string) Result {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.queue = append(s.queue, value)
+
+	return ResultOk
+}
+
+func (s *sharedQueue) dequeue() (string, Result) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.queue) == 0 {
+		return "", ResultEmpty
+	}
+
+	v := s.queue[0]
+	s.queue = s.queue[1:]
+
+	return v, ResultOk
+}
+
+type sharedQueueRegistry struct {
+	lock             sync.RWMutex
+	nameToIDMap      map[string]uint32
+	m                map[uint32]*sharedQueue
+	queueIDGenerator uint32
+}
+
+func (s *sharedQueueRegistry) open(queueName string, createIfNotExist bool) (uint32, Result) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if queueID, ok := s.nameToIDMap[queueName]; ok {
+		return queueID, ResultOk
+	}
+
+	if !createIfNotExist {
+		return 0, ResultNotFound
+	}
+
+	s.queueIDGenerator++
+	newQueueID := s.queueIDGenerator
+	s.nameToIDMap[queueName] = newQueueID
+	s.m[newQueueID] = &sharedQueue{
+		id:   newQueueID,
+		name: queueName,
+	}
+
+	return newQueueID, ResultOk
+}
+
+func (s *sharedQueueRegistry) delete(queueID uint32) Result {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	queue, ok := s.m[queueID]
+	if !ok {
+		return ResultNotFound
+	}
+
+	delete(s.nameToIDMap, queue.name)
+	delete(s.m, queueID)
+
+	return ResultOk
+}
+
+func (s *sharedQueueRegistry) get(queueID uint32) *sharedQueue {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.m[queueID]
+}
+
+var globalSharedQueueRegistry = &sharedQueueRegistry{
+	nameToIDMap: make(map[string]uint32),
+	m:           make(map[uint32]*sharedQueue),
+}
+
 func (d *DefaultImportsHandler) OpenSharedQueue(queueName string, createIfNotExist bool) (uint32, Result) {
-	return 0, ResultUnimplemented
+	return globalSharedQueueRegistry.open(queueName, createIfNotExist)
 }
 
 func (d *DefaultImportsHandler) DequeueSharedQueueItem(queueID uint32) (string, Result) {
-	return "", ResultUnimplemented
+	queue := globalSharedQueueRegistry.get(queueID)
+	if queue == nil {
+		return "", ResultNotFound
+	}
+
+	return queue.dequeue()
 }
 
 func (d *DefaultImportsHandler) EnqueueSharedQueueItem(queueID uint32, payload string) Result {
-	return ResultUnimplemented
+	queue := globalSharedQueueRegistry.get(queueID)
+	if queue == nil {
+		return ResultNotFound
+	}
+
+	return queue.enqueue(payload)
 }
 
-func (d *DefaultImportsHandler) DeleteSharedQueue(queueID uint32) Result { return ResultUnimplemented }
+func (d *DefaultImportsHandler) DeleteSharedQueue(queueID uint32) Result {
+	return globalSharedQueueRegistry.delete(queueID)
+}
 
 func (d *DefaultImportsHandler) CreateTimer(period int32, oneTime bool) (uint32, Result) {
 	return 0, ResultUnimplemented
@@ -125,45 +315,187 @@ func (d *DefaultImportsHandler) CreateTimer(period int32, oneTime bool) (uint32,
 func (d *DefaultImportsHandler) DeleteTimer(timerID uint32) Result { return ResultUnimplemented }
 
 func (d *DefaultImportsHandler) CreateMetric(metricType MetricType, metricName string) (uint32, Result) {
-	return 0, ResultUnimplemented
+	if d.Metrics == nil {
+		return 0, ResultUnimplemented
+	}
+
+	var t metrics.Type
+	switch metricType {
+	case MetricTypeCounter:
+		t = metrics.Counter
+	case MetricTypeGauge:
+		t = metrics.Gauge
+	case MetricTypeHistogram:
+		t = metrics.Histogram
+	default:
+		return 0, ResultBadArgument
+	}
+
+	id, err := d.Metrics.Define(t, metricName)
+	if err != nil {
+		return 0, metricResult(err)
+	}
+
+	return id, ResultOk
 }
 
 func (d *DefaultImportsHandler) GetMetricValue(metricID uint32) (int64, Result) {
-	return 0, ResultUnimplemented
+	if d.Metrics == nil {
+		return 0, ResultUnimplemented
+	}
+
+	v, err := d.Metrics.Get(metricID)
+	if err != nil {
+		return 0, metricResult(err)
+	}
+
+	return v, ResultOk
 }
 
 func (d *DefaultImportsHandler) SetMetricValue(metricID uint32, value int64) Result {
-	return ResultUnimplemented
+	if d.Metrics == nil {
+		return ResultUnimplemented
+	}
+
+	return metricResult(d.Metrics.Record(metricID, value))
 }
 
 func (d *DefaultImportsHandler) IncrementMetricValue(metricID uint32, offset int64) Result {
-	return ResultUnimplemented
+	if d.Metrics == nil {
+		return ResultUnimplemented
+	}
+
+	return metricResult(d.Metrics.Increment(metricID, offset))
+}
+
+func (d *DefaultImportsHandler) DeleteMetric(metricID uint32) Result {
+	if d.Metrics == nil {
+		return ResultUnimplemented
+	}
+
+	return metricResult(d.Metrics.Remove(metricID))
 }
 
-func (d *DefaultImportsHandler) DeleteMetric(metricID uint32) Result { return ResultUnimplemented }
+func metricResult(err error) Result {
+	switch {
+	case err == nil:
+		return ResultOk
+	case errors.Is(err, metrics.ErrNotFound):
+		return ResultNotFound
+	}
+	return ResultBadArgument
+}
 
+// DispatchHttpCall sends the callout with HttpCallouts.
 func (d *DefaultImportsHandler) DispatchHttpCall(upstream string, headersMap common.HeaderMap, bodyData common.IoBuffer,
 	trailersMap common.HeaderMap, timeoutMilliseconds uint32) (uint32, Result) {
-	return 0, ResultUnimplemented
+	if d.HttpCallouts == nil {
+		return 0, ResultUnimplemented
+	}
+
+	id, err := d.HttpCallouts.Dispatch(&callout.Request{
+		Upstream:        upstream,
+		Headers:         headersMap,
+		Body:            bodyData.Bytes(),
+		Trailers:        trailersMap,
+		Timeout:         time.Duration(timeoutMilliseconds) * time.Millisecond,
+		MaxResponseSize: d.CalloutPolicy.ResponseLimit(),
+	})
+	if err != nil {
+		return 0, ResultBadArgument
+	}
+
+	return id, ResultOk
+}
+
+func (d *DefaultImportsHandler) httpCallouts() *callout.Dispatcher { return d.HttpCallouts }
+
+func (d *DefaultImportsHandler) setHttpCallResponse(resp *callout.Response) {
+	d.httpCallResponse = resp
 }
 
+// DispatchGrpcCall sends a unary call with GrpcCallouts.
 func (d *DefaultImportsHandler) DispatchGrpcCall(upstream string, serviceName string, serviceMethod string,
 	initialMetadataMap common.HeaderMap, grpcMessage common.IoBuffer, timeoutMilliseconds uint32) (uint32, Result) {
-	return 0, ResultUnimplemented
+	if d.GrpcCallouts == nil {
+		return 0, ResultUnimplemented
+	}
+
+	id, err := d.GrpcCallouts.Call(&callout.GrpcRequest{
+		Upstream:       upstream,
+		Service:        serviceName,
+		Method:         serviceMethod,
+		Metadata:       initialMetadataMap,
+		Timeout:        time.Duration(timeoutMilliseconds) * time.Millisecond,
+		MaxMessageSize: d.CalloutPolicy.ResponseLimit(),
+	}, grpcMessage.Bytes())
+	if err != nil {
+		return 0, ResultBadArgument
+	}
+
+	return id, ResultOk
 }
 
+// OpenGrpcStream opens a stream with GrpcCallouts.
 func (d *DefaultImportsHandler) OpenGrpcStream(upstream string, serviceName string, serviceMethod string,
 	initialMetadataMap common.HeaderMap) (uint32, Result) {
-	return 0, ResultUnimplemented
+	if d.GrpcCallouts == nil {
+		return 0, ResultUnimplemented
+	}
+
+	id, err := d.GrpcCallouts.Open(&callout.GrpcRequest{
+		Upstream:       upstream,
+		Service:        serviceName,
+		Method:         serviceMethod,
+		Metadata:       initialMetadataMap,
+		MaxMessageSize: d.CalloutPolicy.ResponseLimit(),
+	})
+	if err != nil {
+		return 0, ResultBadArgument
+	}
+
+	return id, ResultOk
 }
 
 func (d *DefaultImportsHandler) SendGrpcStreamMessage(calloutID uint32, grpcMessageData common.IoBuffer) Result {
-	return ResultUnimplemented
+	if d.GrpcCallouts == nil {
+		return ResultUnimplemented
+	}
+	return grpcResult(d.GrpcCallouts.Send(calloutID, grpcMessageData.Bytes(), false))
+}
+
+func (d *DefaultImportsHandler) CancelGrpcCall(calloutID uint32) Result {
+	if d.GrpcCallouts == nil {
+		return ResultUnimplemented
+	}
+	return grpcResult(d.GrpcCallouts.Cancel(calloutID))
 }
 
-func (d *DefaultImportsHandler) CancelGrpcCall(calloutID uint32) Result { return ResultUnimplemented }
+// CloseGrpcCall ends the messages sent on the call, its response keeps being
+// delivered.
+func (d *DefaultImportsHandler) CloseGrpcCall(calloutID uint32) Result {
+	if d.GrpcCallouts == nil {
+		return ResultUnimplemented
+	}
+	return grpcResult(d.GrpcCallouts.Close(calloutID))
+}
+
+func (d *DefaultImportsHandler) grpcCallouts() *callout.GrpcDispatcher { return d.GrpcCallouts }
+
+func (d *DefaultImportsHandler) setGrpcEvent(ev *callout.GrpcEvent) { d.grpcEvent = ev }
 
-func (d *DefaultImportsHandler) CloseGrpcCall(calloutID uint32) Result { return ResultUnimplemented }
+func (d *DefaultImportsHandler) calloutPolicy() *callout.Policy { return d.CalloutPolicy }
+
+func grpcResult(err error) Result {
+	switch {
+	case err == nil:
+		return ResultOk
+	case errors.Is(err, callout.ErrCallNotFound):
+		return ResultNotFound
+	default:
+		return ResultInvalidOperation
+	}
+}
 
 func (d *DefaultImportsHandler) CallCustomFunction(customFunctionID uint32, parametersData string) (string, Result) {
 	return "", ResultUnimplemented
@@ -17,12 +17,27 @@
 
 package v2
 
+import "mosn.io/proxy-wasm-go-host/proxywasm/common"
+
 func (a *ABIContext) CallWasmFunction(funcName string, args ...interface{}) (interface{}, Action, error) {
 	ff, err := a.Instance.GetExportsFunc(funcName)
 	if err != nil {
 		return nil, ActionContinue, err
 	}
 
+	// the guest may switch context with proxy_set_effective_context, which
+	// only lasts for this call
+	data := a.Instance.GetData()
+	e, switched := data.(*effectiveContext)
+	if switched {
+		a.Instance.SetData(e.ContextHandler)
+	}
+	defer func() {
+		if _, ok := a.Instance.GetData().(*effectiveContext); ok || switched {
+			a.Instance.SetData(data)
+		}
+	}()
+
 	res, err := ff.Call(args...)
 	if err != nil {
 		a.Instance.HandleError(err)
@@ -35,6 +50,34 @@ func (a *ABIContext) CallWasmFunction(funcName string, args ...interface{}) (int
 	return res, action, nil
 }
 
+// callContextFunction calls a callback of the context contextID, its first
+// argument, which is the current context of the imports until it returns.
+func (a *ABIContext) callContextFunction(funcName string, contextID int32, args ...interface{}) (interface{}, Action, error) {
+	prev := a.contextID
+	a.contextID = contextID
+	defer func() { a.contextID = prev }()
+
+	return a.CallWasmFunction(funcName, append([]interface{}{contextID}, args...)...)
+}
+
+// callStreamFunction calls a callback whose result is the action to take on
+// the stream, e.g. proxy_on_request_headers, see Stream. A handler with
+// synchronous calls may still decide the action once they complete.
+func (a *ABIContext) callStreamFunction(funcName string, contextID int32, args ...interface{}) (Action, error) {
+	res, action, err := a.callContextFunction(funcName, contextID, args...)
+	if err != nil {
+		return ActionPause, err
+	}
+	if action != ActionContinue {
+		return action, nil
+	}
+
+	if v, ok := res.(int32); ok {
+		return Action(v), nil
+	}
+	return ActionContinue, nil
+}
+
 func (a *ABIContext) ProxyOnMemoryAllocate(memorySize int32) (int32, error) {
 	res, _, err := a.CallWasmFunction("proxy_on_memory_allocate", memorySize)
 	if err != nil {
@@ -44,18 +87,23 @@ func (a *ABIContext) ProxyOnMemoryAllocate(memorySize int32) (int32, error) {
 }
 
 func (a *ABIContext) ProxyOnContextCreate(contextID int32, parentContextID int32, contextType ContextType) error {
-	_, _, err := a.CallWasmFunction("proxy_on_context_create", contextID, parentContextID)
+	_, _, err := a.callContextFunction("proxy_on_context_create", contextID, parentContextID)
 	if err != nil {
 		return err
 	}
+	common.GetContextRegistry(a.Instance).Register(contextID, parentContextID, a)
 	return nil
 }
 
 func (a *ABIContext) ProxyOnDone(contextID int32) (int32, error) {
-	res, _, err := a.CallWasmFunction("proxy_on_done", contextID)
+	res, _, err := a.callContextFunction("proxy_on_done", contextID)
 	if err != nil {
 		return 0, err
 	}
+	// a context not done yet calls proxy_context_finalize later on
+	if res.(int32) != 0 {
+		common.GetContextRegistry(a.Instance).Unregister(contextID)
+	}
 	return res.(int32), nil
 }
 
@@ -76,23 +124,15 @@ func (a *ABIContext) ProxyOnConfigure(pluginID int32, pluginConfigurationSize in
 }
 
 func (a *ABIContext) ProxyOnNewConnection(streamID int32) (Action, error) {
-	_, action, err := a.CallWasmFunction("proxy_on_new_connection", streamID)
-	if err != nil {
-		return ActionPause, err
-	}
-	return action, nil
+	return a.callStreamFunction("proxy_on_new_connection", streamID)
 }
 
 func (a *ABIContext) ProxyOnDownstreamData(streamID int32, dataSize int32, endOfStream int32) (Action, error) {
-	_, action, err := a.CallWasmFunction("proxy_on_downstream_data", streamID, dataSize, endOfStream)
-	if err != nil {
-		return ActionPause, err
-	}
-	return action, nil
+	return a.callStreamFunction("proxy_on_downstream_data", streamID, dataSize, endOfStream)
 }
 
 func (a *ABIContext) ProxyOnDownstreamClose(contextID int32, closeSource CloseSourceType) error {
-	_, _, err := a.CallWasmFunction("proxy_on_downstream_close", contextID, closeSource)
+	_, _, err := a.callContextFunction("proxy_on_downstream_close", contextID, closeSource)
 	if err != nil {
 		return err
 	}
@@ -100,15 +140,11 @@ func (a *ABIContext) ProxyOnDownstreamClose(contextID int32, closeSource CloseSo
 }
 
 func (a *ABIContext) ProxyOnUpstreamData(streamID int32, dataSize int32, endOfStream int32) (Action, error) {
-	_, action, err := a.CallWasmFunction("proxy_on_upstream_data", streamID, dataSize, endOfStream)
-	if err != nil {
-		return ActionPause, err
-	}
-	return action, nil
+	return a.callStreamFunction("proxy_on_upstream_data", streamID, dataSize, endOfStream)
 }
 
 func (a *ABIContext) ProxyOnUpstreamClose(streamID int32, closeSource CloseSourceType) error {
-	_, _, err := a.CallWasmFunction("proxy_on_upstream_close", streamID, closeSource)
+	_, _, err := a.callContextFunction("proxy_on_upstream_close", streamID, closeSource)
 	if err != nil {
 		return err
 	}
@@ -116,67 +152,35 @@ func (a *ABIContext) ProxyOnUpstreamClose(streamID int32, closeSource CloseSourc
 }
 
 func (a *ABIContext) ProxyOnRequestHeaders(streamID int32, numHeaders int32, endOfStream int32) (Action, error) {
-	_, action, err := a.CallWasmFunction("proxy_on_request_headers", streamID, numHeaders, endOfStream)
-	if err != nil {
-		return ActionPause, err
-	}
-	return action, nil
+	return a.callStreamFunction("proxy_on_request_headers", streamID, numHeaders, endOfStream)
 }
 
 func (a *ABIContext) ProxyOnRequestBody(streamID int32, bodySize int32, endOfStream int32) (Action, error) {
-	_, action, err := a.CallWasmFunction("proxy_on_request_body", streamID, bodySize, endOfStream)
-	if err != nil {
-		return ActionPause, err
-	}
-	return action, nil
+	return a.callStreamFunction("proxy_on_request_body", streamID, bodySize, endOfStream)
 }
 
 func (a *ABIContext) ProxyOnRequestTrailers(streamID int32, numTrailers int32, endOfStream int32) (Action, error) {
-	_, action, err := a.CallWasmFunction("proxy_on_request_trailers", streamID, numTrailers, endOfStream)
-	if err != nil {
-		return ActionPause, err
-	}
-	return action, nil
+	return a.callStreamFunction("proxy_on_request_trailers", streamID, numTrailers, endOfStream)
 }
 
 func (a *ABIContext) ProxyOnRequestMetadata(streamID int32, numElements int32) (Action, error) {
-	_, action, err := a.CallWasmFunction("proxy_on_request_metadata", streamID, numElements)
-	if err != nil {
-		return ActionPause, err
-	}
-	return action, nil
+	return a.callStreamFunction("proxy_on_request_metadata", streamID, numElements)
 }
 
 func (a *ABIContext) ProxyOnResponseHeaders(streamID int32, numHeaders int32, endOfStream int32) (Action, error) {
-	_, action, err := a.CallWasmFunction("proxy_on_response_headers", streamID, numHeaders, endOfStream)
-	if err != nil {
-		return ActionPause, err
-	}
-	return action, nil
+	return a.callStreamFunction("proxy_on_response_headers", streamID, numHeaders, endOfStream)
 }
 
 func (a *ABIContext) ProxyOnResponseBody(streamID int32, bodySize int32, endOfStream int32) (Action, error) {
-	_, action, err := a.CallWasmFunction("proxy_on_response_body", streamID, bodySize, endOfStream)
-	if err != nil {
-		return ActionPause, err
-	}
-	return action, nil
+	return a.callStreamFunction("proxy_on_response_body", streamID, bodySize, endOfStream)
 }
 
 func (a *ABIContext) ProxyOnResponseTrailers(streamID int32, numTrailers int32, endOfStream int32) (Action, error) {
-	_, action, err := a.CallWasmFunction("proxy_on_response_trailers", streamID, numTrailers, endOfStream)
-	if err != nil {
-		return ActionPause, err
-	}
-	return action, nil
+	return a.callStreamFunction("proxy_on_response_trailers", streamID, numTrailers, endOfStream)
 }
 
 func (a *ABIContext) ProxyOnResponseMetadata(streamID int32, numElements int32) (Action, error) {
-	_, action, err := a.CallWasmFunction("proxy_on_response_metadata", streamID, numElements)
-	if err != nil {
-		return ActionPause, err
-	}
-	return action, nil
+	return a.callStreamFunction("proxy_on_response_metadata", streamID, numElements)
 }
 
 func (a *ABIContext) ProxyOnQueueReady(queueID int32) error {
@@ -196,7 +200,7 @@ func (a *ABIContext) ProxyOnTimerReady(timerID int32) error {
 }
 
 func (a *ABIContext) ProxyOnHttpCallResponse(pluginContextID int32, calloutID int32, numHeaders int32, bodySize int32, numTrailers int32) error {
-	_, _, err := a.CallWasmFunction("proxy_on_http_call_response", pluginContextID, calloutID, numHeaders, bodySize, numTrailers)
+	_, _, err := a.callContextFunction("proxy_on_http_call_response", pluginContextID, calloutID, numHeaders, bodySize, numTrailers)
 	if err != nil {
 		return err
 	}
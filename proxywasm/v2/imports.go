@@ -86,14 +86,30 @@ func ProxyLog(instance common.WasmInstance, logLevel int32, messageData int32, m
 	return callback.Log(LogLevel(logLevel), string(msg))
 }
 
+// ProxySetEffectiveContext makes the following imports of the guest call in
+// progress act for contextID. The contexts unknown to the registry of the
+// instance are left to the import handler.
 func ProxySetEffectiveContext(instance common.WasmInstance, contextID int32) Result {
+	if v, ok := common.LookupContext(instance, contextID); ok {
+		if ctx, ok := v.(ContextHandler); ok {
+			instance.SetData(&effectiveContext{ContextHandler: ctx, contextID: contextID})
+			return ResultOk
+		}
+	}
+
 	callback := getImportHandler(instance)
 	return callback.SetEffectiveContext(contextID)
 }
 
 func ProxyContextFinalize(instance common.WasmInstance) Result {
 	callback := getImportHandler(instance)
-	return callback.ContextFinalize()
+	res := callback.ContextFinalize()
+
+	if ctx := getContextHandler(instance); ctx != nil && res == ResultOk {
+		common.GetContextRegistry(instance).Unregister(getCurrentContextID(ctx))
+	}
+
+	return res
 }
 
 func ProxyResumeStream(instance common.WasmInstance, streamType StreamType) Result {
@@ -146,14 +162,17 @@ func ProxySendHttpResponse(instance common.WasmInstance, responseCode int32, res
 		return ResultInvalidMemoryAccess
 	}
 
-	additionalHeaderMap := common.DecodeMap(additionalHeaderMapData)
+	additionalHeaderMap, err := common.DecodeMap(additionalHeaderMapData)
+	if err != nil {
+		return ResultBadArgument
+	}
 
 	callback := getImportHandler(instance)
 
 	return callback.SendHttpResp(responseCode,
 		common.NewIoBufferBytes(respCodeDetail),
 		common.NewIoBufferBytes(respBody),
-		common.CommonHeader(additionalHeaderMap), grpcStatus)
+		additionalHeaderMap, grpcStatus)
 }
 
 func ProxyResumeHttpStream(instance common.WasmInstance, streamType StreamType) Result {
@@ -214,15 +233,26 @@ func ProxyGetBuffer(instance common.WasmInstance, bufferType int32, offset int32
 		return ResultEmpty
 	}
 
-	if offset > offset+maxSize {
+	if offset < 0 || maxSize < 0 || int(offset) > buf.Len() {
 		return ResultBadArgument
 	}
 
-	if offset+maxSize > int32(buf.Len()) {
-		maxSize = int32(buf.Len()) - offset
+	addr, size, err := common.CopyBufferIntoInstance(instance, buf, int(offset), int(maxSize))
+	if err != nil {
+		return ResultInvalidMemoryAccess
+	}
+
+	err = instance.PutUint32(uint64(returnBufferData), uint32(addr))
+	if err != nil {
+		return ResultInvalidMemoryAccess
+	}
+
+	err = instance.PutUint32(uint64(returnBufferSize), uint32(size))
+	if err != nil {
+		return ResultInvalidMemoryAccess
 	}
 
-	return copyIntoInstance(instance, buf.Bytes()[offset:offset+maxSize], returnBufferData, returnBufferSize)
+	return ResultOk
 }
 
 func ProxySetBuffer(instance common.WasmInstance, bufferType BufferType, offset int32, size int32,
@@ -237,19 +267,11 @@ func ProxySetBuffer(instance common.WasmInstance, bufferType BufferType, offset
 		return ResultInvalidMemoryAccess
 	}
 
-	if offset == 0 {
-		if size == 0 || int(size) >= buf.Len() {
-			buf.Drain(buf.Len())
-			_, err = buf.Write(content)
-		} else {
-			return ResultBadArgument
-		}
-	} else if int(offset) >= buf.Len() {
-		_, err = buf.Write(content)
-	} else {
+	if offset < 0 || size < 0 {
 		return ResultBadArgument
 	}
 
+	err = common.ReplaceBuffer(buf, int(offset), int(size), content)
 	if err != nil {
 		return ResultInvalidMemoryAccess
 	}
@@ -285,51 +307,17 @@ func GetMap(instance common.WasmInstance, mapType MapType) common.HeaderMap {
 }
 
 func copyMapIntoInstance(m common.HeaderMap, instance common.WasmInstance, returnMapData int32, returnMapSize int32) Result {
-	cloneMap := make(map[string]string)
-	totalBytesLen := 4
-	m.Range(func(key, value string) bool {
-		cloneMap[key] = value
-		totalBytesLen += 4 + 4                         // keyLen + valueLen
-		totalBytesLen += len(key) + 1 + len(value) + 1 // key + \0 + value + \0
-		return true
-	})
-
-	addr, err := instance.Malloc(int32(totalBytesLen))
+	addr, size, err := common.CopyMapIntoInstance(instance, m)
 	if err != nil {
 		return ResultInvalidMemoryAccess
 	}
 
-	err = instance.PutUint32(addr, uint32(len(cloneMap)))
-	if err != nil {
-		return ResultInvalidMemoryAccess
-	}
-
-	lenPtr := addr + 4
-	dataPtr := lenPtr + uint64(8*len(cloneMap))
-
-	for k, v := range cloneMap {
-		_ = instance.PutUint32(lenPtr, uint32(len(k)))
-		lenPtr += 4
-		_ = instance.PutUint32(lenPtr, uint32(len(v)))
-		lenPtr += 4
-
-		_ = instance.PutMemory(dataPtr, uint64(len(k)), []byte(k))
-		dataPtr += uint64(len(k))
-		_ = instance.PutByte(dataPtr, 0)
-		dataPtr++
-
-		_ = instance.PutMemory(dataPtr, uint64(len(v)), []byte(v))
-		dataPtr += uint64(len(v))
-		_ = instance.PutByte(dataPtr, 0)
-		dataPtr++
-	}
-
 	err = instance.PutUint32(uint64(returnMapData), uint32(addr))
 	if err != nil {
 		return ResultInvalidMemoryAccess
 	}
 
-	err = instance.PutUint32(uint64(returnMapSize), uint32(totalBytesLen))
+	err = instance.PutUint32(uint64(returnMapSize), uint32(size))
 	if err != nil {
 		return ResultInvalidMemoryAccess
 	}
@@ -343,56 +331,7 @@ func ProxyGetHeaderMapPairs(instance common.WasmInstance, mapType int32, returnD
 		return int32(ResultNotFound)
 	}
 
-	cloneMap := make(map[string]string)
-	totalBytesLen := 4
-	header.Range(func(key, value string) bool {
-		cloneMap[key] = value
-		totalBytesLen += 4 + 4                         // keyLen + valueLen
-		totalBytesLen += len(key) + 1 + len(value) + 1 // key + \0 + value + \0
-		return true
-	})
-
-	addr, err := instance.Malloc(int32(totalBytesLen))
-	if err != nil {
-		return int32(ResultInvalidMemoryAccess)
-	}
-
-	err = instance.PutUint32(addr, uint32(len(cloneMap)))
-	if err != nil {
-		return int32(ResultInvalidMemoryAccess)
-	}
-
-	lenPtr := addr + 4
-	dataPtr := lenPtr + uint64(8*len(cloneMap))
-
-	for k, v := range cloneMap {
-		_ = instance.PutUint32(lenPtr, uint32(len(k)))
-		lenPtr += 4
-		_ = instance.PutUint32(lenPtr, uint32(len(v)))
-		lenPtr += 4
-
-		_ = instance.PutMemory(dataPtr, uint64(len(k)), []byte(k))
-		dataPtr += uint64(len(k))
-		_ = instance.PutByte(dataPtr, 0)
-		dataPtr++
-
-		_ = instance.PutMemory(dataPtr, uint64(len(v)), []byte(v))
-		dataPtr += uint64(len(v))
-		_ = instance.PutByte(dataPtr, 0)
-		dataPtr++
-	}
-
-	err = instance.PutUint32(uint64(returnDataPtr), uint32(addr))
-	if err != nil {
-		return int32(ResultInvalidMemoryAccess)
-	}
-
-	err = instance.PutUint32(uint64(returnDataSize), uint32(totalBytesLen))
-	if err != nil {
-		return int32(ResultInvalidMemoryAccess)
-	}
-
-	return int32(ResultOk)
+	return int32(copyMapIntoInstance(header, instance, returnDataPtr, returnDataSize))
 }
 
 func ProxyGetMapValues(instance common.WasmInstance, mapType MapType, keysData int32, keysSize int32,
@@ -436,12 +375,21 @@ func ProxySetMapValues(instance common.WasmInstance, mapType MapType, removeKeys
 		return ResultInvalidMemoryAccess
 	}
 
-	newMap := common.DecodeMap(newMapContent)
-
-	for k, v := range newMap {
-		m.Set(k, v)
+	newMap, err := common.DecodeMap(newMapContent)
+	if err != nil {
+		return ResultBadArgument
 	}
 
+	// the pairs of a key replace all its previous values, keeping repeated keys
+	newMap.Range(func(key, _ string) bool {
+		m.Del(key)
+		return true
+	})
+	newMap.Range(func(key, value string) bool {
+		m.Add(key, value)
+		return true
+	})
+
 	// remove unwanted data
 	key, err := instance.GetMemory(uint64(removeKeysData), uint64(removeKeysSize))
 	if err != nil {
@@ -615,6 +563,11 @@ func ProxyOpenSharedQueue(instance common.WasmInstance, queueNameData int32, que
 		return ResultInvalidMemoryAccess
 	}
 
+	// the context creating the queue is notified of the enqueued items
+	if ctx := getContextHandler(instance); ctx != nil && intToBool(createIfNotExist) {
+		globalQueueOwners.set(queueID, instance, ctx, getCurrentContextID(ctx))
+	}
+
 	return ResultOk
 }
 
@@ -637,12 +590,23 @@ func ProxyEnqueueSharedQueueItem(instance common.WasmInstance, queueID int32, pa
 
 	callback := getImportHandler(instance)
 
-	return callback.EnqueueSharedQueueItem(uint32(queueID), string(value))
+	res := callback.EnqueueSharedQueueItem(uint32(queueID), string(value))
+	if res == ResultOk {
+		globalQueueOwners.notify(uint32(queueID))
+	}
+
+	return res
 }
 
 func ProxyDeleteSharedQueue(instance common.WasmInstance, queueID int32) Result {
 	callback := getImportHandler(instance)
-	return callback.DeleteSharedQueue(uint32(queueID))
+
+	res := callback.DeleteSharedQueue(uint32(queueID))
+	if res == ResultOk {
+		globalQueueOwners.delete(uint32(queueID))
+	}
+
+	return res
 }
 
 func ProxyCreateTimer(instance common.WasmInstance, period int32, oneTime int32, returnTimerID int32) Result {
@@ -699,7 +663,7 @@ func ProxyGetMetricValue(instance common.WasmInstance, metricID int32, returnVal
 		return res
 	}
 
-	err := instance.PutUint32(uint64(returnValue), uint32(value))
+	err := instance.PutUint64(uint64(returnValue), uint64(value))
 	if err != nil {
 		return ResultInvalidMemoryAccess
 	}
@@ -735,34 +699,58 @@ func ProxyDispatchHttpCall(instance common.WasmInstance, upstreamNameData int32,
 	if err != nil {
 		return ResultInvalidMemoryAccess
 	}
-	headerMap := common.DecodeMap(headerMapData)
+	headerMap, err := common.DecodeMap(headerMapData)
+	if err != nil {
+		return ResultBadArgument
+	}
 
 	body, err := instance.GetMemory(uint64(bodyData), uint64(bodySize))
 	if err != nil {
 		return ResultInvalidMemoryAccess
 	}
+	// the callout is sent once the import has returned and the guest may
+	// have reused its memory, the pairs are decoded into strings already
+	body = append([]byte(nil), body...)
 
 	trailerMapData, err := instance.GetMemory(uint64(trailersMapData), uint64(trailersMapSize))
 	if err != nil {
 		return ResultInvalidMemoryAccess
 	}
-	trailerMap := common.DecodeMap(trailerMapData)
+	trailerMap, err := common.DecodeMap(trailerMapData)
+	if err != nil {
+		return ResultBadArgument
+	}
 
 	ctx := getImportHandler(instance)
 
+	timeout, admission, err := admitCallout(instance, ctx, string(upstream), uint32(timeoutMilliseconds))
+	if err != nil {
+		return ResultNotAllowed
+	}
+
 	calloutID, res := ctx.DispatchHttpCall(string(upstream),
-		common.CommonHeader(headerMap), common.NewIoBufferBytes(body), common.CommonHeader(trailerMap),
-		uint32(timeoutMilliseconds),
+		headerMap, common.NewIoBufferBytes(body), trailerMap,
+		timeout,
 	)
 	if res != ResultOk {
+		admission.Done(nil)
 		return res
 	}
 
 	err = instance.PutUint32(uint64(returnCalloutID), calloutID)
 	if err != nil {
+		cancelHttpCall(ctx, calloutID)
+		admission.Done(nil)
 		return ResultInvalidMemoryAccess
 	}
 
+	if handler := getContextHandler(instance); handler != nil {
+		awaitHttpCallResponse(instance, handler, ctx, calloutID, admission)
+	} else {
+		cancelHttpCall(ctx, calloutID)
+		admission.Done(nil)
+	}
+
 	return ResultOk
 }
 
@@ -788,7 +776,10 @@ func ProxyDispatchGrpcCall(instance common.WasmInstance, upstreamNameData int32,
 	if err != nil {
 		return ResultInvalidMemoryAccess
 	}
-	initialMetadataMap := common.DecodeMap(initialMetaMapdata)
+	initialMetadataMap, err := common.DecodeMap(initialMetaMapdata)
+	if err != nil {
+		return ResultBadArgument
+	}
 
 	msg, err := instance.GetMemory(uint64(grpcMessageData), uint64(grpcMessageSize))
 	if err != nil {
@@ -797,17 +788,32 @@ func ProxyDispatchGrpcCall(instance common.WasmInstance, upstreamNameData int32,
 
 	ctx := getImportHandler(instance)
 
+	timeout, admission, err := admitCallout(instance, ctx, string(upstream), uint32(timeoutMilliseconds))
+	if err != nil {
+		return ResultNotAllowed
+	}
+
 	calloutID, res := ctx.DispatchGrpcCall(string(upstream), string(serviceName), string(serviceMethod),
-		common.CommonHeader(initialMetadataMap), common.NewIoBufferBytes(msg), uint32(timeoutMilliseconds))
+		initialMetadataMap, common.NewIoBufferBytes(msg), timeout)
 	if res != ResultOk {
+		admission.Done(nil)
 		return res
 	}
 
 	err = instance.PutUint32(uint64(returnCalloutID), calloutID)
 	if err != nil {
+		cancelGrpcCall(ctx, calloutID)
+		admission.Done(nil)
 		return ResultInvalidMemoryAccess
 	}
 
+	if handler := getContextHandler(instance); handler != nil {
+		awaitGrpcEvents(instance, handler, ctx, calloutID, admission)
+	} else {
+		cancelGrpcCall(ctx, calloutID)
+		admission.Done(nil)
+	}
+
 	return ResultOk
 }
 
@@ -833,20 +839,38 @@ func ProxyOpenGrpcStream(instance common.WasmInstance, upstreamNameData int32, u
 	if err != nil {
 		return ResultInvalidMemoryAccess
 	}
-	initialMetadataMap := common.DecodeMap(initialMetaMapdata)
+	initialMetadataMap, err := common.DecodeMap(initialMetaMapdata)
+	if err != nil {
+		return ResultBadArgument
+	}
 
 	ctx := getImportHandler(instance)
 
-	calloutID, res := ctx.OpenGrpcStream(string(upstream), string(serviceName), string(serviceMethod), common.CommonHeader(initialMetadataMap))
+	_, admission, err := admitCallout(instance, ctx, string(upstream), 0)
+	if err != nil {
+		return ResultNotAllowed
+	}
+
+	calloutID, res := ctx.OpenGrpcStream(string(upstream), string(serviceName), string(serviceMethod), initialMetadataMap)
 	if res != ResultOk {
+		admission.Done(nil)
 		return res
 	}
 
 	err = instance.PutUint32(uint64(returnCalloutID), calloutID)
 	if err != nil {
+		cancelGrpcCall(ctx, calloutID)
+		admission.Done(nil)
 		return ResultInvalidMemoryAccess
 	}
 
+	if handler := getContextHandler(instance); handler != nil {
+		awaitGrpcEvents(instance, handler, ctx, calloutID, admission)
+	} else {
+		cancelGrpcCall(ctx, calloutID)
+		admission.Done(nil)
+	}
+
 	return ResultOk
 }
 
@@ -0,0 +1,279 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v2
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+	"mosn.io/proxy-wasm-go-host/proxywasm/metrics"
+)
+
+// fakeInstance is a WasmInstance whose exports are Go funcs.
+type fakeInstance struct {
+	common.WasmInstance // unused methods panic
+	lock                sync.Mutex
+	data                interface{}
+	stopped             int32
+	hookLock            sync.Mutex
+	stopHooks           []func()
+	mem                 []byte
+	brk                 uint64
+	exports             map[string]fakeFunction
+}
+
+func newFakeInstance() *fakeInstance {
+	return &fakeInstance{
+		mem:     make([]byte, 4096),
+		brk:     1024,
+		exports: make(map[string]fakeFunction),
+	}
+}
+
+type fakeFunction func(args ...interface{}) (interface{}, error)
+
+func (f fakeFunction) Call(args ...interface{}) (interface{}, error) { return f(args...) }
+
+func (i *fakeInstance) GetExportsFunc(funcName string) (common.WasmFunction, error) {
+	if f, ok := i.exports[funcName]; ok {
+		return f, nil
+	}
+	return nil, errors.New("export not found")
+}
+
+func (i *fakeInstance) Acquire() bool { return atomic.LoadInt32(&i.stopped) == 0 }
+
+func (i *fakeInstance) Release() {}
+
+func (i *fakeInstance) Lock(data interface{}) {
+	i.lock.Lock()
+	i.data = data
+}
+
+func (i *fakeInstance) Unlock() {
+	i.data = nil
+	i.lock.Unlock()
+}
+
+func (i *fakeInstance) GetData() interface{} { return i.data }
+
+func (i *fakeInstance) SetData(data interface{}) { i.data = data }
+
+func (i *fakeInstance) HandleError(err error) {}
+
+func (i *fakeInstance) Stop() {
+	atomic.StoreInt32(&i.stopped, 1)
+
+	i.hookLock.Lock()
+	hooks := i.stopHooks
+	i.stopHooks = nil
+	i.hookLock.Unlock()
+
+	for _, f := range hooks {
+		f()
+	}
+}
+
+func (i *fakeInstance) OnStop(f func()) {
+	i.hookLock.Lock()
+	if atomic.LoadInt32(&i.stopped) == 0 {
+		i.stopHooks = append(i.stopHooks, f)
+		i.hookLock.Unlock()
+		return
+	}
+	i.hookLock.Unlock()
+
+	f()
+}
+
+func (i *fakeInstance) Malloc(size int32) (uint64, error) {
+	if i.brk+uint64(size) > uint64(len(i.mem)) {
+		return 0, errors.New("out of memory")
+	}
+	addr := i.brk
+	i.brk += uint64(size)
+	return addr, nil
+}
+
+func (i *fakeInstance) GetMemory(addr uint64, size uint64) ([]byte, error) {
+	if addr+size > uint64(len(i.mem)) {
+		return nil, errors.New("addr overflow")
+	}
+	return i.mem[addr : addr+size], nil
+}
+
+func (i *fakeInstance) PutMemory(addr uint64, size uint64, content []byte) error {
+	if addr+size > uint64(len(i.mem)) {
+		return errors.New("addr overflow")
+	}
+	copy(i.mem[addr:addr+size], content)
+	return nil
+}
+
+func (i *fakeInstance) PutByte(addr uint64, b byte) error {
+	if addr >= uint64(len(i.mem)) {
+		return errors.New("addr overflow")
+	}
+	i.mem[addr] = b
+	return nil
+}
+
+func (i *fakeInstance) GetUint32(addr uint64) (uint32, error) {
+	if addr+4 > uint64(len(i.mem)) {
+		return 0, errors.New("addr overflow")
+	}
+	return binary.LittleEndian.Uint32(i.mem[addr:]), nil
+}
+
+func (i *fakeInstance) PutUint32(addr uint64, value uint32) error {
+	if addr+4 > uint64(len(i.mem)) {
+		return errors.New("addr overflow")
+	}
+	binary.LittleEndian.PutUint32(i.mem[addr:], value)
+	return nil
+}
+
+func (i *fakeInstance) GetUint64(addr uint64) (uint64, error) {
+	if addr+8 > uint64(len(i.mem)) {
+		return 0, errors.New("addr overflow")
+	}
+	return binary.LittleEndian.Uint64(i.mem[addr:]), nil
+}
+
+func (i *fakeInstance) PutUint64(addr uint64, value uint64) error {
+	if addr+8 > uint64(len(i.mem)) {
+		return errors.New("addr overflow")
+	}
+	binary.LittleEndian.PutUint64(i.mem[addr:], value)
+	return nil
+}
+
+// filterHandler serves the maps and buffers of a stream.
+type filterHandler struct {
+	DefaultImportsHandler
+	requestHeader common.HeaderMap
+	requestBody   common.IoBuffer
+}
+
+func (h *filterHandler) GetHttpRequestHeader() common.HeaderMap { return h.requestHeader }
+
+func (h *filterHandler) GetHttpRequestBody() common.IoBuffer { return h.requestBody }
+
+// returned reads the address and the size an import returned at 0 and 4.
+func returned(t *testing.T, instance *fakeInstance) []byte {
+	addr, _ := instance.GetUint32(0)
+	size, _ := instance.GetUint32(4)
+	b, err := instance.GetMemory(uint64(addr), uint64(size))
+	assert.Nil(t, err)
+	return b
+}
+
+func TestProxyGetHeaderMapPairs(t *testing.T) {
+	instance := newFakeInstance()
+	header := common.NewCommonHeader(
+		common.HeaderPair{Key: ":path", Value: "/"},
+		common.HeaderPair{Key: "cookie", Value: "a=1"},
+		common.HeaderPair{Key: "cookie", Value: "b=2"},
+	)
+	instance.Lock(&ABIContext{Imports: &filterHandler{requestHeader: header}, Instance: instance})
+	defer instance.Unlock()
+
+	// the pairs are encoded at once, the repeated keys included
+	res := ProxyGetHeaderMapPairs(instance, int32(MapTypeHttpRequestHeaders), 0, 4)
+	assert.Equal(t, int32(ResultOk), res)
+	assert.Equal(t, common.EncodeMap(header), returned(t, instance))
+
+	res = ProxyGetHeaderMapPairs(instance, int32(MapTypeHttpResponseHeaders), 0, 4)
+	assert.Equal(t, int32(ResultNotFound), res)
+
+	// the errors of the writes are returned
+	instance.brk = uint64(len(instance.mem))
+	res = ProxyGetHeaderMapPairs(instance, int32(MapTypeHttpRequestHeaders), 0, 4)
+	assert.Equal(t, int32(ResultInvalidMemoryAccess), res)
+}
+
+func TestProxySetBuffer(t *testing.T) {
+	instance := newFakeInstance()
+	body := common.NewIoBufferBytes([]byte("hello world"))
+	instance.Lock(&ABIContext{Imports: &filterHandler{requestBody: body}, Instance: instance})
+	defer instance.Unlock()
+
+	copy(instance.mem[64:], "new-")
+
+	cases := []struct {
+		offset, size int32
+		expected     string
+	}{
+		{0, 0, "new-hello world"},    // prepend
+		{5, 1, "new-hnew-llo world"}, // splice
+		{4, 100, "new-new-"},         // replace the tail
+		{8, 0, "new-new-new-"},       // append
+	}
+	for _, c := range cases {
+		res := ProxySetBuffer(instance, BufferTypeHttpRequestBody, c.offset, c.size, 64, 4)
+		assert.Equal(t, ResultOk, res)
+		assert.Equal(t, c.expected, string(body.Bytes()), "offset %d, size %d", c.offset, c.size)
+	}
+
+	assert.Equal(t, ResultBadArgument, ProxySetBuffer(instance, BufferTypeHttpRequestBody, -1, 0, 64, 4))
+	assert.Equal(t, ResultBadArgument, ProxySetBuffer(instance, BufferTypeHttpResponseBody, 0, 0, 64, 4))
+}
+
+func TestProxyGetBuffer(t *testing.T) {
+	instance := newFakeInstance()
+	body := common.NewIoBufferBytes([]byte("hello world"))
+	instance.Lock(&ABIContext{Imports: &filterHandler{requestBody: body}, Instance: instance})
+	defer instance.Unlock()
+
+	// the body is read by chunks, the last one being clamped
+	var read []byte
+	for offset := int32(0); offset < int32(body.Len()); offset += 4 {
+		res := ProxyGetBuffer(instance, int32(BufferTypeHttpRequestBody), offset, 4, 0, 4)
+		assert.Equal(t, ResultOk, res)
+		read = append(read, returned(t, instance)...)
+	}
+	assert.Equal(t, "hello world", string(read))
+
+	assert.Equal(t, ResultBadArgument, ProxyGetBuffer(instance, int32(BufferTypeHttpRequestBody), 12, 4, 0, 4))
+	assert.Equal(t, ResultBadArgument, ProxyGetBuffer(instance, int32(BufferTypeHttpRequestBody), -1, 4, 0, 4))
+}
+
+func TestProxyGetMetricValue(t *testing.T) {
+	instance := newFakeInstance()
+	handler := &DefaultImportsHandler{Metrics: metrics.NewRegistry().NewScope("plugin")}
+	instance.Lock(&ABIContext{Imports: handler, Instance: instance})
+	defer instance.Unlock()
+
+	id, res := handler.CreateMetric(MetricTypeGauge, "bytes")
+	assert.Equal(t, ResultOk, res)
+
+	// the value is written on 8 bytes
+	assert.Equal(t, ResultOk, ProxySetMetricValue(instance, int32(id), 1<<40+1))
+	assert.Equal(t, ResultOk, ProxyGetMetricValue(instance, int32(id), 8))
+	v, _ := instance.GetUint64(8)
+	assert.Equal(t, uint64(1<<40+1), v)
+
+	assert.Equal(t, ResultInvalidMemoryAccess, ProxyGetMetricValue(instance, int32(id), int32(len(instance.mem)-4)))
+	assert.Equal(t, ResultOk, ProxyDeleteMetric(instance, int32(id)))
+	assert.Equal(t, ResultNotFound, ProxyGetMetricValue(instance, int32(id), 8))
+}
@@ -21,7 +21,9 @@ import "mosn.io/proxy-wasm-go-host/proxywasm/common"
 
 type ImportsHandler interface {
 	// for golang host environment
-	// Wait until async call return, eg. sync http call in golang
+	// Wait until async call return, eg. sync http call in golang. Returning
+	// ActionContinue keeps the action of the plugin, the handlers with
+	// asynchronous calls letting the plugin pause the stream, see Stream.
 	Wait() Action
 
 	// integration
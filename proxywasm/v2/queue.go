@@ -0,0 +1,95 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v2
+
+import (
+	"sync"
+
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+)
+
+// queueOwner is the context which created a shared queue.
+type queueOwner struct {
+	ctx       ContextHandler
+	contextID int32
+	events    *common.EventQueue
+}
+
+// queueOwners tracks the owners of the shared queues, which are notified
+// through proxy_on_queue_ready when items are enqueued.
+type queueOwners struct {
+	lock sync.RWMutex
+	m    map[uint32]*queueOwner
+}
+
+var globalQueueOwners = &queueOwners{m: make(map[uint32]*queueOwner)}
+
+// set makes ctx the owner of the queue, replacing the previous owner.
+func (o *queueOwners) set(queueID uint32, instance common.WasmInstance, ctx ContextHandler, contextID int32) {
+	owner := &queueOwner{
+		ctx:       ctx,
+		contextID: contextID,
+		events:    common.NewEventQueue(instance),
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	// keep delivering in order to the same instance
+	if prev, ok := o.m[queueID]; ok && prev.events.Instance() == instance {
+		owner.events = prev.events
+	}
+
+	o.m[queueID] = owner
+}
+
+func (o *queueOwners) delete(queueID uint32) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	delete(o.m, queueID)
+}
+
+func (o *queueOwners) get(queueID uint32) *queueOwner {
+	o.lock.RLock()
+	defer o.lock.RUnlock()
+
+	return o.m[queueID]
+}
+
+// notify schedules proxy_on_queue_ready on the owner of the queue, if any.
+func (o *queueOwners) notify(queueID uint32) {
+	owner := o.get(queueID)
+	if owner == nil {
+		return
+	}
+
+	ctx := lookupContext(owner.events.Instance(), owner.contextID, owner.ctx)
+	posted := owner.events.Post(ctx, func() {
+		_ = ctx.GetExports().ProxyOnQueueReady(int32(queueID))
+	})
+
+	// the owner instance has been stopped
+	if !posted {
+		o.lock.Lock()
+		if o.m[queueID] == owner {
+			delete(o.m, queueID)
+		}
+		o.lock.Unlock()
+	}
+}
@@ -0,0 +1,73 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v2
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueueReady(t *testing.T) {
+	instance := newFakeInstance()
+	root := &ABIContext{Imports: &DefaultImportsHandler{}, Instance: instance}
+
+	copy(instance.mem[64:], "my-v2-queue")
+
+	// the plugin context opens the queue once created
+	instance.exports["proxy_on_context_create"] = func(args ...interface{}) (interface{}, error) {
+		assert.Equal(t, ResultOk, ProxyOpenSharedQueue(instance, 64, 11, 1, 0))
+		return nil, nil
+	}
+
+	ready := make(chan int32, 10)
+	instance.exports["proxy_on_queue_ready"] = func(args ...interface{}) (interface{}, error) {
+		// the owner is locked while notified
+		assert.Equal(t, root, instance.GetData())
+		ready <- args[0].(int32)
+		return nil, nil
+	}
+
+	instance.Lock(root)
+	assert.Nil(t, root.ProxyOnContextCreate(1, 0, ContextTypePluginContext))
+	instance.Unlock()
+
+	queueID, _ := instance.GetUint32(0)
+
+	// an other context enqueues two items
+	other := &ABIContext{Imports: &DefaultImportsHandler{}, Instance: instance}
+	instance.Lock(other)
+	assert.Equal(t, ResultOk, ProxyEnqueueSharedQueueItem(instance, int32(queueID), 64, 2))
+	assert.Equal(t, ResultOk, ProxyEnqueueSharedQueueItem(instance, int32(queueID), 66, 2))
+	instance.Unlock()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case v := <-ready:
+			assert.Equal(t, int32(queueID), v)
+		case <-time.After(time.Second):
+			t.Fatal("proxy_on_queue_ready not called")
+		}
+	}
+
+	instance.Lock(other)
+	assert.Equal(t, ResultOk, ProxyDeleteSharedQueue(instance, int32(queueID)))
+	instance.Unlock()
+	assert.Nil(t, globalQueueOwners.get(queueID))
+}
@@ -0,0 +1,136 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package v2
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"mosn.io/proxy-wasm-go-host/proxywasm/callout"
+	"mosn.io/proxy-wasm-go-host/proxywasm/common"
+)
+
+func TestStreamPause(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+
+	instance := newFakeInstance()
+	handler := &DefaultImportsHandler{HttpCallouts: callout.NewDispatcher(nil)}
+	ctx := &ABIContext{Imports: handler, Instance: instance}
+	stream := NewStream(ctx, 5)
+
+	upstream := server.Listener.Addr().String()
+	headers := common.EncodeMap(common.NewCommonHeader(
+		common.HeaderPair{Key: ":method", Value: "GET"},
+		common.HeaderPair{Key: ":path", Value: "/"},
+		common.HeaderPair{Key: ":authority", Value: "auth"},
+	))
+	copy(instance.mem[64:], upstream)
+	copy(instance.mem[128:], headers)
+
+	// the request waits for the response of the callout
+	instance.exports["proxy_on_request_headers"] = func(args ...interface{}) (interface{}, error) {
+		ProxyDispatchHttpCall(instance, 64, int32(len(upstream)), 128, int32(len(headers)), 0, 0, 0, 0, 1000, 0)
+		return int32(ActionPause), nil
+	}
+	instance.exports["proxy_on_http_call_response"] = func(args ...interface{}) (interface{}, error) {
+		return nil, nil
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		action, err := stream.OnRequestHeaders(context.Background(), 0, true)
+		assert.Equal(t, ActionContinue, action)
+		done <- err
+	}()
+
+	// the instance is released to the other streams while paused
+	time.Sleep(10 * time.Millisecond)
+	other := &ABIContext{Imports: &DefaultImportsHandler{}, Instance: instance}
+	instance.Lock(other)
+	instance.Unlock()
+	select {
+	case <-done:
+		t.Fatal("stream not paused")
+	default:
+	}
+
+	instance.exports["proxy_on_http_call_response"] = func(args ...interface{}) (interface{}, error) {
+		assert.Equal(t, ResultOk, ProxyResumeHttpStream(instance, StreamTypeHttpRequest))
+		return nil, nil
+	}
+	close(release)
+
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not resumed")
+	}
+
+	// the body asks for more data without pausing
+	instance.exports["proxy_on_request_body"] = func(args ...interface{}) (interface{}, error) {
+		return int32(ActionWaitForMoreData), nil
+	}
+	action, err := stream.OnRequestBody(context.Background(), 4, false)
+	assert.Nil(t, err)
+	assert.Equal(t, ActionWaitForMoreData, action)
+}
+
+func TestCallWasmFunctionContext(t *testing.T) {
+	instance := newFakeInstance()
+	ctx := &ABIContext{Imports: &DefaultImportsHandler{}, Instance: instance}
+
+	current := make(chan int32, 4)
+	instance.exports["proxy_on_memory_allocate"] = func(args ...interface{}) (interface{}, error) {
+		current <- getCurrentContextID(ctx)
+		return int32(1024), nil
+	}
+	instance.exports["proxy_on_vm_start"] = func(args ...interface{}) (interface{}, error) {
+		current <- getCurrentContextID(ctx)
+		return int32(1), nil
+	}
+	instance.exports["proxy_on_request_headers"] = func(args ...interface{}) (interface{}, error) {
+		current <- getCurrentContextID(ctx)
+		// the host allocates guest memory on behalf of the stream
+		_, err := ctx.ProxyOnMemoryAllocate(64)
+		assert.Nil(t, err)
+		return int32(ActionContinue), nil
+	}
+
+	instance.Lock(ctx)
+	defer instance.Unlock()
+
+	// the sizes and the IDs which are not contexts leave it alone
+	_, err := ctx.ProxyOnMemoryAllocate(64)
+	assert.Nil(t, err)
+	_, err = ctx.ProxyOnVmStart(7, 0)
+	assert.Nil(t, err)
+	_, err = ctx.ProxyOnRequestHeaders(5, 0, 1)
+	assert.Nil(t, err)
+
+	assert.Equal(t, []int32{0, 0, 5, 5}, []int32{<-current, <-current, <-current, <-current})
+	assert.Equal(t, int32(0), getCurrentContextID(ctx))
+}
@@ -71,6 +71,11 @@ const (
 	MapTypeHttpCallResponseHeaders  MapType = 6
 	MapTypeHttpCallResponseTrailers MapType = 7
 	MapTypeHttpCallResponseMetadata MapType = 8
+
+	// The metadata of the gRPC event being delivered, outside of the ABI
+	// and so served by GetCustomMap.
+	MapTypeGrpcReceiveInitialMetadata  MapType = 9
+	MapTypeGrpcReceiveTrailingMetadata MapType = 10
 )
 
 type BufferType int32
@@ -84,6 +89,10 @@ const (
 	BufferTypeHttpRequestBody         BufferType = 5
 	BufferTypeHttpResponseBody        BufferType = 6
 	BufferTypeHttpCalloutResponseBody BufferType = 7
+
+	// The message of the gRPC event being delivered, outside of the ABI and
+	// so served by GetCustomBuffer.
+	BufferTypeGrpcReceiveBuffer BufferType = 8
 )
 
 type StreamType int32
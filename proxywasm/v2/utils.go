@@ -50,6 +50,29 @@ func copyIntoInstance(instance common.WasmInstance, value []byte, retPtr int32,
 	return ResultOk
 }
 
+// effectiveContext is the data of an instance whose guest switched to the
+// context contextID with proxy_set_effective_context.
+type effectiveContext struct {
+	ContextHandler
+	contextID int32
+}
+
+// lookupContext returns the handler registered for contextID in instance,
+// or fallback if there is none.
+func lookupContext(instance common.WasmInstance, contextID int32, fallback ContextHandler) ContextHandler {
+	if v, ok := common.LookupContext(instance, contextID); ok {
+		if ctx, ok := v.(ContextHandler); ok {
+			return ctx
+		}
+	}
+
+	if e, ok := fallback.(*effectiveContext); ok {
+		return e.ContextHandler
+	}
+
+	return fallback
+}
+
 func getContextHandler(instance common.WasmInstance) ContextHandler {
 	if v := instance.GetData(); v != nil {
 		if im, ok := v.(ContextHandler); ok {
@@ -60,6 +83,19 @@ func getContextHandler(instance common.WasmInstance) ContextHandler {
 	return nil
 }
 
+// getCurrentContextID returns the ID of the context the guest is being called
+// for, or 0 if it is unknown.
+func getCurrentContextID(ctx ContextHandler) int32 {
+	if e, ok := ctx.(*effectiveContext); ok {
+		return e.contextID
+	}
+	if a, ok := ctx.(*ABIContext); ok {
+		return a.contextID
+	}
+
+	return 0
+}
+
 func getImportHandler(instance common.WasmInstance) ImportsHandler {
 	if ctx := getContextHandler(instance); ctx != nil {
 		if im := ctx.GetImports(); im != nil {
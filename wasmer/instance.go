@@ -50,6 +50,12 @@ type Instance struct {
 	refCount int
 	stopCond *sync.Cond
 
+	// stopLock guards the stop hooks apart from lock, which is held for
+	// the whole guest calls
+	stopLock  sync.Mutex
+	stopped   bool
+	stopHooks []func()
+
 	// for cache
 	memory    *wasmerGo.Memory
 	funcCache sync.Map // string -> *wasmerGo.Function
@@ -165,9 +171,31 @@ func (w *Instance) Stop() {
 		}
 		_ = atomic.CompareAndSwapUint32(&w.started, 1, 0)
 		w.lock.Unlock()
+
+		w.stopLock.Lock()
+		w.stopped = true
+		hooks := w.stopHooks
+		w.stopHooks = nil
+		w.stopLock.Unlock()
+
+		for _, f := range hooks {
+			f()
+		}
 	}()
 }
 
+func (w *Instance) OnStop(f func()) {
+	w.stopLock.Lock()
+	if !w.stopped {
+		w.stopHooks = append(w.stopHooks, f)
+		w.stopLock.Unlock()
+		return
+	}
+	w.stopLock.Unlock()
+
+	f()
+}
+
 // return true is Instance is started, false if not started.
 func (w *Instance) checkStart() bool {
 	return atomic.LoadUint32(&w.started) == 1
@@ -385,6 +413,34 @@ func (w *Instance) PutUint32(addr uint64, value uint32) error {
 	return nil
 }
 
+func (w *Instance) GetUint64(addr uint64) (uint64, error) {
+	mem, err := w.GetExportsMem("memory")
+	if err != nil {
+		return 0, err
+	}
+
+	if int(addr) > len(mem) || int(addr+8) > len(mem) {
+		return 0, ErrAddrOverflow
+	}
+
+	return binary.LittleEndian.Uint64(mem[addr:]), nil
+}
+
+func (w *Instance) PutUint64(addr uint64, value uint64) error {
+	mem, err := w.GetExportsMem("memory")
+	if err != nil {
+		return err
+	}
+
+	if int(addr) > len(mem) || int(addr+8) > len(mem) {
+		return ErrAddrOverflow
+	}
+
+	binary.LittleEndian.PutUint64(mem[addr:], value)
+
+	return nil
+}
+
 func (w *Instance) HandleError(err error) {
 	var trapError *wasmerGo.TrapError
 	if !errors.As(err, &trapError) {